@@ -0,0 +1,80 @@
+package pqx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"blake.io/pqx/proxy"
+	"github.com/lib/pq"
+)
+
+// KillBackend terminates the server process with pid using
+// pg_terminate_backend, causing its client to see the connection drop as it
+// would if the server crashed. It is an error if no such backend exists.
+func (p *Postgres) KillBackend(ctx context.Context, pid int) error {
+	var ok bool
+	if err := p.db.QueryRowContext(ctx, "SELECT pg_terminate_backend($1)", pid).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("pqx: no backend with pid %d", pid)
+	}
+	return nil
+}
+
+// KillConnections terminates all backends connected to the database dbname
+// and returns the number terminated.
+func (p *Postgres) KillConnections(ctx context.Context, dbname string) (int, error) {
+	const q = `
+		SELECT count(*) FILTER (WHERE pg_terminate_backend(pid))
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()`
+	var n int
+	err := p.db.QueryRowContext(ctx, q, dbname).Scan(&n)
+	return n, err
+}
+
+// KillIdleConnections terminates the backends connected to the database
+// dbname that have been idle, outside of a transaction, for longer than
+// age, such as those kept open by a connection pool of the code under
+// test, and returns the number terminated.
+func (p *Postgres) KillIdleConnections(ctx context.Context, dbname string, age time.Duration) (int, error) {
+	const q = `
+		SELECT count(*) FILTER (WHERE pg_terminate_backend(pid))
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()
+		  AND state = 'idle' AND state_change < now() - $2 * interval '1 microsecond'`
+	var n int
+	err := p.db.QueryRowContext(ctx, q, dbname, age.Microseconds()).Scan(&n)
+	return n, err
+}
+
+// NewProxy returns a proxy, listening on a random local port, that forwards
+// connections to p. It must only be called after Start. Use WithProxy to
+// create databases that are reached through it.
+func (p *Postgres) NewProxy() (*proxy.Proxy, error) {
+	return proxy.Listen(p.Addr())
+}
+
+// Addr returns the address, in host:port form, p listens on, such as for
+// use with Proxy.SetTarget. It must only be called after Start.
+func (p *Postgres) Addr() string {
+	return net.JoinHostPort("localhost", p.port)
+}
+
+// CreateTablespace creates a tablespace named name stored in dir, which must
+// be an absolute path to an existing, empty directory writable by postgres.
+func (p *Postgres) CreateTablespace(ctx context.Context, name, dir string) error {
+	q := fmt.Sprintf("CREATE TABLESPACE %s LOCATION %s", pq.QuoteIdentifier(name), pq.QuoteLiteral(dir))
+	_, err := p.db.ExecContext(ctx, q)
+	return err
+}
+
+// DropTablespace drops the tablespace named name. It fails if any database
+// still stores objects in it.
+func (p *Postgres) DropTablespace(ctx context.Context, name string) error {
+	_, err := p.db.ExecContext(ctx, "DROP TABLESPACE IF EXISTS "+pq.QuoteIdentifier(name))
+	return err
+}
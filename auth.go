@@ -0,0 +1,160 @@
+package pqx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// authDir returns the directory holding the pg_hba.conf, certificates, and
+// keys pqx generates, which is kept outside the data directory so they are
+// not copied by backups.
+func (p *Postgres) authDir() string { return filepath.Join(p.Dir, p.version(), "auth") }
+
+// hbaFile returns the path of the pg_hba.conf generated by writeAuthFiles,
+// or "" if postgres uses the one initdb created.
+func (p *Postgres) hbaFile() string {
+	if !p.ClientCerts && p.SCRAMUser == "" && p.SuperuserPassword == "" {
+		return ""
+	}
+	return filepath.Join(p.authDir(), "pg_hba.conf")
+}
+
+// hbaConf returns the contents of the generated pg_hba.conf. TCP
+// connections as SCRAMUser must authenticate with SCRAM-SHA-256, and others
+// over TLS with a client certificate; all others must authenticate with
+// PasswordAuth if SuperuserPassword is set and passwords is true, and are
+// otherwise trusted, as they are by the pg_hba.conf initdb creates.
+func (p *Postgres) hbaConf(passwords bool) string {
+	method := "trust"
+	if passwords && p.SuperuserPassword != "" {
+		method = p.passwordAuth()
+	}
+	lines := []string{
+		"local all all trust",
+		"local replication all trust",
+	}
+	if p.SCRAMUser != "" {
+		lines = append(lines, "host all "+quoteHBAValue(p.SCRAMUser)+" all scram-sha-256")
+	}
+	if p.ClientCerts {
+		lines = append(lines, "hostssl all all all cert")
+	}
+	lines = append(lines,
+		"host all all all "+method,
+		"host replication all all "+method,
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// quoteHBAValue quotes s for use as a field of pg_hba.conf.
+func quoteHBAValue(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// writeAuthFiles writes the pg_hba.conf, the password file for initdb,
+// and, for ClientCerts, the certificates postgres uses, to authDir. Until
+// setSuperuserPassword runs, TCP connections needing passwords are trusted.
+func (p *Postgres) writeAuthFiles() error {
+	if p.hbaFile() == "" {
+		return nil
+	}
+	dir := p.authDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p.hbaFile(), []byte(p.hbaConf(false)), 0600); err != nil {
+		return err
+	}
+	if p.SuperuserPassword != "" {
+		if err := os.WriteFile(p.pwFile(), []byte(p.SuperuserPassword+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+	if p.ClientCerts {
+		return p.writeCerts(dir)
+	}
+	return nil
+}
+
+// pwFile returns the path of the file initdb reads SuperuserPassword from.
+func (p *Postgres) pwFile() string { return filepath.Join(p.authDir(), "pwfile") }
+
+// passwordAuth returns the pg_hba.conf method for PasswordAuth.
+func (p *Postgres) passwordAuth() string {
+	if p.PasswordAuth == "" {
+		return "scram-sha-256"
+	}
+	return p.PasswordAuth
+}
+
+// setSuperuserPassword sets the superuser's password to SuperuserPassword,
+// which initdb only does for new data directories, undoing any change by
+// a previous run, and then requires passwords by reloading the
+// pg_hba.conf.
+func (p *Postgres) setSuperuserPassword(ctx context.Context) error {
+	if p.SuperuserPassword == "" {
+		return nil
+	}
+	if _, err := p.db.ExecContext(ctx, "ALTER ROLE CURRENT_USER PASSWORD "+pq.QuoteLiteral(p.SuperuserPassword)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p.hbaFile(), []byte(p.hbaConf(true)), 0600); err != nil {
+		return err
+	}
+	var loaded time.Time
+	if err := p.db.QueryRowContext(ctx, "SELECT pg_conf_load_time()").Scan(&loaded); err != nil {
+		return err
+	}
+	if _, err := p.db.ExecContext(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return err
+	}
+	// Reloading is asynchronous; wait for it, so connections without
+	// passwords fail once Start returns.
+	for {
+		var t time.Time
+		if err := p.db.QueryRowContext(ctx, "SELECT pg_conf_load_time()").Scan(&t); err != nil {
+			return err
+		}
+		if t.After(loaded) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// createSCRAMUser creates SCRAMUser, or updates its password if it
+// exists. The password is stored as a SCRAM-SHA-256 verifier because
+// password_encryption is set to scram-sha-256.
+func (p *Postgres) createSCRAMUser(ctx context.Context) error {
+	if p.SCRAMUser == "" {
+		return nil
+	}
+	var exists bool
+	err := p.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_roles WHERE rolname = $1)", p.SCRAMUser).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	q := "CREATE ROLE "
+	if exists {
+		q = "ALTER ROLE "
+	}
+	q += pq.QuoteIdentifier(p.SCRAMUser) + " LOGIN SUPERUSER PASSWORD " + pq.QuoteLiteral(p.SCRAMPassword)
+	_, err = p.db.ExecContext(ctx, q)
+	return err
+}
+
+// SCRAMDSN returns a DSN for connecting to the database dbname as
+// SCRAMUser, authenticating with SCRAM-SHA-256.
+func (p *Postgres) SCRAMDSN(dbname string) string {
+	// Later values take precedence over those in the DSN from p.DSN.
+	return p.DSN(dbname) + " user=" + quoteDSNValue(p.SCRAMUser) + " password=" + quoteDSNValue(p.SCRAMPassword)
+}
@@ -0,0 +1,226 @@
+package pqx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveDir returns the directory WAL segments are archived to when
+// Archive is set. It is next to the data directory.
+func (p *Postgres) ArchiveDir() string { return filepath.Join(p.Dir, p.version(), "archive") }
+
+// archiveCommand returns the archive_command that copies segments into
+// ArchiveDir, refusing to overwrite segments already archived.
+func (p *Postgres) archiveCommand() string {
+	dir := p.ArchiveDir()
+	return fmt.Sprintf("test ! -f '%s/%%f' && cp %%p '%s/%%f'", dir, dir)
+}
+
+// BaseBackup takes a base backup of p into destDir using the bundled
+// pg_basebackup, and returns once the backup is complete and consistent.
+// The WAL needed for consistency is streamed into the backup, so it may be
+// started as-is with a Postgres whose data directory it is, restored from
+// with RestoreToTime, or kept as a snapshot of a seeded cluster for later
+// reuse. If the bundle includes pg_verifybackup (postgres 13 and later), the
+// backup is verified against its manifest before BaseBackup returns.
+//
+// It must only be called after Start.
+func (p *Postgres) BaseBackup(ctx context.Context, destDir string) error {
+	if p.cmd == nil {
+		return errors.New("pqx: BaseBackup called before Start")
+	}
+	if err := p.baseBackup(ctx, destDir); err != nil {
+		return err
+	}
+	verify := filepath.Join(p.binDir, "pg_verifybackup")
+	if _, err := os.Stat(verify); err != nil {
+		return nil // not bundled with this version
+	}
+	cmd := exec.CommandContext(ctx, verify, "--quiet", destDir)
+	cmd.Stdout = p.out
+	cmd.Stderr = p.out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pqx: verifying base backup: %w", err)
+	}
+	return nil
+}
+
+// baseBackup runs pg_basebackup against p, writing the backup to dest with
+// WAL streamed alongside, plus any extra args.
+func (p *Postgres) baseBackup(ctx context.Context, dest string, args ...string) error {
+	args = append([]string{
+		"-d", p.connDSN("postgres"),
+		"-D", dest,
+		"-X", "stream",
+		"-c", "fast",
+	}, args...)
+	cmd := exec.CommandContext(ctx, filepath.Join(p.binDir, "pg_basebackup"), args...)
+	cmd.Stdout = p.out
+	cmd.Stderr = p.out
+	return cmd.Run()
+}
+
+// ArchiveWAL switches to a new WAL segment and waits for the previous one,
+// which contains all changes committed before the call, to be archived. It
+// requires Archive.
+func (p *Postgres) ArchiveWAL(ctx context.Context) error {
+	var seg string
+	if err := p.db.QueryRowContext(ctx, "SELECT pg_walfile_name(pg_switch_wal())").Scan(&seg); err != nil {
+		return err
+	}
+	return poll(ctx, func() (bool, error) {
+		var last string
+		err := p.db.QueryRowContext(ctx, "SELECT coalesce(last_archived_wal, '') FROM pg_stat_archiver").Scan(&last)
+		return last >= seg, err
+	})
+}
+
+// RestoreToTime starts a new instance in dir from the base backup in
+// backupDir, replays WAL archived by p up to target, promotes it, and
+// returns it once it accepts writes. The new instance does not archive.
+//
+// Postgres fails recovery if target is not reached, so at least one
+// transaction committed after target must be archived, using ArchiveWAL,
+// before calling RestoreToTime.
+//
+// The caller must call Shutdown on the returned Postgres when finished.
+func (p *Postgres) RestoreToTime(ctx context.Context, logf func(string, ...any), backupDir, dir string, target time.Time) (*Postgres, error) {
+	r := p.sibling(dir)
+	dataDir := r.dataDir()
+	if err := os.RemoveAll(dataDir); err != nil {
+		return nil, err
+	}
+	if err := copyDir(dataDir, backupDir); err != nil {
+		return nil, err
+	}
+	restore := fmt.Sprintf("cp '%s/%%f' %%p", p.ArchiveDir())
+	conf := fmt.Sprintf("\nrestore_command = %s\nrecovery_target_time = '%s'\nrecovery_target_action = 'promote'\n",
+		quoteConf(restore), target.Format("2006-01-02 15:04:05.999999-07:00"))
+	if err := appendFile(filepath.Join(dataDir, "postgresql.auto.conf"), conf); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600); err != nil {
+		return nil, err
+	}
+	if err := r.Start(ctx, logf); err != nil {
+		return nil, err
+	}
+	err := poll(ctx, func() (bool, error) {
+		var recovering bool
+		err := r.db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&recovering)
+		return !recovering, err
+	})
+	if err != nil {
+		r.Shutdown() //nolint
+		return nil, err
+	}
+	return r, nil
+}
+
+// sibling returns a new, unstarted Postgres in dir with the same version,
+// superuser, and tuning as p, for instances created from p's data, such as
+// replicas and restored backups. Options that only make sense for p, such
+// as Archive and Port, are not copied.
+func (p *Postgres) sibling(dir string) *Postgres {
+	return &Postgres{
+		Version:                 p.Version,
+		Dir:                     dir,
+		DebugLevel:              p.DebugLevel,
+		Superuser:               p.Superuser,
+		SharedBuffers:           p.SharedBuffers,
+		WorkMem:                 p.WorkMem,
+		MaintenanceWorkMem:      p.MaintenanceWorkMem,
+		EffectiveCacheSize:      p.EffectiveCacheSize,
+		Parallel:                p.Parallel,
+		Durable:                 p.Durable,
+		MaxPreparedTransactions: p.MaxPreparedTransactions, // standbys need at least as many as the primary
+		Logical:                 p.Logical,                 // and as many WAL senders and worker processes
+		Config:                  p.Config,                  // which may raise those, or max_connections
+		DropWorkers:             p.DropWorkers,
+		Backoff:                 p.Backoff,
+		FetchAttempts:           p.FetchAttempts,
+		CreateAttempts:          p.CreateAttempts,
+		LogLevel:                p.LogLevel,
+		LogTimestamps:           p.LogTimestamps,
+		AnnotateLogs:            p.AnnotateLogs,
+		PgCtl:                   p.PgCtl,
+		SocketDir:               p.SocketDir,
+		CacheDir:                p.CacheDir,
+		MaxDiskUsage:            p.MaxDiskUsage,
+		DSNOptions:              p.DSNOptions,
+
+		// The copied data directory has the databases of p, marked
+		// for dropping if left over, which are not left over here.
+		copied: true,
+	}
+}
+
+// copyDir copies the files in src to dst, which is created with the
+// permissions postgres requires of data directories.
+func copyDir(dst, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(target, path, info.Mode())
+		}
+	})
+}
+
+func copyFile(dst, src string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// quoteConf quotes v for use as a value in postgresql.conf, which, unlike
+// SQL, has no escape string syntax but treats backslashes in all quoted
+// values as escapes.
+func quoteConf(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(v) + "'"
+}
+
+func appendFile(name, s string) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
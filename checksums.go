@@ -0,0 +1,42 @@
+package pqx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"blake.io/pqx/internal/fetch"
+)
+
+// VerifyChecksums verifies the data checksums of all data in p's data
+// directory using the bundled pg_checksums, which is included with
+// postgres 12 and later. The data directory must have been initialized
+// with DataChecksums set.
+//
+// Postgres only verifies checksums of data directories that were shut down
+// cleanly, so p must not be running: VerifyChecksums must be called before
+// Start or after Shutdown.
+func (p *Postgres) VerifyChecksums(ctx context.Context) error {
+	if p.cmd != nil && !p.stopped {
+		return errors.New("pqx: VerifyChecksums called while running")
+	}
+	binDir := p.binDir
+	if binDir == "" {
+		var err error
+		binDir, err = fetch.Binary(ctx, p.CacheDir, p.version(), p.Backoff, func(string, ...any) {})
+		if err != nil {
+			return err
+		}
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, filepath.Join(binDir, "pg_checksums"), "--check", "-D", p.dataDir())
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pqx: verifying checksums: %w\n%s", err, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
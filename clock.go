@@ -0,0 +1,53 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// clockShim installs pqx.now, which shadows now() when pqx is ahead of
+// pg_catalog in the search_path, returning the time set by SetNow or, if
+// none is set, the real time.
+const clockShim = `
+CREATE SCHEMA pqx;
+CREATE TABLE pqx.clock (now timestamptz);
+CREATE FUNCTION pqx.now() RETURNS timestamptz LANGUAGE sql STABLE AS
+	$$ SELECT coalesce((SELECT now FROM pqx.clock LIMIT 1), pg_catalog.now()) $$;
+`
+
+// WithFakeClock installs a fake clock in the database, so that now() returns
+// the time set by SetNow. It does so by creating a schema named pqx, with a
+// function now, and appending it to the database's search_path, as set by
+// WithSearchPath, ahead of pg_catalog, which is otherwise searched first.
+// The fake clock is installed before the schema passed to CreateDB is
+// applied, so column defaults using now() use it too.
+//
+// Only unqualified calls to now() are affected; CURRENT_TIMESTAMP,
+// pg_catalog.now(), clock_timestamp(), and the like still return the real
+// time.
+func WithFakeClock() DBOption {
+	return func(c *dbConfig) { c.fakeClock = true }
+}
+
+// SetNow sets the time returned by now() in a database created with
+// WithFakeClock, for all connections. If t is the zero time, now() returns
+// the real time again.
+func SetNow(ctx context.Context, db *sql.DB, t time.Time) error {
+	var now any
+	if !t.IsZero() {
+		now = t
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint
+	if _, err := tx.ExecContext(ctx, "DELETE FROM pqx.clock"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO pqx.clock VALUES ($1)", now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
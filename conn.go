@@ -0,0 +1,176 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// A Notice is a non-error message, such as a NOTICE or WARNING, sent by the
+// server to a client; for example by RAISE NOTICE in PL/pgSQL.
+type Notice struct {
+	Severity string // e.g. "NOTICE", "WARNING", "INFO"
+	Code     string // the SQLSTATE code
+	Message  string
+	Detail   string
+	Hint     string
+	Where    string
+}
+
+func noticeFromPQ(e *pq.Error) Notice {
+	return Notice{
+		Severity: e.Severity,
+		Code:     string(e.Code),
+		Message:  e.Message,
+		Detail:   e.Detail,
+		Hint:     e.Hint,
+		Where:    e.Where,
+	}
+}
+
+// openDB returns a *sql.DB for dsn with any connection-level behavior
+// requested by c.
+func openDB(dsn string, c *dbConfig) (*sql.DB, error) {
+	if c.appName != "" {
+		dsn += " application_name=" + quoteDSNValue(c.appName)
+	}
+	if c.driver != "" && c.driver != "postgres" {
+		conn, err := driverConnector(c.driver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.sessionInit) > 0 || c.sessionSetup != nil {
+			conn = &initConnector{Connector: conn, stmts: c.sessionInit, setup: c.sessionSetup}
+		}
+		return sql.OpenDB(conn), nil
+	}
+	pc, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	var conn driver.Connector = pc
+	if c.onNotice != nil {
+		conn = pq.ConnectorWithNoticeHandler(pc, func(e *pq.Error) {
+			c.onNotice(noticeFromPQ(e))
+		})
+	}
+	if len(c.sessionInit) > 0 || c.sessionSetup != nil {
+		conn = &initConnector{Connector: conn, stmts: c.sessionInit, setup: c.sessionSetup}
+	}
+	return sql.OpenDB(conn), nil
+}
+
+// driverConnector returns a connector for dsn using the database/sql
+// driver registered as name.
+func driverConnector(name, dsn string) (driver.Connector, error) {
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	if dc, ok := d.(driver.DriverContext); ok {
+		return dc.OpenConnector(dsn)
+	}
+	return &dsnConnector{dsn: dsn, d: d}, nil
+}
+
+// A dsnConnector connects to dsn with a driver that does not implement
+// driver.DriverContext.
+type dsnConnector struct {
+	dsn string
+	d   driver.Driver
+}
+
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.d.Open(c.dsn) }
+func (c *dsnConnector) Driver() driver.Driver                        { return c.d }
+
+// initConnector runs stmts, and then setup, on each new connection before
+// it is used.
+type initConnector struct {
+	driver.Connector
+	stmts []string
+	setup func(context.Context, *sql.Conn) error
+}
+
+func (c *initConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ex, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("pqx: driver connection does not support ExecContext")
+	}
+	for _, q := range c.stmts {
+		if _, err := ex.ExecContext(ctx, q, nil); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.setup != nil {
+		if err := runSetup(ctx, conn, c.setup); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// runSetup calls setup with a *sql.Conn using conn, which is left open.
+func runSetup(ctx context.Context, conn driver.Conn, setup func(context.Context, *sql.Conn) error) error {
+	db := sql.OpenDB(&oneConnector{conn: &keptConn{conn}})
+	defer db.Close()
+	sc, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	if err := setup(ctx, sc); err != nil {
+		return fmt.Errorf("pqx: session setup: %w", err)
+	}
+	return nil
+}
+
+// oneConnector connects to a single existing connection.
+type oneConnector struct {
+	conn driver.Conn
+	used bool
+}
+
+func (c *oneConnector) Connect(context.Context) (driver.Conn, error) {
+	if c.used {
+		return nil, errors.New("pqx: session setup may only use one connection")
+	}
+	c.used = true
+	return c.conn, nil
+}
+
+func (c *oneConnector) Driver() driver.Driver { return nil }
+
+// keptConn is a driver.Conn that is not closed when database/sql closes
+// it, so that it can be handed to another *sql.DB.
+type keptConn struct {
+	driver.Conn
+}
+
+func (c *keptConn) Close() error { return nil }
+
+func (c *keptConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if ex, ok := c.Conn.(driver.ExecerContext); ok {
+		return ex.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *keptConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
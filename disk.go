@@ -0,0 +1,63 @@
+package pqx
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// DiskUsage returns the total size, in bytes, of the files in p's data
+// directory, including its WAL and temporary files.
+func (p *Postgres) DiskUsage() (int64, error) {
+	var n int64
+	err := filepath.WalkDir(p.dataDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed while walking, such as a temp file
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			n += info.Size()
+		}
+		return nil
+	})
+	return n, err
+}
+
+// A DiskUsageError is returned by CreateDB when p's data directory is larger
+// than MaxDiskUsage.
+type DiskUsageError struct {
+	Dir   string // the data directory
+	Usage int64  // its size in bytes
+	Max   int64  // MaxDiskUsage
+}
+
+func (e *DiskUsageError) Error() string {
+	return fmt.Sprintf("pqx: data directory %s uses %d MB, over MaxDiskUsage of %d MB; look for tests writing large tables, WAL, or temporary files",
+		e.Dir, e.Usage>>20, e.Max>>20)
+}
+
+// checkDiskUsage returns a *DiskUsageError if the data directory is over
+// MaxDiskUsage.
+func (p *Postgres) checkDiskUsage() error {
+	if p.MaxDiskUsage <= 0 {
+		return nil
+	}
+	n, err := p.DiskUsage()
+	if err != nil {
+		return err
+	}
+	if n > p.MaxDiskUsage {
+		return &DiskUsageError{Dir: p.dataDir(), Usage: n, Max: p.MaxDiskUsage}
+	}
+	return nil
+}
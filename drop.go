@@ -0,0 +1,94 @@
+package pqx
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+)
+
+const defaultDropWorkers = 4
+
+// DropStats reports the progress of dropping databases whose cleanup
+// functions have been called.
+type DropStats struct {
+	Pending int64 // queued or in progress
+	Dropped int64
+	Failed  int64
+}
+
+// dropQueue drops, or recycles, databases in the background with a bounded
+// number of workers. Queueing blocks while all workers are busy and the
+// queue is full, so that bursts of cleanups do not open a connection each.
+type dropQueue struct {
+	start sync.Once
+	ch    chan func()
+	wg    sync.WaitGroup // counts queued and in-progress jobs
+
+	pending int64
+	dropped int64
+	failed  int64
+}
+
+// dropDB queues the database name to be dropped.
+func (p *Postgres) dropDB(name string) {
+	q := &p.drops
+	atomic.AddInt64(&q.pending, 1)
+	p.enqueue(func() {
+		p.drop(name)
+		atomic.AddInt64(&q.pending, -1)
+	})
+}
+
+// drop drops the database name, recording the result in p's DropStats.
+func (p *Postgres) drop(name string) {
+	q := &p.drops
+	_, err := p.db.ExecContext(context.Background(), "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(name))
+	if err != nil {
+		atomic.AddInt64(&q.failed, 1)
+		p.log.infof("pqx: dropping database %s: %v", name, err)
+	} else {
+		atomic.AddInt64(&q.dropped, 1)
+	}
+}
+
+// enqueue queues f to be run by a drop worker, blocking while the queue
+// is full.
+func (p *Postgres) enqueue(f func()) {
+	q := &p.drops
+	q.start.Do(func() {
+		n := p.DropWorkers
+		if n <= 0 {
+			n = defaultDropWorkers
+		}
+		q.ch = make(chan func(), n)
+		for i := 0; i < n; i++ {
+			go p.dropWorker()
+		}
+	})
+	q.wg.Add(1)
+	q.ch <- f
+}
+
+func (p *Postgres) dropWorker() {
+	q := &p.drops
+	for f := range q.ch {
+		f()
+		q.wg.Done()
+	}
+}
+
+// waitDrops waits for all queued drops, and recycling, to finish.
+func (p *Postgres) waitDrops() { p.drops.wg.Wait() }
+
+// DropStats returns statistics about databases dropped, or waiting to be
+// dropped, by cleanup functions.
+func (p *Postgres) DropStats() DropStats {
+	q := &p.drops
+	return DropStats{
+		Pending: atomic.LoadInt64(&q.pending),
+		Dropped: atomic.LoadInt64(&q.dropped),
+		Failed:  atomic.LoadInt64(&q.failed),
+	}
+}
@@ -0,0 +1,41 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// TempBlocksWritten runs query with EXPLAIN (ANALYZE, BUFFERS) and returns
+// the number of blocks the query wrote to temporary files; that is, how much
+// it spilled to disk because it needed more than work_mem. The query is run
+// in a transaction that is rolled back, so it leaves no changes behind.
+func TempBlocksWritten(ctx context.Context, db *sql.DB, query string, args ...any) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint
+
+	var out []byte
+	q := "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) " + query
+	if err := tx.QueryRowContext(ctx, q, args...).Scan(&out); err != nil {
+		return 0, queryError(q, err)
+	}
+
+	// Buffer counts of a plan node include those of its children, so
+	// the top node has the total.
+	var plans []struct {
+		Plan struct {
+			TempWrittenBlocks int64 `json:"Temp Written Blocks"`
+		}
+	}
+	if err := json.Unmarshal(out, &plans); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, p := range plans {
+		n += p.Plan.TempWrittenBlocks
+	}
+	return n, nil
+}
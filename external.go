@@ -0,0 +1,51 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"blake.io/pqx/logplex"
+	"github.com/lib/pq"
+)
+
+// startExternal connects p to the server at External instead of starting
+// one. Unlike Start, it does not drop leftover databases, since other
+// clients of the server may be using them.
+func (p *Postgres) startExternal(ctx context.Context) error {
+	startStart := time.Now()
+	p.tail = &tailBuffer{max: startLogTail}
+	p.tailOut = &logplex.Logplex{Sink: p.tail}
+
+	db, err := sql.Open(p.driverName(), p.externalBase())
+	if err != nil {
+		return err
+	}
+	p.db = db
+	if err := p.pingUntilUp(ctx); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&p.up, 1)
+	p.recordSetup(func(s *SetupStats) { s.Start = time.Since(startStart) })
+	return nil
+}
+
+// externalBase returns External in key=value form, so that later values
+// added to it take precedence.
+func (p *Postgres) externalBase() string {
+	dsn := p.External
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if kv, err := pq.ParseURL(dsn); err == nil {
+			dsn = kv
+		}
+	}
+	return dsn
+}
+
+// externalDSN is DSN for an External server.
+func (p *Postgres) externalDSN(dbname string) string {
+	return p.externalBase() + fmt.Sprintf(" dbname=%s", quoteDSNValue(DBName(dbname)))
+}
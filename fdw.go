@@ -0,0 +1,62 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ConnectFDW wires the database local is connected to to the database
+// remote on p using postgres_fdw: it installs the extension, creates a
+// foreign server named server, maps the current user to the user and
+// password of the DSN for remote, or the same user if the DSN has none,
+// and imports the tables of remote's public schema as foreign tables into
+// a schema named server.
+//
+// After ConnectFDW, queries in local may refer to remote's tables as
+// server.table.
+func (p *Postgres) ConnectFDW(ctx context.Context, local *sql.DB, server, remote string) error {
+	opts := parseDSN(p.connDSN(remote))
+	if opts["user"] == "" {
+		var user string
+		if err := local.QueryRowContext(ctx, "SELECT current_user").Scan(&user); err != nil {
+			return err
+		}
+		opts["user"] = user
+	}
+
+	// Options of the connection, other than those postgres_fdw sets
+	// itself, belong to the server, and credentials to the user
+	// mapping.
+	var serverOpts, userOpts []string
+	for _, k := range sortedKeys(opts) {
+		opt := pq.QuoteIdentifier(k) + " " + pq.QuoteLiteral(opts[k])
+		switch k {
+		case "client_encoding", "fallback_application_name":
+		case "user", "password":
+			userOpts = append(userOpts, opt)
+		default:
+			serverOpts = append(serverOpts, opt)
+		}
+	}
+
+	ident := pq.QuoteIdentifier(server)
+	stmts := []string{
+		"CREATE EXTENSION IF NOT EXISTS postgres_fdw",
+		fmt.Sprintf("CREATE SERVER %s FOREIGN DATA WRAPPER postgres_fdw OPTIONS (%s)",
+			ident, strings.Join(serverOpts, ", ")),
+		fmt.Sprintf("CREATE USER MAPPING FOR CURRENT_USER SERVER %s OPTIONS (%s)",
+			ident, strings.Join(userOpts, ", ")),
+		fmt.Sprintf("CREATE SCHEMA %s", ident),
+		fmt.Sprintf("IMPORT FOREIGN SCHEMA public FROM SERVER %s INTO %s", ident, ident),
+	}
+	for _, q := range stmts {
+		if _, err := local.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("pqx: ConnectFDW: %w", err)
+		}
+	}
+	return nil
+}
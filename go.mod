@@ -5,7 +5,6 @@ go 1.18
 require (
 	github.com/lib/pq v1.10.5
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	kr.dev/diff v0.2.0
 	kr.dev/errorfmt v0.1.1
 )
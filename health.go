@@ -0,0 +1,138 @@
+package pqx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// healthInterval is how long CreateDB trusts a successful health check
+// before checking again.
+const healthInterval = time.Second
+
+// restartTimeout is how long restart waits for postgres to accept
+// connections.
+const restartTimeout = 30 * time.Second
+
+// A DiedError is returned by CreateDB when postgres stopped accepting
+// connections after starting, such as when it was killed by the OOM
+// killer, and Restart is not set or restarting it failed.
+type DiedError struct {
+	At  time.Time // when pqx found postgres dead
+	Err error     // the error connecting to it, or restarting it
+	Log []string  // the last lines of its output
+}
+
+func (e *DiedError) Error() string {
+	return fmt.Sprintf("pqx: shared postgres died at %s: %v; last logs:\n\t%s",
+		e.At.Format(LogTimeFormat), e.Err, strings.Join(e.Log, "\n\t"))
+}
+
+func (e *DiedError) Unwrap() error { return e.Err }
+
+// checkHealth returns a *DiedError if postgres has exited, restarting it
+// first if Restart is set. Once postgres is found dead, and not restarted,
+// checkHealth returns the same error without checking again. If postgres
+// fails pings but is still running, such as when it is busy or out of
+// connections, checkHealth returns the error of the ping.
+func (p *Postgres) checkHealth(ctx context.Context) error {
+	p.hmu.Lock()
+	defer p.hmu.Unlock()
+	if p.died != nil {
+		return p.died
+	}
+	if time.Since(p.healthyAt) < healthInterval {
+		return nil
+	}
+	err := p.ping(ctx)
+	if err == nil {
+		p.healthyAt = time.Now()
+		return nil
+	}
+	if ctx.Err() != nil || !p.gone() {
+		return err
+	}
+
+	atomic.StoreInt32(&p.up, 0)
+	died := &DiedError{At: time.Now(), Err: err, Log: p.tailLines()}
+	if !p.Restart {
+		p.died = died
+		return died
+	}
+	p.log.log(LevelWarn, "%v; restarting it", died)
+	if err := p.restart(ctx); err != nil {
+		died.Err = fmt.Errorf("restarting: %w", err)
+		died.Log = p.tailLines()
+		p.died = died
+		return died
+	}
+	atomic.StoreInt32(&p.up, 1)
+	p.healthyAt = time.Now()
+	return nil
+}
+
+// ping pings postgres, retrying once with a new connection in case an
+// idle one was broken.
+func (p *Postgres) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if p.db.PingContext(ctx) == nil {
+		return nil
+	}
+	p.db.SetMaxIdleConns(0)
+	p.db.SetMaxIdleConns(2) // the database/sql default
+	return p.db.PingContext(ctx)
+}
+
+// restart stops what remains of postgres and starts it again in the same
+// data directory and on the same port.
+func (p *Postgres) restart(ctx context.Context) error {
+	if p.PgCtl {
+		p.stopPgCtl("immediate") //nolint
+	} else {
+		// It may be hung rather than gone.
+		p.cmd.Process.Signal(syscall.SIGQUIT) //nolint
+		p.cmd.Wait()                          //nolint
+	}
+	ctx, cancel := context.WithTimeout(ctx, restartTimeout)
+	defer cancel()
+	p.resetReady()
+	cmd, err := p.launch(ctx, io.MultiWriter(p.out, p.tailOut))
+	if err != nil {
+		return err
+	}
+	p.cmd = cmd
+	return p.pingUntilUp(ctx)
+}
+
+// gone reports whether postgres has exited. An External server is never
+// known to have.
+func (p *Postgres) gone() bool {
+	if p.External != "" {
+		return false
+	}
+	pid := p.Pid()
+	if pid <= 0 {
+		return true
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil || proc.Signal(syscall.Signal(0)) != nil {
+		return true
+	}
+	// A postgres that was a child of this process may linger as a
+	// zombie, which can be signaled, until it is waited for, but only
+	// a running one listens on its port.
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", p.port), time.Second)
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return false
+}
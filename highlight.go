@@ -0,0 +1,77 @@
+package pqx
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// errorMarker is inserted into queries at the position of an error.
+const errorMarker = "💥"
+
+// HighlightError returns query with a marker inserted at the position
+// postgres reported for err. If err does not carry a position, query is
+// returned unchanged.
+//
+// For example, the error for "SELECT * FROM bar" where bar does not exist
+// is highlighted as:
+//
+//	SELECT * FROM 💥bar
+func HighlightError(query string, err error) string {
+	pos := errorPosition(err)
+	if pos < 0 {
+		return query
+	}
+	rr := []rune(query)
+	if pos > len(rr) {
+		pos = len(rr)
+	}
+	return string(rr[:pos]) + errorMarker + string(rr[pos:])
+}
+
+// errorPosition returns the zero-based rune offset of err in the query
+// that caused it, or -1 if err does not report a position.
+func errorPosition(err error) int {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Position == "" {
+		return -1
+	}
+	n, perr := strconv.Atoi(pqErr.Position)
+	if perr != nil || n < 1 {
+		return -1
+	}
+	return n - 1 // postgres positions are 1-based
+}
+
+// queryError wraps err, which was returned from running query, with the
+// highlighted line of query that caused it, if known.
+func queryError(query string, err error) error {
+	h := HighlightError(query, err)
+	if h == query {
+		return err
+	}
+	lines := strings.Split(h, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, errorMarker) {
+			return &QueryError{Line: i + 1, Highlight: strings.TrimSpace(line), Err: err}
+		}
+	}
+	return err
+}
+
+// A QueryError records the line of a query, such as a schema passed to
+// CreateDB, that caused Err.
+type QueryError struct {
+	Line      int    // 1-based line number in the query
+	Highlight string // the line, with the error position marked
+	Err       error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%v\nline %d: %s", e.Err, e.Line, e.Highlight)
+}
+
+func (e *QueryError) Unwrap() error { return e.Err }
@@ -0,0 +1,31 @@
+package pqx_test
+
+import (
+	"errors"
+	"testing"
+
+	"blake.io/pqx"
+	"github.com/lib/pq"
+)
+
+func TestHighlightError(t *testing.T) {
+	cases := []struct {
+		query string
+		err   error
+		want  string
+	}{
+		{"SELECT * FROM bar", &pq.Error{Position: "15"}, "SELECT * FROM 💥bar"},
+		{"SELECT 'ü', x", &pq.Error{Position: "13"}, "SELECT 'ü', 💥x"},
+		{"SELECT", &pq.Error{Position: "99"}, "SELECT💥"},
+		{"SELECT", &pq.Error{}, "SELECT"},
+		{"SELECT", &pq.Error{Position: "junk"}, "SELECT"},
+		{"SELECT", errors.New("not a pq error"), "SELECT"},
+		{"SELECT", nil, "SELECT"},
+	}
+	for _, tt := range cases {
+		got := pqx.HighlightError(tt.query, tt.err)
+		if got != tt.want {
+			t.Errorf("HighlightError(%q, %v) = %q; want %q", tt.query, tt.err, got, tt.want)
+		}
+	}
+}
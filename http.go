@@ -0,0 +1,44 @@
+package pqx
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Handler returns an http.Handler reporting the state of p, for scripts and
+// editors that wait for a long-running instance, such as one shared by test
+// processes or run as a development server, without parsing its logs:
+//
+//	GET /healthz   responds 200 once p accepts connections, and 503 before
+//	               then and after it shuts down
+//	GET /dsn       responds with the DSN for the database named by the
+//	               dbname query parameter, or "postgres" if absent, once p
+//	               accepts connections, and 503 otherwise
+//
+// The handler may be served before p is started.
+func (p *Postgres) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !p.isUp() || p.db.PingContext(r.Context()) != nil {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/dsn", func(w http.ResponseWriter, r *http.Request) {
+		if !p.isUp() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		dbname := r.URL.Query().Get("dbname")
+		if dbname == "" {
+			dbname = "postgres"
+		}
+		fmt.Fprintln(w, p.DSN(dbname))
+	})
+	return mux
+}
+
+// isUp reports whether p has started and not yet shut down.
+func (p *Postgres) isUp() bool { return atomic.LoadInt32(&p.up) == 1 }
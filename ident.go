@@ -0,0 +1,74 @@
+package pqx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxIdentLen is the maximum length, in bytes, of a postgres identifier
+// (NAMEDATALEN-1). Postgres silently truncates longer identifiers.
+const maxIdentLen = 63
+
+// DBName returns the name CreateDB gives a database requested as name.
+// Names of up to 63 bytes are returned unchanged. Longer names, which
+// postgres would otherwise silently truncate, are truncated and suffixed
+// with a hash of the full name, so that distinct long names remain
+// distinct and the same name always maps to the same database.
+func DBName(name string) string {
+	if len(name) <= maxIdentLen {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:4])
+	cut := maxIdentLen - len(suffix)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut-- // don't split a multi-byte rune
+	}
+	return name[:cut] + suffix
+}
+
+// quoteDSNValue quotes v, if needed, for use as a value in a key=value
+// connection string.
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+	return "'" + v + "'"
+}
+
+// parseDSN returns the values of a key=value connection string, such as
+// one built with quoteDSNValue, by key. Later values of a key take
+// precedence, as they do for libpq.
+func parseDSN(dsn string) map[string]string {
+	isSpace := func(c byte) bool { return strings.IndexByte(" \t\n\r", c) >= 0 }
+	m := map[string]string{}
+	s := dsn
+	for {
+		s = strings.TrimLeft(s, " \t\n\r")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return m
+		}
+		key := strings.TrimSpace(s[:i])
+		s = strings.TrimLeft(s[i+1:], " \t\n\r")
+		quoted := strings.HasPrefix(s, "'")
+		if quoted {
+			s = s[1:]
+		}
+		var v strings.Builder
+		for s != "" && (quoted && s[0] != '\'' || !quoted && !isSpace(s[0])) {
+			if s[0] == '\\' && len(s) > 1 {
+				s = s[1:]
+			}
+			v.WriteByte(s[0])
+			s = s[1:]
+		}
+		if quoted && s != "" {
+			s = s[1:] // closing quote
+		}
+		m[key] = v.String()
+	}
+}
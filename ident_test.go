@@ -0,0 +1,34 @@
+package pqx_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"blake.io/pqx"
+)
+
+func TestDBName(t *testing.T) {
+	short := "testfoo_0123456789abcdef"
+	if got := pqx.DBName(short); got != short {
+		t.Errorf("DBName(%q) = %q; want unchanged", short, got)
+	}
+
+	long1 := strings.Repeat("a", 100) + "_1"
+	long2 := strings.Repeat("a", 100) + "_2"
+	got1, got2 := pqx.DBName(long1), pqx.DBName(long2)
+	if len(got1) > 63 || len(got2) > 63 {
+		t.Errorf("names too long: %q (%d), %q (%d)", got1, len(got1), got2, len(got2))
+	}
+	if got1 == got2 {
+		t.Errorf("distinct names collide: %q", got1)
+	}
+	if again := pqx.DBName(long1); again != got1 {
+		t.Errorf("DBName not deterministic: %q != %q", again, got1)
+	}
+
+	multi := strings.Repeat("é", 40)
+	if got := pqx.DBName(multi); !utf8.ValidString(got) || len(got) > 63 {
+		t.Errorf("DBName(%q) = %q; want valid UTF-8 of at most 63 bytes", multi, got)
+	}
+}
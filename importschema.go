@@ -0,0 +1,70 @@
+package pqx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"blake.io/pqx/internal/backoff"
+	"blake.io/pqx/internal/fetch"
+)
+
+// ImportSchema returns the schema of the database at sourceDSN, such as a
+// staging database, dumped with the pg_dump bundled with DefaultVersion, for
+// passing to CreateDB or Template, so tests can use the real schema instead
+// of a hand-maintained copy. Ownership and privileges are not included.
+//
+// pg_dump refuses to dump databases of newer major versions than its own.
+func ImportSchema(ctx context.Context, sourceDSN string) (schema string, err error) {
+	binDir, err := fetch.Binary(ctx, "", DefaultVersion, backoff.Strategy{}, func(string, ...any) {})
+	if err != nil {
+		return "", err
+	}
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, filepath.Join(binDir, "pg_dump"),
+		"--schema-only",
+		"--no-owner",
+		"--no-privileges",
+		"--dbname", sourceDSN,
+	)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("pqx: ImportSchema: %w\n%s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return trimDump(out.String()), nil
+}
+
+// trimDump removes the statements of a pg_dump script that would change
+// the session it is applied in for later use: the SET statements and
+// set_config calls of its preamble, such as those emptying search_path and
+// setting client_min_messages and check_function_bodies, and the SETs of
+// default_tablespace and default_table_access_method before each table.
+// pg_dump schema-qualifies all names, so none are needed to apply it.
+func trimDump(dump string) string {
+	lines := strings.SplitAfter(dump, "\n")
+	var b strings.Builder
+	preamble := true
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if preamble && trimmed != "" && !strings.HasPrefix(trimmed, "--") && !isSessionSet(trimmed) {
+			preamble = false
+		}
+		if isSessionSet(trimmed) && (preamble ||
+			strings.HasPrefix(trimmed, "SET default_tablespace ") ||
+			strings.HasPrefix(trimmed, "SET default_table_access_method ")) {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// isSessionSet reports whether line is a statement of a pg_dump script
+// changing a setting of the session.
+func isSessionSet(line string) bool {
+	return (strings.HasPrefix(line, "SET ") || strings.HasPrefix(line, "SELECT pg_catalog.set_config(")) && strings.HasSuffix(line, ";")
+}
@@ -10,10 +10,73 @@ package backoff
 
 import (
 	"context"
+	"math"
 	"math/rand"
 	"time"
 )
 
+// Strategy describes how a Backoff grows its delay between consecutive
+// failures. The zero value is the original tailscale schedule: n²×10ms,
+// randomized between 0.5-1.5x, with no limit on attempts.
+type Strategy struct {
+	// Initial is the delay after the first failure. If zero, 10ms is
+	// used.
+	Initial time.Duration
+
+	// Base is the exponential growth factor applied to Initial after
+	// each consecutive failure. If Base is less than or equal to 1, the
+	// delay instead grows quadratically (n²×Initial).
+	Base float64
+
+	// Max caps the delay between attempts. If zero, the max backoff
+	// provided to NewBackoff is used.
+	Max time.Duration
+
+	// Jitter randomizes each delay d to within d×(1±Jitter). If zero,
+	// 0.5 is used. If negative, delays are not randomized.
+	Jitter float64
+
+	// MaxAttempts is the number of consecutive failures after which the
+	// Backoff reports itself Exhausted. If zero, there is no limit.
+	MaxAttempts int
+}
+
+// Delay returns the delay, before jitter, after n consecutive failures,
+// capped at max.
+func (s Strategy) Delay(n int, max time.Duration) time.Duration {
+	if s.Max > 0 {
+		max = s.Max
+	}
+	initial := s.Initial
+	if initial == 0 {
+		initial = 10 * time.Millisecond
+	}
+
+	var f float64
+	if s.Base > 1 {
+		f = float64(initial) * math.Pow(s.Base, float64(n-1))
+	} else {
+		// n^2 backoff timer is a little smoother than the
+		// common choice of 2^n.
+		f = float64(initial) * float64(n*n)
+	}
+	if max > 0 && f > float64(max) {
+		return max
+	}
+	return time.Duration(f)
+}
+
+func (s Strategy) jitter() float64 {
+	switch {
+	case s.Jitter < 0:
+		return 0
+	case s.Jitter == 0:
+		return 0.5
+	default:
+		return s.Jitter
+	}
+}
+
 // Backoff tracks state the history of consecutive failures and sleeps
 // an increasing amount of time, up to a provided limit.
 type Backoff struct {
@@ -25,6 +88,10 @@ type Backoff struct {
 	// logf is the function used for log messages when backing off.
 	logf func(format string, args ...any)
 
+	// Strategy controls the schedule of delays. The zero value is
+	// the default schedule.
+	Strategy Strategy
+
 	// NewTimer is the function that acts like time.NewTimer.
 	// It's for use in unit tests.
 	NewTimer func(time.Duration) *time.Timer
@@ -46,6 +113,15 @@ func NewBackoff(name string, logf func(string, ...any), maxBackoff time.Duration
 	}
 }
 
+// Attempts returns the number of consecutive failures seen so far.
+func (b *Backoff) Attempts() int { return b.n }
+
+// Exhausted reports whether the number of consecutive failures has reached
+// Strategy.MaxAttempts, in which case the caller should stop retrying.
+func (b *Backoff) Exhausted() bool {
+	return b.Strategy.MaxAttempts > 0 && b.n >= b.Strategy.MaxAttempts
+}
+
 // Backoff sleeps an increasing amount of time if err is non-nil.
 // and the context is not a
 // It resets the backoff schedule once err is nil.
@@ -61,15 +137,16 @@ func (b *Backoff) BackOff(ctx context.Context, err error) {
 	}
 
 	b.n++
-	// n^2 backoff timer is a little smoother than the
-	// common choice of 2^n.
-	d := time.Duration(b.n*b.n) * 10 * time.Millisecond
-	if d > b.maxBackoff {
-		d = b.maxBackoff
+	if b.Exhausted() {
+		// No point sleeping before a retry that won't happen.
+		return
 	}
-	// Randomize the delay between 0.5-1.5 x msec, in order
+	d := b.Strategy.Delay(b.n, b.maxBackoff)
+	// Randomize the delay to within d×(1±jitter), in order
 	// to prevent accidental "thundering herd" problems.
-	d = time.Duration(float64(d) * (rand.Float64() + 0.5))
+	if j := b.Strategy.jitter(); j > 0 {
+		d = time.Duration(float64(d) * (1 - j + 2*j*rand.Float64()))
+	}
 
 	if d >= b.LogLongerThan {
 		b.logf("%s: [v1] backoff: %d msec", b.name, d.Milliseconds())
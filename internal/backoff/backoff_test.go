@@ -0,0 +1,54 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStrategyDelay(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		s    Strategy
+		n    int
+		max  time.Duration
+		want time.Duration
+	}{
+		{Strategy{}, 1, time.Second, 10 * ms},
+		{Strategy{}, 3, time.Second, 90 * ms},
+		{Strategy{}, 100, time.Second, time.Second},
+		{Strategy{Initial: ms}, 4, time.Second, 16 * ms},
+		{Strategy{Base: 2}, 1, time.Second, 10 * ms},
+		{Strategy{Base: 2}, 4, time.Second, 80 * ms},
+		{Strategy{Base: 2, Initial: ms}, 2000, time.Second, time.Second},
+		{Strategy{Max: 50 * ms}, 10, time.Second, 50 * ms},
+	}
+	for _, tt := range cases {
+		got := tt.s.Delay(tt.n, tt.max)
+		if got != tt.want {
+			t.Errorf("%+v.Delay(%d, %v) = %v; want %v", tt.s, tt.n, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	b := NewBackoff("test", t.Logf, time.Millisecond)
+	b.Strategy = Strategy{Initial: time.Microsecond, Jitter: -1, MaxAttempts: 2}
+
+	ctx := context.Background()
+	err := errors.New("boom")
+	for i := 0; i < 2; i++ {
+		if b.Exhausted() {
+			t.Fatalf("exhausted after %d attempts", b.Attempts())
+		}
+		b.BackOff(ctx, err)
+	}
+	if !b.Exhausted() {
+		t.Fatalf("not exhausted after %d attempts", b.Attempts())
+	}
+	b.BackOff(ctx, nil)
+	if b.Exhausted() {
+		t.Fatal("exhausted after reset")
+	}
+}
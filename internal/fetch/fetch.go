@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -13,13 +14,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"blake.io/pqx/internal/backoff"
 	"github.com/xi2/xz"
 	"kr.dev/errorfmt"
 )
 
-var envCacheDir = os.Getenv("PQX_BIN_DIR")
-
 func BinaryURL(version string) string {
 	const fetchURLTempl = "https://repo1.maven.org/maven2/io/zonky/test/postgres/embedded-postgres-binaries-$OS-$ARCH/$VERSION/embedded-postgres-binaries-$OS-$ARCH-$VERSION.jar"
 
@@ -31,24 +32,60 @@ func BinaryURL(version string) string {
 	).Replace(fetchURLTempl)
 }
 
-func pgDir(version string) string {
-	cacheDir := envCacheDir
+// CacheDir returns the directory binaries are cached in when no other is
+// given: $PQX_CACHE_DIR if set, or else .cache/pqx in the older
+// $PQX_BIN_DIR, where earlier versions cached them, or else pqx in
+// $XDG_CACHE_HOME, or in $HOME/.cache if that is unset.
+func CacheDir() (string, error) {
+	if dir := os.Getenv("PQX_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv("PQX_BIN_DIR"); dir != "" {
+		return filepath.Join(dir, ".cache", "pqx"), nil
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "pqx"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("%w; try setting PQX_CACHE_DIR instead", err)
+	}
+	return filepath.Join(home, ".cache", "pqx"), nil
+}
+
+// Cached reports whether the binaries for version are already cached in
+// cacheDir, or in CacheDir if cacheDir is empty, so that Binary will not
+// download them.
+func Cached(cacheDir, version string) bool {
 	if cacheDir == "" {
-		cacheDir = os.Getenv("HOME")
-		if cacheDir == "" {
-			cacheDir, _ = os.UserHomeDir()
-		}
-		if cacheDir == "" {
-			panic("no HOME; try setting PQX_BIN_DIR instead")
+		var err error
+		cacheDir, err = CacheDir()
+		if err != nil {
+			return false
 		}
 	}
-	return filepath.Join(cacheDir, ".cache/pqx", version)
+	_, err := os.Stat(filepath.Join(cacheDir, version, "bin"))
+	return err == nil
 }
 
-func Binary(ctx context.Context, version string) (binDir string, err error) {
+// defaultMaxAttempts is the number of download attempts made when the
+// provided strategy does not set MaxAttempts.
+const defaultMaxAttempts = 3
+
+// Binary returns the bin directory of the cached postgres for version,
+// downloading and extracting it first if it is not already cached in
+// cacheDir, or in CacheDir if cacheDir is empty. Downloads that fail with
+// network or server errors are retried according to s.
+func Binary(ctx context.Context, cacheDir, version string, s backoff.Strategy, logf func(string, ...any)) (binDir string, err error) {
 	defer errorfmt.Handlef("fetchBinary: %w", &err)
 
-	dir := pgDir(version)
+	if cacheDir == "" {
+		cacheDir, err = CacheDir()
+		if err != nil {
+			return "", err
+		}
+	}
+	dir := filepath.Join(cacheDir, version)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return "", err
 	}
@@ -64,21 +101,51 @@ func Binary(ctx context.Context, version string) (binDir string, err error) {
 	binURL := BinaryURL(version)
 	defer errorfmt.Handlef("%s: %w", binURL, &err)
 
+	if s.MaxAttempts == 0 {
+		s.MaxAttempts = defaultMaxAttempts
+	}
+	b := backoff.NewBackoff("fetch", logf, 30*time.Second)
+	b.Strategy = s
+	for {
+		err = download(ctx, dir, binURL)
+		if err == nil {
+			return binDir, nil
+		}
+		var se *statusError
+		if errors.As(err, &se) && se.code < 500 {
+			return "", err // not worth retrying
+		}
+		b.BackOff(ctx, err)
+		if b.Exhausted() || ctx.Err() != nil {
+			return "", err
+		}
+		logf("fetch: retrying after error: %v", err)
+	}
+}
+
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.status)
+}
+
+func download(ctx context.Context, dir, binURL string) error {
 	req, err := http.NewRequestWithContext(ctx, "GET", binURL, nil)
 	if err != nil {
-		return "", err
+		return err
 	}
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer res.Body.Close()
-
-	if err := extractJar(ctx, dir, res.Body); err != nil {
-		return "", err
+	if res.StatusCode != http.StatusOK {
+		return &statusError{res.StatusCode, res.Status}
 	}
-
-	return binDir, nil
+	return extractJar(ctx, dir, res.Body)
 }
 
 func extractJar(ctx context.Context, dir string, r io.Reader) (err error) {
@@ -0,0 +1,30 @@
+package fetch
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheDir(t *testing.T) {
+	cases := []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"HOME": "/home/u"}, "/home/u/.cache/pqx"},
+		{map[string]string{"HOME": "/home/u", "XDG_CACHE_HOME": "/xdg"}, "/xdg/pqx"},
+		{map[string]string{"XDG_CACHE_HOME": "/xdg", "PQX_BIN_DIR": "/bin"}, "/bin/.cache/pqx"},
+		{map[string]string{"PQX_BIN_DIR": "/bin", "PQX_CACHE_DIR": "/cache"}, "/cache"},
+	}
+	for _, tt := range cases {
+		for _, name := range []string{"HOME", "XDG_CACHE_HOME", "PQX_BIN_DIR", "PQX_CACHE_DIR"} {
+			t.Setenv(name, tt.env[name])
+		}
+		got, err := CacheDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != filepath.FromSlash(tt.want) {
+			t.Errorf("CacheDir() with %v = %q; want %q", tt.env, got, tt.want)
+		}
+	}
+}
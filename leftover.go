@@ -0,0 +1,71 @@
+package pqx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// leftoverComment is the comment CreateDB sets on databases its cleanup
+// drops, so that those left by a run that exited without cleaning up, such
+// as one killed by go test's -timeout, can be dropped by the next.
+const leftoverComment = "pqx: dropped on cleanup"
+
+// markLeftover marks the database name as one to be dropped by
+// dropLeftovers if its cleanup never runs.
+func (p *Postgres) markLeftover(ctx context.Context, name string) error {
+	q := fmt.Sprintf("COMMENT ON DATABASE %s IS %s", pq.QuoteIdentifier(name), pq.QuoteLiteral(leftoverComment))
+	_, err := p.db.ExecContext(ctx, q)
+	return err
+}
+
+// dropLeftovers drops the databases marked by markLeftover that remain
+// from previous runs against the same data directory, which Start holds
+// the lock for, except recycled ones, which are adopted by takeRecycled.
+// It does nothing on standbys.
+func (p *Postgres) dropLeftovers(ctx context.Context) error {
+	var standby bool
+	if err := p.db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&standby); err != nil {
+		return err
+	}
+	if standby {
+		return nil // read-only, and its databases are the primary's
+	}
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT d.datname FROM pg_database d
+		JOIN pg_shdescription s ON s.objoid = d.oid AND s.classoid = 'pg_database'::regclass
+		WHERE s.description = $1 AND left(d.datname, length($2)) <> $2`,
+		leftoverComment, recyclePrefix)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		// Postgres may have been left running, along with clients of
+		// the previous run.
+		if _, err := p.KillConnections(ctx, name); err != nil {
+			return err
+		}
+		if _, err := p.db.ExecContext(ctx, "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(name)); err != nil {
+			return err
+		}
+	}
+	if len(names) > 0 {
+		p.log.infof("pqx: dropped %d databases left by a previous run", len(names))
+	}
+	return nil
+}
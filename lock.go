@@ -0,0 +1,40 @@
+package pqx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockDir takes an exclusive lock, shared with other processes, on dir,
+// which is created if needed. If another process holds the lock, lockDir
+// waits for it to be released or for ctx to be done. The lock is released
+// by calling unlock, or when the process exits.
+func lockDir(ctx context.Context, dir string, logf func(string, ...any)) (unlock func(), err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "pqx.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	name := f.Name()
+	waiting := false
+	err = poll(ctx, func() (bool, error) {
+		ok, err := tryLock(f)
+		if err == nil && !ok && !waiting {
+			logf("pqx: waiting for another process to release %s", name)
+			waiting = true
+		}
+		return ok, err
+	})
+	if err != nil {
+		f.Close()
+		if waiting {
+			return nil, fmt.Errorf("pqx: waiting for another process to release %s: %w", name, err)
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,160 @@
+package pqx
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"blake.io/pqx/logplex"
+)
+
+// A Level is the importance of a log message. Levels mirror those of
+// log/slog: higher levels are more important, and the zero Level is
+// LevelInfo.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+// logger is the leveled logging layer shared by pqx and the postgres output
+// it routes. All messages, whether produced by pqx or by postgres, funnel
+// through a logger so that they are filtered the same way.
+type logger struct {
+	logf  func(string, ...any)
+	level Level // minimum level logged
+}
+
+func newLogger(logf func(string, ...any), level Level) *logger {
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	return &logger{logf: logf, level: level}
+}
+
+func (l *logger) enabled(lv Level) bool { return lv >= l.level }
+
+func (l *logger) log(lv Level, format string, args ...any) {
+	if l.enabled(lv) {
+		l.logf(format, args...)
+	}
+}
+
+func (l *logger) debugf(format string, args ...any) { l.log(LevelDebug, format, args...) }
+func (l *logger) infof(format string, args ...any)  { l.log(LevelInfo, format, args...) }
+
+// sink returns an io.Writer suitable for use as a logplex sink; it logs each
+// line written to it at lv.
+func (l *logger) sink(lv Level) io.Writer {
+	if !l.enabled(lv) {
+		return io.Discard
+	}
+	return logplex.LogfWriter(l.logf)
+}
+
+// tailBuffer is a logplex sink that remembers the last max lines written to
+// it.
+type tailBuffer struct {
+	max int
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// A write may hold a line and its continuations.
+	b.lines = append(b.lines, strings.Split(strings.TrimRight(string(p), "\n"), "\n")...)
+	if len(b.lines) > b.max {
+		b.lines = b.lines[len(b.lines)-b.max:]
+	}
+	return len(p), nil
+}
+
+// Lines returns a copy of the remembered lines, oldest first.
+func (b *tailBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.lines...)
+}
+
+// prefixSink is like sink, but prefixes each line with prefix. Lines must
+// be written whole, as by a logplex.
+func (l *logger) prefixSink(lv Level, prefix string) io.Writer {
+	if !l.enabled(lv) {
+		return io.Discard
+	}
+	return &prefixWriter{logf: l.logf, prefix: prefix}
+}
+
+type prefixWriter struct {
+	logf   func(string, ...any)
+	prefix string
+}
+
+func (w *prefixWriter) Write(line []byte) (int, error) {
+	w.logf("%s%s", w.prefix, strings.TrimRight(string(line), "\n"))
+	return len(line), nil
+}
+
+// groupWriter is a logplex sink that logs each postgres message together
+// with the lines that follow it, such as its DETAIL and STATEMENT, in a
+// single call to logf. A group is logged when the next message begins, or
+// when the writer is flushed.
+type groupWriter struct {
+	logf func(string, ...any)
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (w *groupWriter) Write(line []byte) (int, error) {
+	s := strings.TrimRight(string(line), "\n")
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.lines) > 0 && !isFollowLine(s) {
+		w.flushLocked()
+	}
+	w.lines = append(w.lines, s)
+	return len(line), nil
+}
+
+func (w *groupWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushLocked()
+	return nil
+}
+
+func (w *groupWriter) flushLocked() {
+	if len(w.lines) > 0 {
+		w.logf("%s", strings.Join(w.lines, "\n"))
+		w.lines = w.lines[:0]
+	}
+}
+
+// isFollowLine reports whether line, as routed from postgres output,
+// belongs to the message before it: a continuation of a multi-line value,
+// or a line labeled as detail of the message.
+func isFollowLine(line string) bool {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		return true
+	}
+	// Labels are followed by a colon and two spaces, as in
+	// "DETAIL:  Key (id)=(1) already exists.", and may be preceded by
+	// the timestamp and annotations added by log_line_prefix.
+	i := strings.Index(line, ":  ")
+	if i < 0 {
+		return false
+	}
+	label := line[strings.LastIndexByte(line[:i], ' ')+1 : i]
+	switch label {
+	case "DETAIL", "HINT", "CONTEXT", "STATEMENT", "QUERY", "LOCATION":
+		return true
+	}
+	return false
+}
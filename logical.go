@@ -0,0 +1,243 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ReplicaPairOptions configures StartReplicaPair.
+type ReplicaPairOptions struct {
+	// Dir is the directory the publisher and subscriber keep their data
+	// in. If empty, a temporary directory is used and removed by
+	// Shutdown.
+	Dir string
+
+	Version string // the postgres version of both instances; see Postgres.Version
+
+	// DBName is the name of the database created on both instances. If
+	// empty, "pqx" is used.
+	DBName string
+
+	// Schema is applied to the database on both instances before
+	// replication begins. Logical replication does not replicate DDL,
+	// so the replicated tables must exist on both sides.
+	Schema string
+
+	// Tables are the tables published. If empty, all tables are
+	// published.
+	Tables []string
+
+	// Logf receives the logs of both instances.
+	Logf func(string, ...any)
+}
+
+// A ReplicaPair is a publisher and a subscriber instance connected by
+// logical replication. It is created by StartReplicaPair.
+type ReplicaPair struct {
+	Publisher  *Postgres
+	Subscriber *Postgres
+
+	// PublisherDB and SubscriberDB are connected to the replicated
+	// database on each instance.
+	PublisherDB  *sql.DB
+	SubscriberDB *sql.DB
+
+	dbname  string
+	tempDir string
+	cleanup []func()
+}
+
+const (
+	pairPublication  = "pqx_pub"
+	pairSubscription = "pqx_sub"
+)
+
+// StartReplicaPair starts a publisher and a subscriber instance with
+// wal_level=logical, creates the database described by opts on both, and
+// subscribes the subscriber to a publication of opts.Tables on the publisher.
+// It returns once the initial copy of all published tables is complete.
+//
+// The caller must call Shutdown when finished with the pair.
+func StartReplicaPair(ctx context.Context, opts ReplicaPairOptions) (_ *ReplicaPair, err error) {
+	rp := &ReplicaPair{dbname: opts.DBName}
+	if rp.dbname == "" {
+		rp.dbname = "pqx"
+	}
+	dir := opts.Dir
+	if dir == "" {
+		dir, err = os.MkdirTemp("", "pqx-pair")
+		if err != nil {
+			return nil, err
+		}
+		rp.tempDir = dir
+	}
+	defer func() {
+		if err != nil {
+			rp.Shutdown() //nolint
+		}
+	}()
+
+	start := func(name string) (*Postgres, *sql.DB, error) {
+		p := &Postgres{
+			Version: opts.Version,
+			Dir:     filepath.Join(dir, name),
+			Logical: true,
+		}
+		logf := prefixLogf(opts.Logf, "["+name+"] ")
+		if err := p.Start(ctx, logf); err != nil {
+			return nil, nil, err
+		}
+		rp.cleanup = append(rp.cleanup, func() { p.Shutdown() }) //nolint
+		db, _, cleanup, err := p.CreateDB(ctx, logf, rp.dbname, opts.Schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		rp.cleanup = append(rp.cleanup, cleanup)
+		return p, db, nil
+	}
+	rp.Publisher, rp.PublisherDB, err = start("publisher")
+	if err != nil {
+		return nil, err
+	}
+	rp.Subscriber, rp.SubscriberDB, err = start("subscriber")
+	if err != nil {
+		return nil, err
+	}
+
+	tables := "ALL TABLES"
+	if len(opts.Tables) > 0 {
+		tables = "TABLE " + strings.Join(opts.Tables, ", ")
+	}
+	q := fmt.Sprintf("CREATE PUBLICATION %s FOR %s", pairPublication, tables)
+	if _, err := rp.PublisherDB.ExecContext(ctx, q); err != nil {
+		return nil, err
+	}
+	q = fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s",
+		pairSubscription,
+		pq.QuoteLiteral(rp.Publisher.connDSN(rp.dbname)),
+		pairPublication,
+	)
+	if _, err := rp.SubscriberDB.ExecContext(ctx, q); err != nil {
+		return nil, err
+	}
+	// Dropping the subscription also drops its replication slot on the
+	// publisher, which would otherwise keep the publisher's database
+	// from being dropped.
+	rp.cleanup = append(rp.cleanup, func() {
+		rp.SubscriberDB.Exec("DROP SUBSCRIPTION " + pairSubscription) //nolint
+	})
+
+	if err := rp.waitForInitialSync(ctx); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// waitForInitialSync waits for the subscriber to finish copying the
+// initial contents of all published tables.
+func (rp *ReplicaPair) waitForInitialSync(ctx context.Context) error {
+	const q = `
+		SELECT count(*) FROM pg_subscription_rel r
+		JOIN pg_subscription s ON s.oid = r.srsubid
+		WHERE s.subname = $1 AND r.srsubstate <> 'r'`
+	return poll(ctx, func() (bool, error) {
+		var pending int
+		err := rp.SubscriberDB.QueryRowContext(ctx, q, pairSubscription).Scan(&pending)
+		return pending == 0, err
+	})
+}
+
+// Sync waits until the subscriber has applied all changes committed on the
+// publisher before Sync was called.
+func (rp *ReplicaPair) Sync(ctx context.Context) error {
+	var lsn string
+	if err := rp.PublisherDB.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()").Scan(&lsn); err != nil {
+		return err
+	}
+	const q = `
+		SELECT coalesce(bool_and(replay_lsn >= $1::pg_lsn), false)
+		FROM pg_stat_replication
+		WHERE application_name = $2`
+	return poll(ctx, func() (bool, error) {
+		var caughtUp bool
+		err := rp.PublisherDB.QueryRowContext(ctx, q, lsn, pairSubscription).Scan(&caughtUp)
+		return caughtUp, err
+	})
+}
+
+// Shutdown drops the subscription, shuts down both instances, and removes
+// the data directory if it was temporary.
+func (rp *ReplicaPair) Shutdown() error {
+	for i := len(rp.cleanup) - 1; i >= 0; i-- {
+		rp.cleanup[i]()
+	}
+	rp.cleanup = nil
+	if rp.tempDir != "" {
+		return os.RemoveAll(rp.tempDir)
+	}
+	return nil
+}
+
+// poll calls f until it reports done, returns an error, or ctx is done.
+func poll(ctx context.Context, f func() (done bool, err error)) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		done, err := f()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// prefixLogf returns a logf that prefixes each message with prefix. If
+// logf is nil, the returned logf discards messages.
+func prefixLogf(logf func(string, ...any), prefix string) func(string, ...any) {
+	if logf == nil {
+		return func(string, ...any) {}
+	}
+	return func(format string, args ...any) {
+		logf(prefix+"%s", fmt.Sprintf(format, args...))
+	}
+}
+
+// CreateLogicalSlot creates a logical replication slot named name in db's
+// database using the output plugin, such as "test_decoding" or "pgoutput".
+// The server must be running with Logical set.
+//
+// A slot retains WAL and prevents its database from being dropped until it
+// is dropped with DropSlot.
+func CreateLogicalSlot(ctx context.Context, db *sql.DB, name, plugin string) error {
+	_, err := db.ExecContext(ctx, "SELECT pg_create_logical_replication_slot($1, $2)", name, plugin)
+	return err
+}
+
+// CreatePhysicalSlot creates a physical replication slot named name, for
+// use by streaming replicas.
+func CreatePhysicalSlot(ctx context.Context, db *sql.DB, name string) error {
+	_, err := db.ExecContext(ctx, "SELECT pg_create_physical_replication_slot($1)", name)
+	return err
+}
+
+// DropSlot drops the replication slot named name. It is not an error if the
+// slot does not exist.
+func DropSlot(ctx context.Context, db *sql.DB, name string) error {
+	const q = `SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1`
+	_, err := db.ExecContext(ctx, q, name)
+	return err
+}
@@ -0,0 +1,234 @@
+// Package logplex provides a line-oriented io.Writer that routes each line
+// written to it to a sink chosen by the line's key.
+//
+// A Logplex is typically used as the Stdout and Stderr of a subprocess that
+// interleaves logs for many consumers, such as a postgres server logging
+// for many databases. Each consumer registers interest in a key using
+// Watch, and Split extracts the key from each line.
+package logplex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode"
+)
+
+// ErrClosed is returned by Write after Close has been called.
+var ErrClosed = errors.New("logplex: write to closed Logplex")
+
+// A Logplex routes lines written to it to the writers registered with Watch.
+// Lines with no key, or a key no writer is watching, are written to Sink.
+//
+// It is safe to call the methods of a Logplex concurrently.
+type Logplex struct {
+	// Sink receives all lines not claimed by a watcher.
+	Sink io.Writer
+
+	// Split splits line into a key and a message. If the key matches a
+	// prefix registered with Watch, the message is written to the
+	// corresponding writer. Messages beginning with a space are
+	// considered continuations of the previous line, such as the lines
+	// of a stack trace, and are routed to the same writer. A line and
+	// the continuations written with it in the same call to Write are
+	// written to their writer in a single call, so that they are kept
+	// together.
+	//
+	// If Split is nil, all lines go to Sink.
+	Split func(line []byte) (key, message []byte)
+
+	lineBuf bytes.Buffer
+
+	mu       sync.Mutex
+	sinks    map[string]io.Writer
+	lastSeen []byte // key of the last line that was not a continuation
+	closed   bool
+
+	// group holds the last line routed, and its continuations, until
+	// the next line that is not a continuation or the end of Write.
+	group  bytes.Buffer
+	groupW io.Writer
+}
+
+// Watch routes all future lines with a key matching prefix to w.
+func (lp *Logplex) Watch(prefix string, w io.Writer) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if lp.sinks == nil {
+		lp.sinks = map[string]io.Writer{}
+	}
+	lp.sinks[prefix] = w
+}
+
+var newline = []byte{'\n'}
+
+// Write writes p to the underlying buffer and flushes each newline to their
+// corresponding sinks. Complete lines are routed as soon as they are written;
+// only a trailing partial line is held until its newline is written or Flush
+// is called.
+func (lp *Logplex) Write(p []byte) (int, error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.closed {
+		return 0, ErrClosed
+	}
+
+	p0 := p
+	for {
+		before, after, hasNewline := bytes.Cut(p, newline)
+		lp.lineBuf.Write(before)
+		if hasNewline {
+			lp.lineBuf.Write(newline)
+			if err := lp.flushLocked(); err != nil {
+				lp.group.Reset()
+				return 0, err
+			}
+			p = after
+		} else {
+			if err := lp.flushGroup(); err != nil {
+				return 0, err
+			}
+			return len(p0), nil
+		}
+	}
+}
+
+// caller must hold mu
+func (lp *Logplex) flushLocked() error {
+	defer lp.lineBuf.Reset()
+
+	if lp.lineBuf.Len() == 0 {
+		return nil
+	}
+
+	// There is only one line in the buffer. Check the prefix and send to
+	// the appropriate sink.
+	if lp.Split == nil {
+		_, err := lp.Sink.Write(lp.lineBuf.Bytes())
+		return err
+	}
+
+	line := lp.lineBuf.Bytes()
+	key, message := lp.Split(line)
+	cont := isContinuation(message)
+	if cont {
+		key = lp.lastSeen
+	} else {
+		lp.lastSeen = append(lp.lastSeen[:0], key...)
+	}
+	w, watched := lp.sinks[string(key)]
+	if !watched {
+		w, message = lp.Sink, line
+	}
+	if cont && lp.group.Len() > 0 {
+		lp.group.Write(message)
+		return nil
+	}
+	if err := lp.flushGroup(); err != nil {
+		return err
+	}
+	lp.groupW = w
+	lp.group.Write(message)
+	return nil
+}
+
+// flushGroup writes the grouped lines to their writer.
+//
+// caller must hold mu
+func (lp *Logplex) flushGroup() error {
+	if lp.group.Len() == 0 {
+		return nil
+	}
+	_, err := lp.groupW.Write(lp.group.Bytes())
+	lp.group.Reset()
+	lp.groupW = nil
+	return err
+}
+
+// Unwatch stops routing lines with a key matching prefix, and flushes the
+// writer it routed them to if it is a Flusher. Future lines with that key
+// are written to Sink.
+func (lp *Logplex) Unwatch(prefix string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if f, ok := lp.sinks[prefix].(Flusher); ok {
+		f.Flush() //nolint
+	}
+	delete(lp.sinks, prefix)
+}
+
+// A Flusher is a writer that buffers what is written to it, such as to
+// group related lines. Logplex flushes writers registered with Watch that
+// implement Flusher when it is flushed and when they are unwatched.
+type Flusher interface {
+	Flush() error
+}
+
+// Flush flushes the any underlying buffered contents to any corresponding sink,
+// and flushes the writers registered with Watch that implement Flusher.
+//
+// The contents flushed may not be a complete line, or have enough data to
+// determine the proper sink and instead send to Sink.
+//
+// Flush should only be called when no more data will be written to Write.
+func (lp *Logplex) Flush() error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	err := lp.flushLocked()
+	if gerr := lp.flushGroup(); err == nil {
+		err = gerr
+	}
+	for _, w := range lp.sinks {
+		if f, ok := w.(Flusher); ok {
+			if ferr := f.Flush(); err == nil {
+				err = ferr
+			}
+		}
+	}
+	return err
+}
+
+// Close flushes any buffered contents and causes all future calls to Write
+// to return ErrClosed. It is safe to call Close more than once.
+func (lp *Logplex) Close() error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if lp.closed {
+		return nil
+	}
+	lp.closed = true
+	if err := lp.flushLocked(); err != nil {
+		return err
+	}
+	return lp.flushGroup()
+}
+
+type logfWriter struct {
+	logf func(string, ...any)
+}
+
+// LogfWriter returns an io.Writer that calls logf once per call to Write
+// to log the written bytes verbatim.
+func LogfWriter(logf func(string, ...any)) io.Writer {
+	return &logfWriter{logf}
+}
+
+func (w *logfWriter) Write(p []byte) (int, error) {
+	w.logf("%s", p)
+	return len(p), nil
+}
+
+// LogfFromWriter returns a logf-style function that formats its arguments
+// and writes the result to w.
+func LogfFromWriter(w io.Writer) func(string, ...any) {
+	return func(format string, args ...any) {
+		fmt.Fprintf(w, format, args...)
+	}
+}
+
+func isContinuation(line []byte) bool {
+	return len(line) > 0 && unicode.IsSpace(rune(line[0]))
+}
@@ -81,6 +81,32 @@ func TestLogplex(t *testing.T) {
 	diff.Test(t, t.Errorf, d3.String(), "3\n\tcontinuation\n")
 }
 
+type writeRecorder struct{ writes []string }
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestContinuationGrouping(t *testing.T) {
+	var sink, a, b writeRecorder
+	lp := &Logplex{Sink: &sink, Split: testSplitter}
+	lp.Watch("a", &a)
+	lp.Watch("b", &b)
+
+	// A line is written together with its continuations.
+	lp.Write([]byte("a::ERROR: boom\n\tframe 1\n\tframe 2\na::next\n")) //nolint
+	diff.Test(t, t.Errorf, a.writes, []string{"ERROR: boom\n\tframe 1\n\tframe 2\n", "next\n"})
+
+	// Continuations of lines with unwatched keys are not routed to the
+	// last watched key.
+	lp.Write([]byte("b::one\n"))            //nolint
+	lp.Write([]byte("c::other\n\tframe\n")) //nolint
+	lp.Write([]byte("\tlate frame\n"))      //nolint
+	diff.Test(t, t.Errorf, b.writes, []string{"one\n"})
+	diff.Test(t, t.Errorf, sink.writes, []string{"c::other\n\tframe\n", "\tlate frame\n"})
+}
+
 // run with -race
 func TestConcurrency(t *testing.T) {
 	var (
@@ -142,3 +168,63 @@ func BenchmarkWrite(b *testing.B) {
 		lp.Write(line) //nolint
 	}
 }
+
+func TestClose(t *testing.T) {
+	var d0 strings.Builder
+	lp := &Logplex{Sink: &d0}
+
+	if _, err := lp.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lp.Close(); err != nil {
+		t.Fatalf("second Close = %v; want nil", err)
+	}
+	diff.Test(t, t.Errorf, d0.String(), "partial")
+
+	if _, err := lp.Write([]byte("more\n")); err != ErrClosed {
+		t.Errorf("Write after Close = %v; want %v", err, ErrClosed)
+	}
+}
+
+type flushCounter struct {
+	strings.Builder
+	flushes int
+}
+
+func (w *flushCounter) Flush() error {
+	w.flushes++
+	return nil
+}
+
+func TestFlushWatchers(t *testing.T) {
+	lp := &Logplex{Sink: io.Discard, Split: testSplitter}
+	var w flushCounter
+	lp.Watch("a", &w)
+	if err := lp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if w.flushes != 1 {
+		t.Errorf("flushes after Flush = %d; want 1", w.flushes)
+	}
+	lp.Unwatch("a")
+	if w.flushes != 2 {
+		t.Errorf("flushes after Unwatch = %d; want 2", w.flushes)
+	}
+}
+
+func TestLogfWriter(t *testing.T) {
+	var got string
+	w := LogfWriter(func(format string, args ...any) {
+		got = fmt.Sprintf(format, args...)
+	})
+	const line = "LOG:  statement: SELECT 100%s"
+	if _, err := w.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	if got != line {
+		t.Errorf("logged %q; want %q", got, line)
+	}
+}
@@ -0,0 +1,104 @@
+package pqx
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// A Manager creates databases on a Postgres instance for programs that are
+// not tests, such as benchmark harnesses, examples, and local tooling. It
+// gives each database a unique name and tracks it until its cleanup
+// function, or Close, is called.
+//
+//	m := pqx.NewManager(&pqx.Postgres{Dir: dir}, log.Printf)
+//	defer m.Close()
+//	db, dsn, cleanup, err := m.CreateDB(ctx, "bench", schema)
+type Manager struct {
+	p    *Postgres
+	logf func(string, ...any)
+
+	mu       sync.Mutex
+	next     int
+	cleanups map[int]func()
+	closed   bool
+}
+
+// NewManager returns a Manager of databases on p, which is started by the
+// first call to CreateDB if not already started. Logs of p and all
+// databases are written to logf.
+func NewManager(p *Postgres, logf func(string, ...any)) *Manager {
+	return &Manager{p: p, logf: logf, cleanups: map[int]func(){}}
+}
+
+// Postgres returns the instance m creates databases on.
+func (m *Manager) Postgres() *Postgres { return m.p }
+
+// CreateDB is like Postgres.CreateDB, but the database is named prefix
+// followed by a random suffix. The returned cleanup function may be called
+// more than once; only the first call has effect.
+func (m *Manager) CreateDB(ctx context.Context, prefix, schema string, opts ...DBOption) (db *sql.DB, dsn string, cleanup func(), err error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, "", nil, fmt.Errorf("pqx: Manager is closed")
+	}
+	m.mu.Unlock()
+
+	if err := m.p.Start(ctx, m.logf); err != nil {
+		return nil, "", nil, err
+	}
+	name := fmt.Sprintf("%s_%s", prefix, randomSuffix())
+	db, dsn, drop, err := m.p.CreateDB(ctx, m.logf, name, schema, opts...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	m.mu.Lock()
+	id := m.next
+	m.next++
+	var once sync.Once
+	cleanup = func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.cleanups, id)
+			m.mu.Unlock()
+			drop()
+		})
+	}
+	m.cleanups[id] = cleanup
+	m.mu.Unlock()
+	return db, dsn, cleanup, nil
+}
+
+// Close calls the cleanup functions of all databases created by m that
+// have not been cleaned up, and then shuts down the instance.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	cleanups := make([]func(), 0, len(m.cleanups))
+	for _, f := range m.cleanups {
+		cleanups = append(cleanups, f)
+	}
+	m.mu.Unlock()
+
+	for _, f := range cleanups {
+		f()
+	}
+	if m.p.cmd == nil {
+		return nil // never started
+	}
+	return m.p.Shutdown()
+}
+
+// randomSuffix returns a random string suitable for making database names
+// unique.
+func randomSuffix() string {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", buf)
+}
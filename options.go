@@ -0,0 +1,410 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"blake.io/pqx/proxy"
+	"github.com/lib/pq"
+)
+
+// A DBOption configures a database created by CreateDB.
+type DBOption func(*dbConfig)
+
+type dbConfig struct {
+	onNotice func(Notice)
+	proxy    *proxy.Proxy
+	settings [][2]string // name, quoted value pairs set with ALTER DATABASE
+
+	sessionInit  []string // statements run on each new connection
+	sessionSetup func(context.Context, *sql.Conn) error
+
+	tablespace string
+	template   string
+	owner      string
+	encoding   string
+	collate    string // LC_COLLATE
+	ctype      string // LC_CTYPE
+	connLimit  int    // CONNECTION LIMIT; zero means unlimited
+	unlogged   bool
+	replace    bool // drop any existing database of the same name first
+	keep       bool // do not drop the database on cleanup
+	recycle    bool
+	analyze    bool
+	fakeClock  bool
+	searchPath []string
+	schemas    map[string]string // DDL by schema name
+	seed       func(context.Context, *sql.DB) error
+	extensions []string
+	restore    string // dump file
+	masks      []Mask
+	cached     bool // populate in a template, as for seed, extensions, and restore
+	appName    string
+	driver     string        // database/sql driver name for the returned *sql.DB; see Postgres.DriverName
+	dsnOptions [][2]string   // key, value pairs added to the DSN
+	idleAge    time.Duration // kill sessions idle longer before dropping; zero means never
+	err        error         // from an invalid option, returned by CreateDB
+}
+
+func (c *dbConfig) set(name, value string) {
+	c.settings = append(c.settings, [2]string{name, pq.QuoteLiteral(value)})
+}
+
+// setList is like set for settings that are lists, such as search_path,
+// whose elements must be given separately.
+func (c *dbConfig) setList(name string, values ...string) {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = pq.QuoteLiteral(v)
+	}
+	c.settings = append(c.settings, [2]string{name, strings.Join(quoted, ", ")})
+}
+
+// needsTemplate reports whether databases configured by c are populated in
+// a template database they are cloned from, because doing so for each
+// would be expensive.
+func (c *dbConfig) needsTemplate() bool {
+	return c.cached || c.seed != nil || len(c.extensions) > 0 || c.restore != ""
+}
+
+// changesCreate reports whether c sets the clauses of CREATE DATABASE set
+// by WithOwner, WithEncoding, WithLocale, and WithConnLimit.
+func (c *dbConfig) changesCreate() bool {
+	return c.owner != "" || c.encoding != "" || c.collate != "" || c.ctype != "" || c.connLimit != 0
+}
+
+// poolable reports whether a Pool can honour c, which, since its databases
+// are created ahead of time, only sets connection options and database
+// settings.
+func (c *dbConfig) poolable() bool {
+	return c.template == "" && c.tablespace == "" && !c.unlogged && !c.replace && !c.keep && !c.recycle && !c.analyze &&
+		!c.fakeClock && len(c.schemas) == 0 && !c.needsTemplate() && !c.changesCreate()
+}
+
+func newDBConfig(opts []DBOption) *dbConfig {
+	c := &dbConfig{}
+	for _, o := range opts {
+		o(c)
+	}
+	if len(c.searchPath) > 0 || len(c.schemas) > 0 || c.fakeClock {
+		path := c.searchPath
+		switch {
+		case len(path) > 0:
+		case len(c.schemas) > 0:
+			path = append(sortedKeys(c.schemas), "public")
+		default:
+			path = []string{"$user", "public"} // the default
+		}
+		path = path[:len(path):len(path)]
+		if c.fakeClock {
+			// see WithFakeClock
+			path = append(path, "pqx", "pg_catalog")
+		}
+		c.setList("search_path", path...)
+	}
+	return c
+}
+
+// WithNoticeHandler calls h with each notice or warning the server sends to
+// any connection of the database, including those raised while applying
+// the schema. Handlers given by more than one WithNoticeHandler are all
+// called, in order.
+func WithNoticeHandler(h func(Notice)) DBOption {
+	return func(c *dbConfig) {
+		prev := c.onNotice
+		if prev == nil {
+			c.onNotice = h
+			return
+		}
+		c.onNotice = func(n Notice) {
+			prev(n)
+			h(n)
+		}
+	}
+}
+
+// WithProxy causes CreateDB to return a DSN, and a *sql.DB, that connect to
+// the database through px, which is typically created with NewProxy.
+func WithProxy(px *proxy.Proxy) DBOption {
+	return func(c *dbConfig) { c.proxy = px }
+}
+
+// WithApplicationName sets application_name to name for the connections of
+// the returned *sql.DB, and adds it as fallback_application_name to the
+// returned DSN, so that pg_stat_activity and server logs attribute sessions
+// to their creator, such as a test.
+func WithApplicationName(name string) DBOption {
+	return func(c *dbConfig) { c.appName = name }
+}
+
+// WithSessionSetup calls setup with each new connection of the returned
+// *sql.DB before it is used, to apply session-level settings, such as SET
+// ROLE, search_path, or statement_timeout, as applications commonly do when
+// configuring their pools. The *sql.Conn is only valid during the call.
+// Connections made with the returned DSN are not affected.
+func WithSessionSetup(setup func(ctx context.Context, conn *sql.Conn) error) DBOption {
+	return func(c *dbConfig) { c.sessionSetup = setup }
+}
+
+// WithDSNOption adds key=value, such as connect_timeout=5, to the returned
+// DSN and the connections of the returned *sql.DB. Options added later take
+// precedence over earlier ones and those in Postgres.DSNOptions.
+func WithDSNOption(key, value string) DBOption {
+	return func(c *dbConfig) { c.dsnOptions = append(c.dsnOptions, [2]string{key, value}) }
+}
+
+// WithKillIdle makes the database's cleanup function terminate sessions that
+// have been idle for longer than age before dropping it, so the drop does
+// not fail because code under test keeps connections open, such as in a
+// global pool. Use Postgres.KillIdleConnections to do so at other times.
+func WithKillIdle(age time.Duration) DBOption {
+	return func(c *dbConfig) { c.idleAge = age }
+}
+
+// WithWorkMem sets work_mem (e.g. "64kB") for all sessions of the database.
+// Small values force sorts and hashes to spill to temporary files.
+func WithWorkMem(size string) DBOption {
+	return func(c *dbConfig) { c.set("work_mem", size) }
+}
+
+// WithTempFileLimit sets temp_file_limit (e.g. "1MB") for all sessions of
+// the database. Queries that need more temporary file space than the limit
+// fail, simulating a disk running out of space.
+func WithTempFileLimit(size string) DBOption {
+	return func(c *dbConfig) { c.set("temp_file_limit", size) }
+}
+
+// WithFunctionTracking sets track_functions to "pl" for all sessions of
+// the database, so that the calls of SQL and PL/pgSQL functions are counted
+// in pg_stat_user_functions.
+func WithFunctionTracking() DBOption {
+	return func(c *dbConfig) { c.set("track_functions", "pl") }
+}
+
+// WithTriggerLogging logs DDL statements, and, using auto_explain, the plan
+// of each statement, including those run by triggers and functions, with
+// the time spent in and number of calls to each trigger it fired, routing
+// them to CreateDB's logf like other logs of the database. It is verbose and
+// slows queries, so it is meant for debugging trigger-heavy schemas.
+func WithTriggerLogging() DBOption {
+	return func(c *dbConfig) {
+		c.set("log_statement", "ddl")
+		c.set("session_preload_libraries", "auto_explain")
+		c.set("auto_explain.log_min_duration", "0")
+		c.set("auto_explain.log_nested_statements", "on")
+		c.set("auto_explain.log_analyze", "on")
+		c.set("auto_explain.log_triggers", "on")
+	}
+}
+
+// WithTablespace creates the database in the named tablespace, which may be
+// created with CreateTablespace.
+func WithTablespace(name string) DBOption {
+	return func(c *dbConfig) { c.tablespace = name }
+}
+
+// WithTemplate creates the database as a copy of the database named name,
+// such as one returned by Postgres.Template, instead of an empty one. The
+// schema passed to CreateDB, if any, is applied after copying.
+//
+// Name may also be one of the databases postgres creates: template1, which
+// is copied by default, including any objects installed into it, or
+// template0, which holds only the standard objects and is needed to create
+// a database with a different locale or encoding than template1's.
+func WithTemplate(name string) DBOption {
+	return func(c *dbConfig) { c.template = name }
+}
+
+// WithOwner creates the database owned by the named role, which must
+// exist, instead of the superuser. Objects created by the schema are still
+// owned by the superuser.
+func WithOwner(role string) DBOption {
+	return func(c *dbConfig) { c.owner = role }
+}
+
+// WithEncoding creates the database with the named character set encoding,
+// such as "LATIN1", instead of the instance's default. Unless WithTemplate
+// is used, the database is copied from template0, as postgres requires
+// for encodings different from template1's.
+func WithEncoding(encoding string) DBOption {
+	return func(c *dbConfig) { c.encoding = encoding }
+}
+
+// WithLocale creates the database with the LC_COLLATE collate and
+// LC_CTYPE ctype, such as "C" or "en_US.UTF-8", instead of the instance's
+// defaults. An empty value leaves that default. Unless WithTemplate is
+// used, the database is copied from template0, as for WithEncoding.
+func WithLocale(collate, ctype string) DBOption {
+	return func(c *dbConfig) { c.collate, c.ctype = collate, ctype }
+}
+
+// WithConnLimit limits the number of concurrent connections to the
+// database to n. Superusers, like the one pqx connects as, are exempt.
+func WithConnLimit(n int) DBOption {
+	return func(c *dbConfig) { c.connLimit = n }
+}
+
+// WithUnloggedTables converts all tables created by the schema to UNLOGGED
+// tables, which skip writing WAL, for faster writes in tests where
+// durability does not matter. Tables created after CreateDB returns are
+// not affected.
+func WithUnloggedTables() DBOption {
+	return func(c *dbConfig) { c.unlogged = true }
+}
+
+// WithParallel configures parallel query for all sessions of the database,
+// overriding Postgres.Parallel. The number of workers is still limited by
+// the instance's max_worker_processes.
+func WithParallel(pl Parallel) DBOption {
+	return func(c *dbConfig) {
+		for _, kv := range pl.settings() {
+			c.set(kv[0], kv[1])
+		}
+	}
+}
+
+// WithReplace causes CreateDB to drop any existing database of the same
+// name, terminating its connections, before creating it, instead of
+// failing. It allows reusing stable names across runs.
+func WithReplace() DBOption {
+	return func(c *dbConfig) { c.replace = true }
+}
+
+// WithKeep causes the cleanup returned by CreateDB to close its connections
+// without dropping the database, leaving it for inspection after the caller
+// is done with it.
+func WithKeep() DBOption {
+	return func(c *dbConfig) { c.keep = true }
+}
+
+// WithRecycle causes the cleanup returned by CreateDB to reset the database
+// and set it aside, instead of dropping it, for reuse by a later CreateDB
+// with the same schema and options that also uses WithRecycle. Reusing a
+// database only requires renaming it, which is much faster than creating
+// one and applying its schema.
+//
+// Resetting truncates all tables and restarts all sequences, so schemas
+// that insert rows should be applied with WithTemplate instead, and the
+// database's schema must not be changed after CreateDB returns.
+func WithRecycle() DBOption {
+	return func(c *dbConfig) { c.recycle = true }
+}
+
+// WithAnalyze runs ANALYZE after applying the schema, so that the planner
+// has statistics about any rows it inserts rather than the defaults it
+// assumes for empty tables, making plans, and assertions about them, match
+// those of realistic data. Templates created by Postgres.Template are always
+// analyzed, and their statistics are copied to databases created from them.
+func WithAnalyze() DBOption {
+	return func(c *dbConfig) { c.analyze = true }
+}
+
+// WithRandomSeed makes random() reproducible by seeding it with seed, which
+// must be between -1 and 1, on each new connection of the returned *sql.DB.
+// CreateDB returns an error for other seeds.
+// It also disables synchronized sequential scans, so that concurrent scans
+// of a table do not change the order rows are returned in.
+//
+// Other sources of nondeterminism are not affected: gen_random_uuid and
+// other functions using strong randomness, the order of rows returned by
+// queries without ORDER BY after rows are updated, and connections made
+// without the returned *sql.DB, such as through its DSN.
+func WithRandomSeed(seed float64) DBOption {
+	return func(c *dbConfig) {
+		if !(seed >= -1 && seed <= 1) { // also false for NaN
+			c.err = fmt.Errorf("pqx: WithRandomSeed: seed %v not between -1 and 1", seed)
+			return
+		}
+		c.sessionInit = append(c.sessionInit, fmt.Sprintf("SELECT setseed(%v)", seed))
+		c.set("synchronize_seqscans", "off")
+	}
+}
+
+// WithSearchPath sets the search_path for all sessions of the database to
+// schemas, in order, so that unqualified names resolve as they do in
+// production. The special name "$user" may be included.
+func WithSearchPath(schemas ...string) DBOption {
+	return func(c *dbConfig) { c.searchPath = schemas }
+}
+
+// WithSchemas creates a schema for each entry in schemas, named by its key,
+// and applies its DDL, in which unqualified names refer to objects in that
+// schema. Schemas may refer to each other; they are applied in an order
+// that satisfies such references, and before the schema passed to
+// CreateDB. Unless WithSearchPath is used, the database's search_path is
+// set to the schemas, in sorted order, followed by public.
+func WithSchemas(schemas map[string]string) DBOption {
+	return func(c *dbConfig) { c.schemas = schemas }
+}
+
+// WithSeed runs seed against the database after its schema is applied.
+// Seeding is done once, in a template database that the database, and
+// later ones created with the same schema, options, and seed, are cloned
+// from, so expensive programmatic seeding is not repeated for each test.
+//
+// Seed functions are identified by name, so closures created by the same
+// function literal are considered the same seed and must insert the same
+// data.
+func WithSeed(seed func(ctx context.Context, db *sql.DB) error) DBOption {
+	return func(c *dbConfig) { c.seed = seed }
+}
+
+// WithCachedSchema applies the schema, and the options that populate the
+// database, once, in a template database that the database, and later ones
+// created with the same schema and options, are cloned from. Cloning takes
+// milliseconds, so it saves most of the setup time of tests whose schemas
+// are slow to apply. It is what SetSchema does in pqxtest, for any schema.
+func WithCachedSchema() DBOption {
+	return func(c *dbConfig) { c.cached = true }
+}
+
+// WithExtensions installs the named extensions, such as "pg_trgm", before
+// applying the schema. Like seeding, it is done once, in a template
+// database that the database, and later ones created with the same schema
+// and options, are cloned from.
+func WithExtensions(names ...string) DBOption {
+	return func(c *dbConfig) { c.extensions = append(c.extensions, names...) }
+}
+
+// Presets bundle extensions, and settings, that are commonly used
+// together, for passing to CreateDB like other options.
+var (
+	// PresetUUID installs pgcrypto and uuid-ossp, for generating UUIDs
+	// with gen_random_uuid or uuid_generate_v4 and hashing with digest.
+	PresetUUID DBOption = WithExtensions("pgcrypto", "uuid-ossp")
+
+	// PresetTextSearch installs unaccent and pg_trgm, and sets
+	// default_text_search_config to english, so full text search does not
+	// depend on the locale the instance was initialized with.
+	PresetTextSearch DBOption = func(c *dbConfig) {
+		WithExtensions("unaccent", "pg_trgm")(c)
+		c.set("default_text_search_config", "pg_catalog.english")
+	}
+)
+
+// WithRestore restores the dump in file, made by pg_dump in its plain SQL,
+// custom, or directory format, into the database after its schema is
+// applied, and then applies masks to the restored data, such as HashMask
+// for identifiers and NullMask for personal data. Like seeding, it is done
+// once, in a template database that the database, and later ones created
+// with the same schema and options, are cloned from, so tests never see
+// the unmasked data.
+func WithRestore(file string, masks ...Mask) DBOption {
+	return func(c *dbConfig) {
+		c.restore = file
+		c.masks = append(c.masks, masks...)
+	}
+}
+
+// seedName returns the name of the function seed.
+func seedName(seed func(context.Context, *sql.DB) error) string {
+	if seed == nil {
+		return ""
+	}
+	return runtime.FuncForPC(reflect.ValueOf(seed).Pointer()).Name()
+}
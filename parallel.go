@@ -0,0 +1,37 @@
+package pqx
+
+import "strconv"
+
+// defaultMaxWorkerProcesses is the postgres default of max_worker_processes,
+// which limits max_parallel_workers.
+const defaultMaxWorkerProcesses = 8
+
+// Parallel configures parallel query. The zero value disables parallel
+// query, making plans deterministic regardless of table sizes and machine.
+type Parallel struct {
+	MaxWorkers            int // max_parallel_workers
+	MaxWorkersPerGather   int // max_parallel_workers_per_gather; zero disables parallel query
+	MaxMaintenanceWorkers int // max_parallel_maintenance_workers
+
+	// Force makes the planner consider parallel plans free and tables of
+	// any size worth scanning in parallel, so parallel plans are chosen
+	// even for the small tables typical of tests.
+	Force bool
+}
+
+func (pl *Parallel) settings() [][2]string {
+	s := [][2]string{
+		{"max_parallel_workers", strconv.Itoa(pl.MaxWorkers)},
+		{"max_parallel_workers_per_gather", strconv.Itoa(pl.MaxWorkersPerGather)},
+		{"max_parallel_maintenance_workers", strconv.Itoa(pl.MaxMaintenanceWorkers)},
+	}
+	if pl.Force {
+		s = append(s,
+			[2]string{"parallel_setup_cost", "0"},
+			[2]string{"parallel_tuple_cost", "0"},
+			[2]string{"min_parallel_table_scan_size", "0"},
+			[2]string{"min_parallel_index_scan_size", "0"},
+		)
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package pqx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// startPgCtl starts postgres with args using pg_ctl, and waits for it to
+// start. It returns the exited pg_ctl command. Output from postgres is
+// written to out until it exits.
+func (p *Postgres) startPgCtl(ctx context.Context, out io.Writer, args []string) (*exec.Cmd, error) {
+	// Postgres inherits pg_ctl's output, so use a pipe that is not tied
+	// to the pg_ctl process, as exec.Cmd's would be, to keep reading
+	// after pg_ctl exits.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	cmd := exec.CommandContext(ctx, filepath.Join(p.binDir, "pg_ctl"), "start",
+		"-w",
+		"-D", p.dataDir(),
+		"-o", strings.Join(quoted, " "),
+	)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	go func() {
+		defer r.Close()
+		io.Copy(out, r) //nolint
+	}()
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("pqx: pg_ctl start: %w", err)
+	}
+	return cmd, nil
+}
+
+// stopPgCtl stops postgres using pg_ctl's shutdown mode, and waits for it
+// to exit.
+func (p *Postgres) stopPgCtl(mode string) error {
+	cmd := exec.Command(filepath.Join(p.binDir, "pg_ctl"), "stop", "-w", "-D", p.dataDir(), "-m", mode)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pqx: pg_ctl stop: %w\n%s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// pgCtlPid returns the pid of the postgres started by pg_ctl, as recorded
+// on the first line of its postmaster.pid, or zero if it cannot be read.
+func (p *Postgres) pgCtlPid() int {
+	data, err := os.ReadFile(p.PidFile())
+	if err != nil {
+		return 0
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	pid, _ := strconv.Atoi(strings.TrimSpace(line))
+	return pid
+}
+
+// shellQuote quotes s for use as a single word by the shell pg_ctl runs
+// postgres with.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,228 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// A Pool is a set of databases created ahead of time, all copies of the
+// same template, that are checked out with Get instead of being created,
+// and reset, rather than dropped, when released. For suites with many
+// small tests, this avoids the cost of creating and dropping a database per
+// test.
+//
+// Databases copied from a template are reset by copying it again, so they
+// keep its rows, such as seed data. Empty databases are reset by
+// truncating all tables and restarting all sequences, which does not undo
+// other changes, so they must not have their schema changed.
+type Pool struct {
+	p        *Postgres
+	prefix   string
+	template string
+
+	mu   sync.Mutex
+	free []string
+	n    int // number of databases created
+}
+
+// NewPool returns a Pool of n databases copied from the database named
+// template, such as one returned by Template, or empty databases if
+// template is empty. If more than n databases are checked out at once, the
+// pool grows as needed.
+func (p *Postgres) NewPool(ctx context.Context, logf func(string, ...any), n int, template string) (*Pool, error) {
+	if err := p.Start(ctx, logf); err != nil {
+		return nil, err
+	}
+	return p.newPool(ctx, n, template)
+}
+
+// startPool creates the pool CreateDB checks databases out of, if
+// PoolSize is set and it has not been created yet, and returns it.
+func (p *Postgres) startPool(ctx context.Context, logf func(string, ...any)) (*Pool, error) {
+	if p.PoolSize == 0 {
+		return nil, nil
+	}
+	p.pmu.Lock()
+	defer p.pmu.Unlock()
+	if p.pool != nil {
+		return p.pool, nil
+	}
+	var template string
+	if p.PoolSchema != "" {
+		var err error
+		template, err = p.template(ctx, logf, p.PoolSchema, &dbConfig{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	pl, err := p.newPool(ctx, p.PoolSize, template)
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pl
+	return pl, nil
+}
+
+func (p *Postgres) newPool(ctx context.Context, n int, template string) (*Pool, error) {
+	prefix := "pqx_pool"
+	if template != "" {
+		prefix = template + "_pool"
+	}
+	pl := &Pool{p: p, prefix: prefix, template: template}
+	for i := 0; i < n; i++ {
+		name, err := pl.create(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pl.free = append(pl.free, name)
+	}
+	return pl, nil
+}
+
+func (pl *Pool) create(ctx context.Context) (string, error) {
+	pl.mu.Lock()
+	pl.n++
+	name := DBName(fmt.Sprintf("%s_%d", pl.prefix, pl.n))
+	pl.mu.Unlock()
+
+	if err := pl.p.replaceDB(ctx, name); err != nil {
+		return "", err
+	}
+	_, err := pl.p.db.ExecContext(ctx, createDBQuery(name, &dbConfig{template: pl.template}))
+	return name, err
+}
+
+// Get checks out a database from pl, and returns it like CreateDB, along
+// with its name. The release function resets the database and returns it
+// to pl. Options that change how a database is created or populated, such
+// as WithTemplate, WithTablespace, WithOwner, WithUnloggedTables,
+// WithSchemas, and WithFakeClock, are not allowed.
+func (pl *Pool) Get(ctx context.Context, logf func(string, ...any), opts ...DBOption) (db *sql.DB, name, dsn string, release func(), err error) {
+	c := newDBConfig(opts)
+	if c.err != nil {
+		return nil, "", "", nil, c.err
+	}
+	if !c.poolable() {
+		return nil, "", "", nil, errors.New("pqx: Pool.Get: option not allowed for pooled databases")
+	}
+
+	pl.mu.Lock()
+	if len(pl.free) > 0 {
+		name = pl.free[len(pl.free)-1]
+		pl.free = pl.free[:len(pl.free)-1]
+	}
+	pl.mu.Unlock()
+	if name == "" {
+		name, err = pl.create(ctx)
+		if err != nil {
+			return nil, "", "", nil, err
+		}
+	}
+
+	p := pl.p
+	defer p.out.Flush()
+	p.watch(name, logf)
+
+	fail := func(err error) (*sql.DB, string, string, func(), error) {
+		p.out.Unwatch(name)
+		p.dropDB(name)
+		return nil, "", "", nil, err
+	}
+	if err := p.configureDB(ctx, name, c); err != nil {
+		return fail(err)
+	}
+	dsn = p.dsn(name, c)
+	c.driver = p.DriverName
+	db, err = openDB(dsn, c)
+	if err != nil {
+		return fail(err)
+	}
+
+	release = func() {
+		db.Close()
+		p.out.Flush()
+		p.out.Unwatch(name)
+		if err := pl.reset(ctx, name); err != nil {
+			p.log.infof("pqx: resetting pooled database %s: %v; dropping it", name, err)
+			p.dropDB(name)
+			return
+		}
+		pl.mu.Lock()
+		pl.free = append(pl.free, name)
+		pl.mu.Unlock()
+	}
+	return db, name, dsn, release, nil
+}
+
+// reset restores the database name of pl to its state when created.
+func (pl *Pool) reset(ctx context.Context, name string) error {
+	if pl.template == "" {
+		return pl.p.resetDB(ctx, name)
+	}
+	if err := pl.p.replaceDB(ctx, name); err != nil {
+		return err
+	}
+	_, err := pl.p.db.ExecContext(ctx, createDBQuery(name, &dbConfig{template: pl.template}))
+	return err
+}
+
+// resetDB terminates any connections left open to the database name,
+// removes its data, and undoes any settings applied by configureDB.
+func (p *Postgres) resetDB(ctx context.Context, name string) error {
+	if _, err := p.KillConnections(ctx, name); err != nil {
+		return err
+	}
+	if _, err := p.db.ExecContext(ctx, "ALTER DATABASE "+pq.QuoteIdentifier(name)+" RESET ALL"); err != nil {
+		return err
+	}
+
+	db, err := openDB(p.connDSN(name), &dbConfig{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var tables, seqs []string
+	rows, err := db.QueryContext(ctx, `
+		SELECT format('%I.%I', schemaname, tablename), false FROM pg_tables
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema')
+		UNION ALL
+		SELECT format('%I.%I', schemaname, sequencename), true FROM pg_sequences`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ident string
+		var isSeq bool
+		if err := rows.Scan(&ident, &isSeq); err != nil {
+			return err
+		}
+		if isSeq {
+			seqs = append(seqs, ident)
+		} else {
+			tables = append(tables, ident)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(tables) > 0 {
+		if _, err := db.ExecContext(ctx, "TRUNCATE "+strings.Join(tables, ", ")+" CASCADE"); err != nil {
+			return err
+		}
+	}
+	for _, seq := range seqs {
+		if _, err := db.ExecContext(ctx, "ALTER SEQUENCE "+seq+" RESTART"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
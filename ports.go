@@ -0,0 +1,96 @@
+package pqx
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// portBlockSize is the number of ports in each process's share of
+// PQX_PORT_RANGE.
+const portBlockSize = 32
+
+// partitionedPort returns a free port in r, a range of ports formatted like
+// "20000-29999", that is not used by another instance in this process. The
+// caller must hold usedMu.
+//
+// The range is divided into blocks, and each process starts its search in
+// the block chosen by its pid and working directory, which differs between
+// the test binaries of packages run in parallel, so concurrent processes
+// rarely race to use the same port. Each candidate port is verified free by
+// binding it first.
+func partitionedPort(r string) (string, error) {
+	lo, hi, err := parsePortRange(r)
+	if err != nil {
+		return "", err
+	}
+	n := hi - lo + 1
+	blocks := n / portBlockSize
+	if blocks == 0 {
+		blocks = 1
+	}
+	wd, _ := os.Getwd()
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d\x00%s", os.Getpid(), wd)
+	start := lo + int(h.Sum32()%uint32(blocks))*portBlockSize
+	for i := 0; i < n; i++ {
+		port := strconv.Itoa(lo + (start-lo+i)%n)
+		if usedPorts[port] || !canBind(port) {
+			continue
+		}
+		return port, nil
+	}
+	return "", fmt.Errorf("pqx: no free port in PQX_PORT_RANGE %s", r)
+}
+
+// Ports chosen for a PortKey are in stablePortLo through stablePortHi,
+// below the range Linux assigns to outgoing connections.
+const (
+	stablePortLo = 20000
+	stablePortHi = 29999
+)
+
+// stablePort returns the port derived from key, or, if it is not free, the
+// first free port after it, wrapping around the range of stable ports. The
+// caller must hold usedMu.
+func stablePort(key string) (string, error) {
+	n := stablePortHi - stablePortLo + 1
+	h := fnv.New32a()
+	h.Write([]byte(key)) //nolint
+	start := int(h.Sum32() % uint32(n))
+	for i := 0; i < n; i++ {
+		port := strconv.Itoa(stablePortLo + (start+i)%n)
+		if usedPorts[port] || !canBind(port) {
+			continue
+		}
+		return port, nil
+	}
+	return "", fmt.Errorf("pqx: no free port for PortKey %q", key)
+}
+
+func parsePortRange(r string) (lo, hi int, err error) {
+	a, b, ok := strings.Cut(r, "-")
+	if ok {
+		lo, err = strconv.Atoi(a)
+		if err == nil {
+			hi, err = strconv.Atoi(b)
+		}
+	}
+	if !ok || err != nil || lo <= 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("pqx: invalid PQX_PORT_RANGE %q; want a range like 20000-29999", r)
+	}
+	return lo, hi, nil
+}
+
+// canBind reports whether port can be listened on.
+func canBind(port string) bool {
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,34 +12,282 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"blake.io/pqx/internal/backoff"
 	"blake.io/pqx/internal/fetch"
-	"blake.io/pqx/internal/logplex"
-	"golang.org/x/sync/errgroup"
+	"blake.io/pqx/logplex"
+	"github.com/lib/pq"
 )
 
 const DefaultVersion = "14.2.0"
 
+// Backoff configures how pqx retries operations that may fail transiently,
+// such as pinging postgres while it starts up and downloading postgres
+// binaries. The zero value uses pqx's defaults: delays growing n²×10ms,
+// randomized ±50%, with no limit on attempts.
+type Backoff = backoff.Strategy
+
 type Postgres struct {
 	Version string // for a list of versions by OS, see: https://mvnrepository.com/artifact/io.zonky.test.postgres
 	Dir     string
-	Port    int // The port to bind postgres too. If the value is zero, a random port is assigned.
+
+	// Port is the port postgres listens on. If zero, a free port is
+	// assigned: a random one, or, if the PQX_PORT_RANGE environment
+	// variable is set to a range like "20000-29999", one from a block of
+	// that range chosen by this process, so the many processes of a
+	// parallel CI run rarely race for the same port.
+	Port int
+
+	// PortKey, if set and Port is zero, derives the port from a hash of
+	// PortKey, such as the name of a project, so it is the same on every
+	// run, and saved DSNs and psql commands stay valid. If that port is in
+	// use, the next free one after it is used instead. Ports derived from
+	// keys are in the range 20000-29999.
+	PortKey string
 
 	DebugLevel int // passed to postgres using the ("-d") flag
 
+	// Superuser is the name of the superuser created by initdb and used
+	// in DSNs. If empty, initdb names it after the operating system user
+	// running it, which differs between machines. Superuser only takes
+	// effect when the data directory is first initialized; Start fails if
+	// it was initialized with another.
+	Superuser string
+
+	// SuperuserPassword, if set, is the password of the superuser, which
+	// DSNs include, and TCP connections as any role must then authenticate
+	// with a password, using the pg_hba.conf method PasswordAuth:
+	// "scram-sha-256", the default, "md5", or "password". Roles without
+	// passwords cannot connect over TCP. Start sets the password each
+	// time, undoing changes made by tests, such as of password rotation.
+	SuperuserPassword string
+	PasswordAuth      string
+
+	// SharedBuffers, WorkMem, MaintenanceWorkMem, and EffectiveCacheSize
+	// set the server's memory settings of the same names, in postgres's
+	// memory units (e.g. "128MB" or "64kB"). If empty, shared_buffers is
+	// 12MB and the others use the postgres defaults. Larger values help
+	// suites with large fixtures avoid thrashing temporary files.
+	SharedBuffers      string
+	WorkMem            string
+	MaintenanceWorkMem string
+	EffectiveCacheSize string
+
+	// Parallel, if non-nil, configures parallel query for the instance.
+	// Use WithParallel to configure it per database.
+	Parallel *Parallel
+
+	// Durable runs postgres with fsync, synchronous_commit, and
+	// full_page_writes on, as they are in production. By default they are
+	// off, which is much faster but unsafe if the machine crashes. Set it
+	// for tests that verify crash safety or measure commit latency.
+	Durable bool
+
+	// Logical runs postgres with wal_level=logical and enough WAL
+	// senders and replication slots for logical decoding and logical
+	// replication. See CreateLogicalSlot.
+	Logical bool
+
+	// LogTimestamps prefixes each line of postgres output routed to logf
+	// functions with the server's timestamp for it, in UTC and formatted
+	// by LogTimeFormat, so it can be correlated with other events.
+	LogTimestamps bool
+
+	// AnnotateLogs prefixes each line of postgres output routed to logf
+	// functions with the application_name of the session that caused it
+	// and its SQLSTATE, and logs each message together with the DETAIL,
+	// HINT, CONTEXT, and STATEMENT lines that follow it in a single call,
+	// so they can be told apart from the logs of concurrent sessions.
+	AnnotateLogs bool
+
+	// MaxPreparedTransactions sets max_prepared_transactions, the number
+	// of transactions that may be prepared for two-phase commit at once.
+	// The zero value leaves the postgres default of zero, which disables
+	// PREPARE TRANSACTION.
+	MaxPreparedTransactions int
+
+	// DataChecksums initializes the data directory with data checksums
+	// enabled, so postgres detects corruption of data files when reading
+	// them. See VerifyChecksums. It has no effect on data directories
+	// already initialized. When set, Shutdown stops postgres cleanly,
+	// rather than immediately, so checksums may be verified after.
+	DataChecksums bool
+
+	// Reinit causes Start to remove and re-initialize a data directory
+	// initialized by a different major version of postgres, instead of
+	// failing with a *VersionMismatchError. All data in it is lost.
+	Reinit bool
+
+	// Archive enables WAL archiving into ArchiveDir, for testing backup
+	// and point-in-time recovery. See BaseBackup and RestoreToTime.
+	Archive bool
+
+	// Backoff controls the delays between retries while waiting for
+	// postgres to accept connections, while fetching binaries, and while
+	// creating databases fails with transient connection errors. Its
+	// MaxAttempts only limits the pings while waiting for postgres;
+	// FetchAttempts and CreateAttempts limit the others.
+	Backoff Backoff
+
+	// FetchAttempts is the number of times downloading binaries is tried
+	// while it fails with network or server errors. The zero value means
+	// 3.
+	FetchAttempts int
+
+	// CreateAttempts is the number of times CreateDB tries to create a
+	// database while it fails with transient connection errors. The zero
+	// value means 3.
+	CreateAttempts int
+
+	// DropWorkers is the maximum number of databases dropped concurrently
+	// after their cleanup functions are called. Cleanup functions block
+	// while that many drops are in progress and as many more are queued.
+	// The zero value means 4.
+	DropWorkers int
+
+	// DriverName, if set, is the name of the database/sql driver that
+	// pqx uses for its own connection to the server and that opens the
+	// *sql.DB returned by CreateDB and Pool.Get, such as "pgx" after
+	// importing github.com/jackc/pgx/v5/stdlib. The default is lib/pq's
+	// "postgres", which is still used to apply schemas, since it runs
+	// many statements in one Exec. Other drivers do not deliver notices
+	// to WithNoticeHandler. To use a driver's native API, such as a
+	// pgxpool.Pool, see pqxtest.CreatePool.
+	DriverName string
+
+	// Config sets server settings, passed to postgres as -c key=value
+	// flags, such as max_connections, shared_preload_libraries, or
+	// log_min_duration_statement. They are passed after, and so override,
+	// those pqx sets, like shared_buffers and fsync; overriding
+	// log_line_prefix breaks routing logs to the logf functions of
+	// databases. Settings that only apply at server start take effect the
+	// next time p starts.
+	Config map[string]string
+
+	// DSNOptions are added, as key=value pairs, to all DSNs returned for
+	// p, such as connect_timeout or options. They are not used for the
+	// connections pqx makes itself, such as to create databases and apply
+	// schemas. Use WithDSNOption to add them to the DSN of a single
+	// database.
+	DSNOptions map[string]string
+
+	// CacheDir is the directory postgres binaries are downloaded to and
+	// cached in, such as one inside a project for hermetic builds. If
+	// empty, it is $PQX_CACHE_DIR if set, or else pqx in the user's cache
+	// directory: $XDG_CACHE_HOME, or $HOME/.cache if that is unset.
+	CacheDir string
+
+	// SocketDir is the directory postgres creates its Unix-domain socket
+	// in. If empty, it is the data directory, unless that path is too long
+	// for a socket, in which case no socket is created; pqx connects over
+	// TCP either way.
+	SocketDir string
+
+	// MaxDiskUsage, if positive, is the size in bytes the data directory
+	// may grow to. CreateDB fails with a *DiskUsageError when it is over,
+	// and database cleanup functions log a warning, to catch tests that
+	// unintentionally write gigabytes of data, WAL, or temporary files.
+	// See DiskUsage.
+	MaxDiskUsage int64
+
+	// PgCtl manages postgres with pg_ctl, which starts it in the
+	// background, waits for it to start and stop, and recovers from
+	// postmaster.pid files left by crashed servers, instead of running it
+	// as a child process.
+	PgCtl bool
+
+	// ClientCerts runs postgres with TLS, using a certificate authority
+	// and server certificate generated each time it starts, and requires
+	// connections made over TLS to authenticate with a client certificate
+	// signed by that authority, whose common name is the name of the role
+	// to connect as. Connections without TLS, such as those pqx makes, are
+	// trusted as usual. See ClientCertDSN.
+	ClientCerts bool
+
+	// SCRAMUser, if set, names a superuser role that Start creates, with
+	// the password SCRAMPassword, and that must authenticate with
+	// SCRAM-SHA-256 when connecting over TCP, for testing drivers and
+	// poolers that implement it. The server's password_encryption is set
+	// to scram-sha-256, so other passwords are stored as SCRAM verifiers
+	// too. SCRAMUser must not be the superuser pqx connects as, and
+	// SCRAMPassword must not be empty. See SCRAMDSN.
+	SCRAMUser     string
+	SCRAMPassword string
+
+	// External, if set, is the DSN, in key=value or URL form, of an
+	// already-running server for p to use instead of running its own, such
+	// as a CI service container or a server on a platform the bundled
+	// binaries do not run on. Start only connects to it, and Shutdown
+	// leaves it running. The DSN's role must be able to create databases.
+	//
+	// Settings of the server itself, such as Version, Port, and
+	// SharedBuffers, have no effect, and methods needing a local server,
+	// such as Pid, BinDir, and WithProxy, are unsupported. The server's
+	// logs are not available, so logf functions receive only pqx's
+	// messages and notices sent to clients.
+	External string
+
+	// Restart causes CreateDB to restart postgres, in the same data
+	// directory and on the same port, if it finds postgres has died, such
+	// as from being killed by the OOM killer, rather than failing with a
+	// *DiedError. Connections made before then are broken.
+	Restart bool
+
+	// LogLevel is the minimum level of messages logged to the logf
+	// functions passed to Start and CreateDB. The zero value is LevelInfo.
+	LogLevel Level
+
+	// PoolSize is the number of databases Start creates ahead of time,
+	// copied from a template with PoolSchema applied, or empty if
+	// PoolSchema is empty. CreateDB checks one out, instead of creating a
+	// database, when called with PoolSchema and only options Pool.Get
+	// allows, and its cleanup function resets the database and returns it
+	// to the pool; see Pool. The zero value means no pool.
+	PoolSize   int
+	PoolSchema string
+
 	startOnce sync.Once
 	err       error
 	cmd       *exec.Cmd
 	db        *sql.DB
 	port      string
-	readyCtx  context.Context
+	binDir    string
+	readyMu   sync.Mutex
+	readyCtx  context.Context // done once postgres logs that it is ready
+	ready     func()          // cancels readyCtx
+	log       *logger
 	out       *logplex.Logplex
-	dropg     errgroup.Group
+	tail      *tailBuffer
+	tailOut   *logplex.Logplex // splits output into lines for tail
+	unlock    func()           // releases the cross-process lock on Dir
+	stopped   bool             // set by Shutdown once postgres exits
+	up        int32            // 1 while accepting connections; see Handler
+	ca        *certAuthority   // set by Start if ClientCerts is set
+	copied    bool             // data directory copied from another instance; see sibling
+	drops     dropQueue
+
+	hmu       sync.Mutex
+	healthyAt time.Time  // of the last successful health check
+	died      *DiedError // set once postgres is found dead, unless restarted
+
+	smu   sync.Mutex
+	setup SetupStats
+
+	tmu       sync.Mutex
+	templates map[string]*template // by schema hash
+
+	rmu      sync.Mutex
+	recycled map[string][]string // database names by recycleKey
+
+	pmu  sync.Mutex
+	pool *Pool // created by Start if PoolSize is set
 }
 
 func (p *Postgres) version() string {
@@ -52,17 +301,30 @@ func (p *Postgres) dataDir() string { return filepath.Join(p.Dir, p.version(), "
 
 // ctx only affects initdb and pingUntilUp; otherwise, the context is ignored.
 func (p *Postgres) Start(ctx context.Context, logf func(string, ...any)) error {
-	do := func() error {
-		const magicSep = " ::pqx:: "
+	if err := p.startServer(ctx, logf); err != nil {
+		return err
+	}
+	_, err := p.startPool(ctx, logf)
+	return err
+}
 
-		var ready func()
-		p.readyCtx, ready = context.WithCancel(context.Background())
+// startServer is Start without creating the pool, for use while creating
+// it.
+func (p *Postgres) startServer(ctx context.Context, logf func(string, ...any)) error {
+	do := func() (err error) {
+		bootStart := time.Now()
+		if err := p.validate(); err != nil {
+			return err
+		}
 
+		p.resetReady()
+
+		p.log = newLogger(logf, p.LogLevel)
 		p.out = &logplex.Logplex{
-			Sink: logplex.LogfWriter(logf),
+			Sink: p.log.sink(LevelInfo),
 			Split: func(line []byte) (key, message []byte) {
 				if bytes.Contains(line, []byte("database system is ready to accept connections")) {
-					ready() // signal pg is ready avoiding extra backoff sleeps in pingUntilUp
+					p.signalReady() // avoids extra backoff sleeps in pingUntilUp
 				}
 
 				key, message, hasMagicSep := bytes.Cut(line, []byte(magicSep))
@@ -74,75 +336,382 @@ func (p *Postgres) Start(ctx context.Context, logf func(string, ...any)) error {
 			},
 		}
 
-		binDir, err := fetch.Binary(ctx, p.version())
-		if err != nil {
-			return err
+		if p.External != "" {
+			return p.startExternal(ctx)
 		}
 
-		if err := initdb(ctx, p.out, binDir, p.dataDir()); err != nil {
+		if err := claimDir(p.dataDir()); err != nil {
 			return err
 		}
+		defer func() {
+			if err != nil && p.cmd == nil {
+				releaseDir(p.dataDir())
+			}
+		}()
 
-		if p.Port == 0 {
-			p.port = randomPort()
-		} else {
-			p.port = strconv.Itoa(p.Port)
+		// Other processes may use the same directory, such as test
+		// binaries of packages in the same directory, so only one may
+		// initialize and run postgres in it at a time.
+		p.unlock, err = lockDir(ctx, filepath.Dir(p.dataDir()), p.log.infof)
+		if err != nil {
+			return err
 		}
+		defer func() {
+			if err != nil && p.cmd == nil {
+				p.unlock()
+			}
+		}()
 
-		// run with disconnected ctx so postgres continues running in
-		// background after the provided ctx is canceled
-		cmd := exec.CommandContext(context.Background(), binDir+"/postgres",
-			// env
-			"-d", strconv.Itoa(p.DebugLevel),
-			"-D", p.dataDir(),
-			"-p", p.port,
+		p.tail = &tailBuffer{max: startLogTail}
+		p.tailOut = &logplex.Logplex{Sink: p.tail}
+		out := io.MultiWriter(p.out, p.tailOut)
 
-			// resources
-			"-c", "shared_buffers=12MB", // TODO(bmizerany): make configurable
-			"-c", "fsync=off",
-			"-c", "synchronous_commit=off",
-			"-c", "full_page_writes=off",
+		// Fetching binaries, the slowest step of a cold start, only
+		// needs to finish before initdb, so prepare everything else
+		// meanwhile. There is no use in finishing a download if
+		// preparing fails.
+		fetchCtx, cancelFetch := context.WithCancel(ctx)
+		defer cancelFetch()
+		fetched := make(chan error, 1)
+		go func() {
+			fetchStart := time.Now()
+			fetchCached := fetch.Cached(p.CacheDir, p.version())
+			s := p.Backoff
+			s.MaxAttempts = p.FetchAttempts
+			binDir, err := fetch.Binary(fetchCtx, p.CacheDir, p.version(), s, p.log.infof)
+			if err == nil {
+				p.binDir = binDir
+				p.recordSetup(func(s *SetupStats) {
+					s.Fetch, s.FetchCached = time.Since(fetchStart), fetchCached
+				})
+			}
+			fetched <- err
+		}()
+		prepareStart := time.Now()
+		err = p.prepare()
+		p.recordSetup(func(s *SetupStats) { s.Prepare = time.Since(prepareStart) })
+		defer func() {
+			if err != nil && p.cmd == nil && p.Port == 0 {
+				releasePort(p.port)
+			}
+		}()
+		if err != nil {
+			cancelFetch()
+		}
+		if ferr := <-fetched; err == nil {
+			err = ferr
+		}
+		if err != nil {
+			return err
+		}
 
-			// logs
-			"-c", "log_line_prefix=%d"+magicSep,
-		)
-		cmd.Stdout = p.out
-		cmd.Stderr = p.out
-		if err := cmd.Start(); err != nil {
+		// initdb can take a while the first time, so stream its output
+		// for those watching debug logs.
+		initLog := &logplex.Logplex{Sink: p.log.prefixSink(LevelDebug, "[initdb] ")}
+		initdbStart := time.Now()
+		initdbCached := isPostgresDir(p.dataDir())
+		err = initdb(ctx, io.MultiWriter(p.tailOut, initLog), p.binDir, p.dataDir(), p.initdbArgs()...)
+		initLog.Flush() //nolint
+		if err != nil {
 			return err
 		}
-		defer p.Flush()
+		p.recordSetup(func(s *SetupStats) {
+			s.Initdb, s.InitdbCached = time.Since(initdbStart), initdbCached
+		})
+		startStart := time.Now()
+		cmd, err := p.launch(ctx, out)
+		if err != nil {
+			return err
+		}
+		defer p.out.Flush()
 
-		db, err := sql.Open("postgres", p.DSN("postgres"))
+		db, err := sql.Open(p.driverName(), p.connDSN("postgres"))
 		if err != nil {
 			return err
 		}
 		p.db = db
 		p.cmd = cmd
+		defer func() {
+			if err != nil {
+				p.stopFailed()
+			}
+		}()
 
-		p.Flush() // flush any interesting/helpful logs before we start pinging
-		return p.pingUntilUp(ctx, logf)
+		p.out.Flush() // flush any interesting/helpful logs before we start pinging
+		if err := p.pingUntilUp(ctx); err != nil {
+			return err
+		}
+		if err := p.createSCRAMUser(ctx); err != nil {
+			return err
+		}
+		if err := p.setSuperuserPassword(ctx); err != nil {
+			return err
+		}
+		if !p.copied {
+			if err := p.dropLeftovers(ctx); err != nil {
+				return fmt.Errorf("pqx: dropping leftover databases: %w", err)
+			}
+		}
+		atomic.StoreInt32(&p.up, 1)
+		p.recordSetup(func(s *SetupStats) {
+			s.Start = time.Since(startStart)
+			s.Boot = time.Since(bootStart)
+		})
+		return nil
 	}
 	p.startOnce.Do(func() {
 		p.err = do()
+		var pe *PingError
+		if p.err != nil && !errors.As(p.err, &pe) && p.tail != nil {
+			p.err = &StartError{Log: p.tailLines(), Err: p.err}
+		}
 	})
 
 	return p.err
 }
 
+// stopFailed stops postgres after it was launched by a Start that then
+// failed, so the deferred cleanups of Start release its port, the data
+// directory, and its lock.
+func (p *Postgres) stopFailed() {
+	p.db.Close()
+	if p.PgCtl {
+		p.stopPgCtl("immediate") //nolint
+	} else {
+		p.cmd.Process.Signal(syscall.SIGQUIT) //nolint
+		p.cmd.Wait()                          //nolint
+	}
+	p.cmd = nil
+}
+
+// prepare readies the data, archive, and authentication directories, and
+// the port, for starting postgres. It runs while binaries are fetched, so
+// it must not use them.
+func (p *Postgres) prepare() (err error) {
+	if err := p.checkDataVersion(); err != nil {
+		return err
+	}
+	if p.Archive {
+		if err := os.MkdirAll(p.ArchiveDir(), 0755); err != nil {
+			return err
+		}
+	}
+	if err := p.writeAuthFiles(); err != nil {
+		return err
+	}
+	if p.Port == 0 {
+		p.port, err = reservePort(p.PortKey)
+		return err
+	}
+	p.port = strconv.Itoa(p.Port)
+	return nil
+}
+
+// launch runs postgres, with its output written to out, and returns the
+// command running it, or, if PgCtl is set, the exited pg_ctl command.
+func (p *Postgres) launch(ctx context.Context, out io.Writer) (*exec.Cmd, error) {
+	args := []string{
+		// env
+		"-d", strconv.Itoa(p.DebugLevel),
+		"-p", p.port,
+	}
+	for _, kv := range p.settings() {
+		args = append(args, "-c", kv[0]+"="+kv[1])
+	}
+	if p.PgCtl {
+		return p.startPgCtl(ctx, out, args)
+	}
+	// run with disconnected ctx so postgres continues running in
+	// background after the provided ctx is canceled
+	cmd := exec.CommandContext(context.Background(), p.binDir+"/postgres", append([]string{"-D", p.dataDir()}, args...)...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// LogTimeFormat is the time layout of the timestamps prefixed to log lines
+// when LogTimestamps is set.
+const LogTimeFormat = "2006-01-02 15:04:05.000 MST"
+
+func (p *Postgres) logLinePrefix() string {
+	prefix := "%d" + magicSep
+	if p.LogTimestamps {
+		prefix += "%m "
+	}
+	if p.AnnotateLogs {
+		prefix += "[%a %e] "
+	}
+	return prefix
+}
+
+// watch routes the postgres logs for the database name to logf.
+func (p *Postgres) watch(name string, logf func(string, ...any)) {
+	l := newLogger(logf, p.LogLevel)
+	if p.AnnotateLogs && l.enabled(LevelInfo) {
+		p.out.Watch(name, &groupWriter{logf: l.logf})
+		return
+	}
+	p.out.Watch(name, l.sink(LevelInfo))
+}
+
+// magicSep separates the database name from the message in each postgres
+// log line so lines can be routed to the logf of the database's creator.
+const magicSep = " ::pqx:: "
+
+// settings returns the server configuration passed to postgres as -c flags,
+// in order.
+func (p *Postgres) settings() [][2]string {
+	sharedBuffers := p.SharedBuffers
+	if sharedBuffers == "" {
+		sharedBuffers = "12MB"
+	}
+	s := [][2]string{
+		// resources
+		{"shared_buffers", sharedBuffers},
+
+		// logs
+		{"log_line_prefix", p.logLinePrefix()},
+	}
+	for _, kv := range p.memorySettings() {
+		if kv[1] != "" {
+			s = append(s, kv)
+		}
+	}
+	if p.Parallel != nil {
+		s = append(s, p.Parallel.settings()...)
+		if p.Parallel.MaxWorkers > defaultMaxWorkerProcesses {
+			s = append(s, [2]string{"max_worker_processes", strconv.Itoa(p.Parallel.MaxWorkers)})
+		}
+	}
+	if !p.Durable {
+		s = append(s,
+			[2]string{"fsync", "off"},
+			[2]string{"synchronous_commit", "off"},
+			[2]string{"full_page_writes", "off"},
+		)
+	}
+	if p.Logical {
+		s = append(s,
+			[2]string{"wal_level", "logical"},
+			[2]string{"max_wal_senders", "16"},
+			[2]string{"max_replication_slots", "16"},
+		)
+	}
+	s = append(s, [2]string{"unix_socket_directories", p.socketDir()})
+	if p.LogTimestamps {
+		s = append(s, [2]string{"log_timezone", "UTC"})
+	}
+	if p.MaxPreparedTransactions > 0 {
+		s = append(s, [2]string{"max_prepared_transactions", strconv.Itoa(p.MaxPreparedTransactions)})
+	}
+	if p.Archive {
+		s = append(s,
+			[2]string{"archive_mode", "on"},
+			[2]string{"archive_command", p.archiveCommand()},
+		)
+	}
+	if p.SCRAMUser != "" {
+		s = append(s, [2]string{"password_encryption", "scram-sha-256"})
+	} else if p.SuperuserPassword != "" {
+		enc := "scram-sha-256"
+		if p.PasswordAuth == "md5" {
+			enc = "md5"
+		}
+		s = append(s, [2]string{"password_encryption", enc})
+	}
+	if f := p.hbaFile(); f != "" {
+		s = append(s, [2]string{"hba_file", f})
+	}
+	s = append(s, p.tlsSettings()...)
+	for _, k := range sortedKeys(p.Config) {
+		s = append(s, [2]string{k, p.Config[k]})
+	}
+	return s
+}
+
+// maxSocketPath is the longest path a Unix-domain socket may have on common
+// platforms, less room for the name postgres gives the socket.
+const maxSocketPath = 103 - len("/.s.PGSQL.65535")
+
+// socketDir returns the value of unix_socket_directories, which may be
+// empty to disable Unix-domain sockets.
+func (p *Postgres) socketDir() string {
+	if p.SocketDir != "" {
+		return p.SocketDir
+	}
+	dir := p.dataDir()
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if len(dir) > maxSocketPath {
+		return ""
+	}
+	return dir
+}
+
+// memorySettings returns the optional memory settings, which may be empty.
+func (p *Postgres) memorySettings() [][2]string {
+	return [][2]string{
+		{"work_mem", p.WorkMem},
+		{"maintenance_work_mem", p.MaintenanceWorkMem},
+		{"effective_cache_size", p.EffectiveCacheSize},
+	}
+}
+
+// validate reports an error for any invalid fields.
+func (p *Postgres) validate() error {
+	mem := append([][2]string{{"shared_buffers", p.SharedBuffers}}, p.memorySettings()...)
+	for _, kv := range mem {
+		if kv[1] != "" && !isMemorySize(kv[1]) {
+			return fmt.Errorf("pqx: invalid %s %q: want a size like \"64MB\"", kv[0], kv[1])
+		}
+	}
+	if p.SCRAMUser != "" && (p.SCRAMPassword == "" || p.SCRAMUser == p.Superuser) {
+		return errors.New("pqx: SCRAMUser requires a SCRAMPassword and must differ from Superuser")
+	}
+	switch p.PasswordAuth {
+	case "", "scram-sha-256", "md5", "password":
+	default:
+		return fmt.Errorf("pqx: invalid PasswordAuth %q; want scram-sha-256, md5, or password", p.PasswordAuth)
+	}
+	if p.PasswordAuth != "" && p.SuperuserPassword == "" {
+		return errors.New("pqx: PasswordAuth requires a SuperuserPassword")
+	}
+	return nil
+}
+
+var memorySizeRx = regexp.MustCompile(`^[0-9]+ *(B|kB|MB|GB|TB)?$`)
+
+// isMemorySize reports whether s is a valid postgres memory size.
+func isMemorySize(s string) bool { return memorySizeRx.MatchString(s) }
+
+// Flush waits for databases queued for dropping by cleanup functions to be
+// dropped, and then writes any buffered logs to their destinations.
 func (p *Postgres) Flush() {
+	p.waitDrops()
 	p.out.Flush()
 }
 
 // Shutdown waits for any inflight database cleanup functions to finish and
 // then shutsdown postgres.
 func (p *Postgres) Shutdown() error {
-	return p.shutdown(false)
+	return p.shutdown(false, false)
 }
 
 // ShutdownAlone is like Shutdown, but it leaves postgres running.
 func (p *Postgres) ShutdownAlone() error {
-	return p.shutdown(true)
+	return p.shutdown(true, false)
+}
+
+// ShutdownFast is like Shutdown, but for when the process is being
+// interrupted: it does not wait for databases pending drop, and it always
+// uses a fast shutdown, which terminates connected backends and checkpoints,
+// so the data directory is left clean rather than needing recovery.
+func (p *Postgres) ShutdownFast() error {
+	return p.shutdown(false, true)
 }
 
 // Pid returns the pid of the postgres process. It is an error to call Pid
@@ -151,88 +720,418 @@ func (p *Postgres) Pid() int {
 	if p.cmd == nil {
 		panic("pqx: Pid called before Start")
 	}
+	if p.PgCtl {
+		return p.pgCtlPid()
+	}
 	return p.cmd.Process.Pid
 }
 
-func (p *Postgres) shutdown(alone bool) error {
+// PidFile returns the path of the postmaster.pid file, which has the pid
+// of postgres on its first line while it runs. Unlike Pid, it stays valid
+// when postgres is restarted; see Restart.
+func (p *Postgres) PidFile() string {
+	return filepath.Join(p.dataDir(), "postmaster.pid")
+}
+
+// BinDir returns the directory containing the postgres binaries used by p,
+// for running others from the same bundle, such as pg_dump or pgbench. It
+// is an error to call BinDir before Start.
+func (p *Postgres) BinDir() string {
+	if p.binDir == "" {
+		panic("pqx: BinDir called before Start")
+	}
+	return p.binDir
+}
+
+// ResolvedVersion returns the version of postgres p runs: Version, or
+// DefaultVersion if Version is empty.
+func (p *Postgres) ResolvedVersion() string {
+	return p.version()
+}
+
+func (p *Postgres) shutdown(alone, fast bool) error {
+	atomic.StoreInt32(&p.up, 0)
+	if !fast {
+		p.waitDrops()
+	}
 	p.db.Close()
-	if alone {
+	if alone || p.External != "" {
 		return nil
 	}
-	if err := p.cmd.Process.Signal(syscall.SIGQUIT); err != nil {
-		return err
-	}
-	if err := p.cmd.Wait(); err != nil {
-		return err
+	// An immediate shutdown is fastest, but leaves the data directory
+	// needing recovery, which pg_checksums refuses to verify; a fast
+	// shutdown leaves it clean.
+	fast = fast || p.DataChecksums
+	if p.PgCtl {
+		mode := "immediate"
+		if fast {
+			mode = "fast"
+		}
+		if err := p.stopPgCtl(mode); err != nil {
+			return err
+		}
+	} else {
+		sig := syscall.SIGQUIT
+		if fast {
+			sig = syscall.SIGINT
+		}
+		if err := p.cmd.Process.Signal(sig); err != nil {
+			return err
+		}
+		if err := p.cmd.Wait(); err != nil {
+			return err
+		}
 	}
-	return nil
+	p.stopped = true
+	releaseDir(p.dataDir())
+	releasePort(p.port)
+	p.unlock()
+	return p.out.Close()
 }
 
 // Open creates a database for the schema, connects to it, and returns the
 // *sql.DB. .. more words needed here.
-func (p *Postgres) CreateDB(ctx context.Context, logf func(string, ...any), name, schema string) (db *sql.DB, dsn string, cleanup func(), err error) {
-	if err := p.Start(ctx, logf); err != nil {
+//
+// The name is used verbatim, except that names longer than postgres allows
+// are shortened; see DBName. The returned DSN refers to the database by
+// its actual name.
+//
+// The database may be further configured with opts.
+//
+// If p has a pool (see PoolSize), the database may instead be checked out
+// of it, in which case it has the name given to it by the pool.
+func (p *Postgres) CreateDB(ctx context.Context, logf func(string, ...any), name, schema string, opts ...DBOption) (db *sql.DB, dsn string, cleanup func(), err error) {
+	c := newDBConfig(opts)
+	if c.err != nil {
+		return nil, "", nil, c.err
+	}
+	name = DBName(name)
+
+	if err := p.startServer(ctx, logf); err != nil {
 		return nil, "", nil, err
 	}
+	pool, err := p.startPool(ctx, logf)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if err := p.checkHealth(ctx); err != nil {
+		return nil, "", nil, err
+	}
+	if err := p.checkDiskUsage(); err != nil {
+		return nil, "", nil, err
+	}
+	createStart := time.Now()
+	defer func() {
+		if err == nil {
+			p.recordSetup(func(s *SetupStats) {
+				s.CreateDBs++
+				s.CreateDBTime += time.Since(createStart)
+			})
+		}
+	}()
 
-	dsn = p.DSN(name)
+	if pool != nil && schema == p.PoolSchema && c.poolable() {
+		db, _, dsn, cleanup, err = pool.Get(ctx, logf, opts...)
+		return db, dsn, cleanup, err
+	}
 
-	defer p.Flush()
+	dsn = p.dsn(name, c)
 
-	p.out.Watch(name, logplex.LogfWriter(logf))
+	defer p.out.Flush()
 
-	q := fmt.Sprintf("CREATE DATABASE %s", name)
-	_, err = p.db.ExecContext(ctx, q)
-	if err != nil {
-		p.Flush()
+	p.watch(name, logf)
+	defer func() {
+		if err != nil {
+			p.out.Unwatch(name)
+		}
+	}()
+
+	if c.replace {
+		if err := p.replaceDB(ctx, name); err != nil {
+			p.out.Flush()
+			return nil, "", nil, err
+		}
+	}
+	var key string
+	recycled := false
+	if c.recycle {
+		key = recycleKey(schema, c)
+		recycled = p.takeRecycled(ctx, key, name)
+	}
+	populated := recycled
+	create := c
+	if c.needsTemplate() && !recycled {
+		tmpl, err := p.template(ctx, logf, schema, c)
+		if err != nil {
+			p.out.Flush()
+			return nil, "", nil, err
+		}
+		cc := *c
+		cc.template = tmpl
+		create = &cc
+		populated = true
+	}
+	if !recycled {
+		err = p.createDatabase(ctx, name, createDBQuery(name, create))
+		if err != nil {
+			p.out.Flush()
+			if sqlState(err) == "42P04" { // duplicate_database
+				return nil, "", nil, fmt.Errorf("%w: %q", ErrDatabaseExists, name)
+			}
+			return nil, "", nil, err
+		}
+	}
+	if !c.keep && !recycled {
+		if err := p.markLeftover(ctx, name); err != nil {
+			p.dropDB(name)
+			p.out.Flush()
+			return nil, "", nil, err
+		}
+	}
+	if err := p.configureDB(ctx, name, c); err != nil {
+		p.dropDB(name)
+		p.out.Flush()
 		return nil, "", nil, err
 	}
 
-	db, err = sql.Open("postgres", p.DSN(name))
+	db, err = openDB(dsn, c)
 	if err != nil {
 		return nil, "", nil, err
 	}
 
+	ready := false
 	cleanup = func() {
 		db.Close()
-		p.dropDB(ctx, name)
+		if err := p.checkDiskUsage(); err != nil {
+			newLogger(logf, p.LogLevel).log(LevelWarn, "pqx: cleaning up %s: %v", name, err)
+		}
+		switch {
+		case c.recycle && ready:
+			p.recycleDB(key, name)
+		case !c.keep:
+			if c.idleAge > 0 {
+				if _, err := p.KillIdleConnections(context.Background(), name, c.idleAge); err != nil {
+					p.log.infof("pqx: killing idle connections to %s: %v", name, err)
+				}
+			}
+			p.dropDB(name)
+		}
 
 		// flush any logs we have on hand, we may not get them all, but
 		// at this point we'll only miss sessions disconnecting, etc.
 		// TODO(bmizerany): wait for sentinal log line before proceeding after Flush?
-		p.Flush()
+		p.out.Flush()
 		p.out.Unwatch(name)
 	}
 
-	if schema != "" {
-		_, err = db.ExecContext(ctx, schema)
+	if !populated {
+		if err := p.populate(ctx, db, name, schema, c); err != nil {
+			cleanup()
+			return nil, "", nil, err
+		}
+	}
+	if c.unlogged && !recycled {
+		if err := setUnlogged(ctx, db); err != nil {
+			cleanup()
+			return nil, "", nil, err
+		}
+	}
+	if c.analyze && !recycled {
+		if _, err := db.ExecContext(ctx, "ANALYZE"); err != nil {
+			cleanup()
+			return nil, "", nil, err
+		}
+	}
+	if p.DriverName != "" {
+		// The schema is applied with lib/pq, which, unlike some
+		// drivers, runs many statements in one Exec.
+		db.Close()
+		cc := *c
+		cc.driver = p.DriverName
+		ddb, err := openDB(dsn, &cc)
 		if err != nil {
 			cleanup()
 			return nil, "", nil, err
 		}
+		db = ddb
 	}
+	ready = true
 	return db, dsn, cleanup, nil
 }
 
-func (p *Postgres) dropDB(ctx context.Context, name string) {
-	p.dropg.Go(func() error {
-		_, err := p.db.ExecContext(ctx, "DROP DATABASE "+name)
+// ErrDatabaseExists is returned by CreateDB when a database of the same
+// name already exists, such as one left behind by a crashed run. Use
+// WithReplace to replace it instead.
+var ErrDatabaseExists = errors.New("pqx: database already exists")
+
+// createDBQuery returns the CREATE DATABASE statement for name as
+// configured by c.
+func createDBQuery(name string, c *dbConfig) string {
+	q := fmt.Sprintf("CREATE DATABASE %s", pq.QuoteIdentifier(name))
+	template := c.template
+	if template == "" && (c.encoding != "" || c.collate != "" || c.ctype != "") {
+		template = "template0"
+	}
+	if template != "" {
+		q += " TEMPLATE " + pq.QuoteIdentifier(template)
+	}
+	if c.owner != "" {
+		q += " OWNER " + pq.QuoteIdentifier(c.owner)
+	}
+	if c.encoding != "" {
+		q += " ENCODING " + pq.QuoteLiteral(c.encoding)
+	}
+	if c.collate != "" {
+		q += " LC_COLLATE " + pq.QuoteLiteral(c.collate)
+	}
+	if c.ctype != "" {
+		q += " LC_CTYPE " + pq.QuoteLiteral(c.ctype)
+	}
+	if c.connLimit != 0 {
+		q += fmt.Sprintf(" CONNECTION LIMIT %d", c.connLimit)
+	}
+	if c.tablespace != "" {
+		q += " TABLESPACE " + pq.QuoteIdentifier(c.tablespace)
+	}
+	return q
+}
+
+// configureDB applies the database-level settings in c to the database
+// name. They take effect for all new connections to it.
+func (p *Postgres) configureDB(ctx context.Context, name string, c *dbConfig) error {
+	for _, kv := range c.settings {
+		q := fmt.Sprintf("ALTER DATABASE %s SET %s = %s", pq.QuoteIdentifier(name), kv[0], kv[1])
+		if _, err := p.db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// populate creates the objects described by schema and c in db, the
+// database name, in the order CreateDB documents.
+func (p *Postgres) populate(ctx context.Context, db *sql.DB, name, schema string, c *dbConfig) error {
+	for _, name := range c.extensions {
+		if _, err := db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS "+pq.QuoteIdentifier(name)); err != nil {
+			return err
+		}
+	}
+	if c.fakeClock {
+		if _, err := db.ExecContext(ctx, clockShim); err != nil {
+			return err
+		}
+	}
+	if len(c.schemas) > 0 {
+		if err := applySchemas(ctx, db, c.schemas); err != nil {
+			return err
+		}
+	}
+	if schema != "" {
+		if _, err := db.ExecContext(ctx, schema); err != nil {
+			return queryError(schema, err)
+		}
+	}
+	if c.restore != "" {
+		if err := p.restore(ctx, name, c.restore); err != nil {
+			return err
+		}
+		if err := applyMasks(ctx, db, c.masks); err != nil {
+			return err
+		}
+	}
+	if c.seed != nil {
+		if err := c.seed(ctx, db); err != nil {
+			return fmt.Errorf("pqx: seeding: %w", err)
+		}
+	}
+	return nil
+}
+
+// replaceDB synchronously drops the database name, if it exists, after
+// terminating any connections to it.
+func (p *Postgres) replaceDB(ctx context.Context, name string) error {
+	if _, err := p.KillConnections(ctx, name); err != nil {
 		return err
-	})
+	}
+	_, err := p.db.ExecContext(ctx, "DROP DATABASE IF EXISTS "+pq.QuoteIdentifier(name))
+	return err
+}
+
+// initdbArgs returns the flags passed to initdb when creating the data
+// directory.
+func (p *Postgres) initdbArgs() []string {
+	var args []string
+	if p.Superuser != "" {
+		args = append(args, "-U", p.Superuser)
+	}
+	if p.DataChecksums {
+		args = append(args, "--data-checksums")
+	}
+	if p.SuperuserPassword != "" {
+		args = append(args, "--pwfile="+p.pwFile())
+	}
+	return args
 }
 
 // initdb creates a new postgres database using the initdb command and returns
 // the directory it was created in, or an error if any.
-func initdb(ctx context.Context, out io.Writer, binDir, dataDir string) error {
+func initdb(ctx context.Context, out io.Writer, binDir, dataDir string, args ...string) error {
 	if isPostgresDir(dataDir) {
 		return nil
 	}
-	cmd := exec.CommandContext(ctx, path.Join(binDir, "initdb"), dataDir)
+	args = append(args, dataDir)
+	cmd := exec.CommandContext(ctx, path.Join(binDir, "initdb"), args...)
 	cmd.Stdout = out
 	cmd.Stderr = out
 	return cmd.Run()
 }
 
+// A VersionMismatchError is returned by Start when the data directory was
+// initialized by a major version of postgres other than the one being
+// started, which cannot use it. Use Upgrade to keep its data, or set Reinit
+// to start over with an empty data directory.
+type VersionMismatchError struct {
+	Dir  string // the data directory
+	Have string // the major version of the data directory
+	Want string // the major version being started
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("pqx: data directory %s is from postgres %s, not %s; set Reinit to re-initialize it", e.Dir, e.Have, e.Want)
+}
+
+// checkDataVersion reports a *VersionMismatchError if the data directory
+// exists and is for another major version, unless Reinit is set, in which
+// case it removes the data directory.
+func (p *Postgres) checkDataVersion() error {
+	dir := p.dataDir()
+	data, err := os.ReadFile(filepath.Join(dir, "PG_VERSION"))
+	if err != nil {
+		return nil // not initialized yet
+	}
+	have := strings.TrimSpace(string(data))
+	want := majorVersion(p.version())
+	if have == want {
+		return nil
+	}
+	if !p.Reinit {
+		return &VersionMismatchError{Dir: dir, Have: have, Want: want}
+	}
+	p.log.infof("pqx: data directory %s is from postgres %s; re-initializing it for %s", dir, have, want)
+	return os.RemoveAll(dir)
+}
+
+// majorVersion returns the major version of the postgres version v, as
+// recorded in PG_VERSION: the first component for 10 and later, such as
+// "14" for "14.2.0", and the first two before, such as "9.6" for "9.6.24".
+func majorVersion(v string) string {
+	parts := strings.Split(v, ".")
+	if n, err := strconv.Atoi(parts[0]); err == nil && n < 10 && len(parts) > 1 {
+		return parts[0] + "." + parts[1]
+	}
+	return parts[0]
+}
+
 // isPostgresDir return true iif dir exists, is a directory, and contains the
 // file PG_VERSION; otherwise false.
 func isPostgresDir(dir string) bool {
@@ -244,30 +1143,222 @@ func isPostgresDir(dir string) bool {
 	return err == nil
 }
 
+// DSN returns the DSN for connecting to the database dbname, as named by
+// DBName.
 func (p *Postgres) DSN(dbname string) string {
-	return fmt.Sprintf("host=localhost port=%s dbname=%s sslmode=disable", p.port, dbname)
+	return p.connDSN(dbname) + p.dsnOptions()
+}
+
+// driverName returns the database/sql driver pqx connects to the server
+// with.
+func (p *Postgres) driverName() string {
+	if p.DriverName != "" {
+		return p.DriverName
+	}
+	return "postgres"
+}
+
+// connDSN is DSN without DSNOptions, for the connections pqx makes itself,
+// which options meant for clients, such as a default_transaction_read_only
+// in options, must not change.
+func (p *Postgres) connDSN(dbname string) string {
+	if p.External != "" {
+		return p.externalDSN(dbname)
+	}
+	return p.formatDSN("localhost", p.port, dbname)
+}
+
+// dsnOptions returns DSNOptions formatted for appending to a DSN.
+func (p *Postgres) dsnOptions() string {
+	var s string
+	for _, k := range sortedKeys(p.DSNOptions) {
+		s += " " + k + "=" + quoteDSNValue(p.DSNOptions[k])
+	}
+	return s
+}
+
+// dsn returns the DSN for connecting to dbname as configured by c.
+func (p *Postgres) dsn(dbname string, c *dbConfig) string {
+	dsn := p.DSN(dbname)
+	if c.proxy != nil {
+		dsn = p.formatDSN(c.proxy.Host(), c.proxy.Port(), dbname) + p.dsnOptions()
+	}
+	if c.appName != "" {
+		dsn += " fallback_application_name=" + quoteDSNValue(c.appName)
+	}
+	for _, kv := range c.dsnOptions {
+		dsn += " " + kv[0] + "=" + quoteDSNValue(kv[1])
+	}
+	return dsn
+}
+
+func (p *Postgres) formatDSN(host, port, dbname string) string {
+	dsn := fmt.Sprintf("host=%s port=%s dbname=%s sslmode=disable", host, port, quoteDSNValue(DBName(dbname)))
+	if p.Superuser != "" {
+		dsn += " user=" + quoteDSNValue(p.Superuser)
+	}
+	if p.SuperuserPassword != "" {
+		dsn += " password=" + quoteDSNValue(p.SuperuserPassword)
+	}
+	return dsn
 }
 
+// startLogTail is the number of lines of initdb and postgres output included
+// in startup errors.
+const startLogTail = 20
+
 // pingUntilUp pings the database until it's up; the provided context is
-// canceled; or p.readyContext is canceled, whichever comes first.
-func (p *Postgres) pingUntilUp(ctx context.Context, logf func(string, ...any)) error {
-	b := backoff.NewBackoff("ping", logf, 1*time.Second)
+// canceled; or postgres logs that it is ready, whichever comes first.
+//
+// If postgres does not come up, the returned error is a *PingError.
+func (p *Postgres) pingUntilUp(ctx context.Context) error {
+	b := backoff.NewBackoff("ping", p.log.debugf, 1*time.Second)
+	b.Strategy = p.Backoff
+
+	p.readyMu.Lock()
+	ready := p.readyCtx
+	p.readyMu.Unlock()
+	// Sleeps between pings end early when postgres is ready.
+	sleepCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ready.Done():
+			cancel()
+		case <-sleepCtx.Done():
+		}
+	}()
+
+	pe := &PingError{}
+	fail := func(err error) error {
+		pe.Err = err
+		pe.Log = p.tailLines()
+		return pe
+	}
 	for {
 		select {
-		case <-p.readyCtx.Done():
-			return nil
+		case <-ready.Done():
+			return p.roleError(p.db.PingContext(ctx))
 		case <-ctx.Done():
 			// oddly, p.db.PingContext isn't honoring the cotext it seems. Maybe a bug in lib/pq?
-			return ctx.Err()
+			return fail(ctx.Err())
 		default:
 		}
+		pe.Attempts++
 		err := p.db.PingContext(ctx)
 		if err == nil {
 			return nil
 		}
-		logf("pqx: ping failed; retrying: %v", err)
-		b.BackOff(p.readyCtx, err)
+		if err := p.roleError(err); err != nil {
+			return err
+		}
+		pe.record(err)
+		b.BackOff(sleepCtx, err)
+		if b.Exhausted() {
+			return fail(err)
+		}
+		p.log.infof("pqx: ping failed; retrying: %v", err)
+	}
+}
+
+// roleError returns an error explaining err if it reports that the role p
+// connects as does not exist, which, since Superuser only takes effect when
+// the data directory is initialized, means it was initialized with another.
+// Otherwise, it returns nil.
+func (p *Postgres) roleError(err error) error {
+	if p.External != "" || sqlState(err) != "28000" || !strings.Contains(err.Error(), "does not exist") {
+		return nil
+	}
+	return fmt.Errorf("pqx: %w: the data directory %s was initialized with a superuser of another name; set Superuser to it, or set Reinit", err, p.dataDir())
+}
+
+// resetReady arms the signal, given by signalReady when postgres logs that
+// it is ready, that pingUntilUp waits for.
+func (p *Postgres) resetReady() {
+	p.readyMu.Lock()
+	defer p.readyMu.Unlock()
+	p.readyCtx, p.ready = context.WithCancel(context.Background())
+}
+
+func (p *Postgres) signalReady() {
+	p.readyMu.Lock()
+	defer p.readyMu.Unlock()
+	p.ready()
+}
+
+// A PingError is returned by Start when postgres does not accept connections
+// before the context passed to Start is done, or before Backoff.MaxAttempts
+// pings have failed.
+type PingError struct {
+	Attempts int      // number of pings tried
+	Errs     []error  // the last few distinct ping errors, oldest first
+	Log      []string // the tail of the initdb and postgres output
+	Err      error    // the error that ended pinging
+}
+
+// maxPingErrs is the number of distinct ping errors kept by PingError.
+const maxPingErrs = 3
+
+func (e *PingError) record(err error) {
+	for i, seen := range e.Errs {
+		if seen.Error() == err.Error() {
+			e.Errs = append(e.Errs[:i], e.Errs[i+1:]...)
+			break
+		}
+	}
+	e.Errs = append(e.Errs, err)
+	if len(e.Errs) > maxPingErrs {
+		e.Errs = e.Errs[1:]
+	}
+}
+
+func (e *PingError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "pqx: postgres not up after %d pings: %v", e.Attempts, e.Err)
+	if len(e.Errs) > 0 {
+		b.WriteString("\nlast ping errors:")
+		for _, err := range e.Errs {
+			fmt.Fprintf(&b, "\n\t%v", err)
+		}
 	}
+	writeLog(&b, e.Log)
+	return b.String()
+}
+
+func (e *PingError) Unwrap() error { return e.Err }
+
+// A StartError is returned by Start when it fails for reasons other than
+// postgres not accepting connections, such as initdb or postgres exiting
+// with an error.
+type StartError struct {
+	Log []string // the tail of the initdb and postgres output
+	Err error
+}
+
+func (e *StartError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Err.Error())
+	writeLog(&b, e.Log)
+	return b.String()
+}
+
+func (e *StartError) Unwrap() error { return e.Err }
+
+// writeLog writes the postgres log lines to b, one per indented line.
+func writeLog(b *strings.Builder, lines []string) {
+	if len(lines) > 0 {
+		b.WriteString("\npostgres log:")
+		for _, line := range lines {
+			fmt.Fprintf(b, "\n\t%s", line)
+		}
+	}
+}
+
+// tailLines returns the tail of the initdb and postgres output, including
+// any partial last line.
+func (p *Postgres) tailLines() []string {
+	p.tailOut.Flush() //nolint
+	return p.tail.Lines()
 }
 
 func randomPort() string {
@@ -278,3 +1369,67 @@ func randomPort() string {
 	defer ln.Close()
 	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
 }
+
+// Ports and data directories in use by instances in this process. A port
+// returned by randomPort is free when returned, but may be returned again
+// before the instance it was returned for listens on it.
+var (
+	usedMu    sync.Mutex
+	usedPorts = map[string]bool{}
+	usedDirs  = map[string]bool{}
+)
+
+// reservePort returns a free port not used by another instance in this
+// process: the one derived from key, if set, or one from this process's
+// share of PQX_PORT_RANGE, if set, or else a random one.
+func reservePort(key string) (string, error) {
+	usedMu.Lock()
+	defer usedMu.Unlock()
+	if key != "" {
+		port, err := stablePort(key)
+		if err != nil {
+			return "", err
+		}
+		usedPorts[port] = true
+		return port, nil
+	}
+	if r := os.Getenv("PQX_PORT_RANGE"); r != "" {
+		port, err := partitionedPort(r)
+		if err != nil {
+			return "", err
+		}
+		usedPorts[port] = true
+		return port, nil
+	}
+	for {
+		port := randomPort()
+		if !usedPorts[port] {
+			usedPorts[port] = true
+			return port, nil
+		}
+	}
+}
+
+func releasePort(port string) {
+	usedMu.Lock()
+	defer usedMu.Unlock()
+	delete(usedPorts, port)
+}
+
+// claimDir reports an error if dir is the data directory of another
+// instance in this process, which would fail in confusing ways.
+func claimDir(dir string) error {
+	usedMu.Lock()
+	defer usedMu.Unlock()
+	if usedDirs[dir] {
+		return fmt.Errorf("pqx: data directory %s is in use by another instance", dir)
+	}
+	usedDirs[dir] = true
+	return nil
+}
+
+func releaseDir(dir string) {
+	usedMu.Lock()
+	defer usedMu.Unlock()
+	delete(usedDirs, dir)
+}
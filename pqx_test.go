@@ -2,18 +2,33 @@ package pqx_test
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"blake.io/pqx"
+	"blake.io/pqx/pqxgen"
 	"blake.io/pqx/pqxtest"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 func TestMain(m *testing.M) {
@@ -40,9 +55,73 @@ func TestMain(m *testing.M) {
 			panic("intentional panic")
 		}()
 		select {} // panic will kill us
-	} else {
-		pqxtest.TestMain(m)
 	}
+
+	// for TestPackageSchema
+	pqxtest.SetSchema(`CREATE TABLE package_schema (n int)`)
+
+	if os.Getenv("TESTING_RERUN") != "" {
+		// Run the tests twice against one instance, as TestRerun
+		// expects; see TESTING_ORPHAN above for why we chdir.
+		flag.Parse()
+		dir, err := os.MkdirTemp("", "pqxtest")
+		if err != nil {
+			panic(err)
+		}
+		_ = os.Chdir(dir)
+		pqxtest.Start(5*time.Second, 0)
+		code := m.Run()
+		if code == 0 {
+			pqxtest.Reset()
+			code = m.Run()
+		}
+		pqxtest.Shutdown()
+		os.Exit(code)
+	}
+	if os.Getenv("TESTING_CHILD") != "" {
+		// Run the tests selected by runChild with their own instance;
+		// see TESTING_ORPHAN above for why we chdir.
+		dir, err := os.MkdirTemp("", "pqxtest")
+		if err != nil {
+			panic(err)
+		}
+		_ = os.Chdir(dir)
+		// for TestChildLeavePrepared
+		pqxtest.Configure(func(p *pqx.Postgres) { p.MaxPreparedTransactions = 8 })
+	}
+	pqxtest.TestMain(m)
+}
+
+// runChild runs the test named test in a new process of the test binary,
+// with TESTING_CHILD set to mode, and env and args added, and returns its
+// output.
+func runChild(t *testing.T, test, mode string, env []string, args ...string) (string, error) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, append([]string{"-test.run=^" + test + "$", "-test.v"}, args...)...)
+	cmd.Env = append(append(os.Environ(), "TESTING_CHILD="+mode), env...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// startPostgres starts a Postgres of t's own, in a temporary directory,
+// after configure, if not nil, sets its fields, and shuts it down when t
+// ends. Tests of per-database features use the instance shared through
+// pqxtest instead.
+func startPostgres(t *testing.T, configure func(*pqx.Postgres)) *pqx.Postgres {
+	t.Helper()
+	p := &pqx.Postgres{Dir: t.TempDir()}
+	if configure != nil {
+		configure(p)
+	}
+	t.Cleanup(func() { p.Shutdown() }) //nolint
+	if err := p.Start(context.Background(), t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	return p
 }
 
 func TestStart(t *testing.T) {
@@ -130,3 +209,2094 @@ func scanString(t *testing.T, r io.Reader, format string) string {
 	}
 	return s
 }
+
+func TestNotices(t *testing.T) {
+	db := pqxtest.CreateDB(t, `DO $$ BEGIN RAISE NOTICE 'from schema'; END $$`)
+	_, err := db.Exec(`DO $$ BEGIN RAISE WARNING 'careful: %', 42; END $$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := pqxtest.Notices(t)
+	if len(got) != 1 {
+		t.Fatalf("got %d notices; want 1: %v", len(got), got)
+	}
+	if got[0].Severity != "WARNING" || got[0].Message != "careful: 42" {
+		t.Errorf("got %+v; want WARNING careful: 42", got[0])
+	}
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	db := pqxtest.CreateDB(t, "")
+
+	tryLock := func() bool {
+		t.Helper()
+		var ok bool
+		if err := db.QueryRow(`SELECT pg_try_advisory_xact_lock(42)`).Scan(&ok); err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	release := pqxtest.HoldAdvisoryLock(t, db, 42)
+	if !pqxtest.AdvisoryLockHeld(t, db, 42) {
+		t.Fatal("lock not held")
+	}
+	if tryLock() {
+		t.Fatal("acquired lock held by another session")
+	}
+	release()
+	if pqxtest.AdvisoryLockHeld(t, db, 42) {
+		t.Fatal("lock held after release")
+	}
+	if !tryLock() {
+		t.Fatal("could not acquire released lock")
+	}
+}
+
+func TestKillConnections(t *testing.T) {
+	db := pqxtest.CreateDB(t, "")
+	db.SetMaxIdleConns(1)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if n := pqxtest.KillConnections(t, db); n != 1 {
+		t.Fatalf("killed %d connections; want 1", n)
+	}
+
+	// The first query may or may not see the dropped connection,
+	// depending on whether the server's FATAL message arrives before
+	// the socket closes, but database/sql eventually discards the bad
+	// connection and dials a new one.
+	db.Exec(`SELECT 1`) //nolint
+	if _, err := db.Exec(`SELECT 1`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKillIdleConnections(t *testing.T) {
+	db := pqxtest.CreateDB(t, "")
+	db.SetMaxIdleConns(1)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if n := pqxtest.KillIdleConnections(t, db, time.Hour); n != 0 {
+		t.Fatalf("killed %d connections idle for an hour; want 0", n)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := pqxtest.KillIdleConnections(t, db, time.Millisecond); n != 1 {
+		t.Fatalf("killed %d connections; want 1", n)
+	}
+
+	// A connection left open by a global pool must not prevent the
+	// database from being dropped.
+	ctx := context.Background()
+	p := startPostgres(t, nil)
+	_, dsn, cleanup, err := p.CreateDB(ctx, t.Logf, "idle", "", pqx.WithKillIdle(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaked := sqlOpen(t, dsn)
+	if err := leaked.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	p.Flush()
+	if got, want := p.DropStats(), (pqx.DropStats{Dropped: 1}); got != want {
+		t.Errorf("DropStats = %+v; want %+v", got, want)
+	}
+}
+
+func TestTemplateSelection(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, nil)
+	t1 := sqlOpen(t, p.DSN("template1"))
+	if _, err := t1.Exec(`CREATE TABLE installed (x int)`); err != nil {
+		t.Fatal(err)
+	}
+	t1.Close()
+
+	for _, tt := range []struct {
+		template string
+		want     bool
+	}{
+		{"", true},
+		{"template1", true},
+		{"template0", false},
+	} {
+		db, _, cleanup, err := p.CreateDB(ctx, t.Logf, "tmpl_"+tt.template, "", pqx.WithTemplate(tt.template))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bool
+		if err := db.QueryRow(`SELECT to_regclass('installed') IS NOT NULL`).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+		if got != tt.want {
+			t.Errorf("template %q: table installed in template1 exists = %v; want %v", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestCreateTxDB(t *testing.T) {
+	const schema = `CREATE TABLE txdb (x int)`
+	for i := 0; i < 2; i++ {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			tx := pqxtest.CreateTxDB(t, schema)
+			pqxtest.AssertRowCount(t, tx, 0, `SELECT * FROM txdb`)
+			if _, err := tx.Exec(`INSERT INTO txdb VALUES (1)`); err != nil {
+				t.Fatal(err)
+			}
+			pqxtest.AssertRowCount(t, tx, 1, `SELECT * FROM txdb`)
+		})
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	tx := pqxtest.CreateTxDB(t, `CREATE TABLE sp (x int)`)
+	if _, err := tx.Exec(`INSERT INTO sp VALUES (0)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			pqxtest.Savepoint(t, tx)
+			if _, err := tx.Exec(`INSERT INTO sp VALUES ($1)`, i); err != nil {
+				t.Fatal(err)
+			}
+			pqxtest.AssertRowCount(t, tx, 2, `SELECT * FROM sp`)
+		})
+	}
+	pqxtest.AssertRowCount(t, tx, 1, `SELECT * FROM sp`)
+}
+
+func TestClientCerts(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) { p.ClientCerts = true })
+	admin := sqlOpen(t, p.DSN("postgres"))
+	if _, err := admin.Exec(`CREATE ROLE certuser LOGIN`); err != nil {
+		t.Fatal(err)
+	}
+
+	dsn, err := p.ClientCertDSN("postgres", "certuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sqlOpen(t, dsn)
+	var user string
+	var ssl bool
+	err = db.QueryRow(`SELECT current_user, ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()`).Scan(&user, &ssl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "certuser" || !ssl {
+		t.Errorf("connected as %q with ssl=%v; want certuser with ssl", user, ssl)
+	}
+
+	// TLS connections without a certificate are rejected.
+	noCert := sqlOpen(t, p.DSN("postgres")+" sslmode=require user=certuser")
+	if err := noCert.Ping(); err == nil {
+		t.Error("connected over TLS without a client certificate")
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) {
+		p.SCRAMUser = "scramuser"
+		p.SCRAMPassword = "s3cret"
+	})
+
+	db := sqlOpen(t, p.SCRAMDSN("postgres"))
+	var user, verifier string
+	err := db.QueryRow(`SELECT current_user, rolpassword FROM pg_authid WHERE rolname = current_user`).Scan(&user, &verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "scramuser" || !strings.HasPrefix(verifier, "SCRAM-SHA-256$") {
+		t.Errorf("connected as %q with password %q; want scramuser with a SCRAM verifier", user, verifier)
+	}
+
+	wrong := sqlOpen(t, p.DSN("postgres")+" user=scramuser password=wrong")
+	if err := wrong.Ping(); err == nil {
+		t.Error("connected with the wrong password")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	p := &pqx.Postgres{Dir: t.TempDir()}
+	t.Cleanup(func() { p.Shutdown() }) //nolint
+	srv := httptest.NewServer(p.Handler())
+	t.Cleanup(srv.Close)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz before start = %d; want 503", code)
+	}
+	if err := p.Start(ctx, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("/healthz"); code != http.StatusOK || body != "ok" {
+		t.Errorf("/healthz = %d %q; want 200 \"ok\"", code, body)
+	}
+	code, dsn := get("/dsn?dbname=template1")
+	if code != http.StatusOK || dsn != p.DSN("template1") {
+		t.Errorf("/dsn = %d %q; want 200 %q", code, dsn, p.DSN("template1"))
+	}
+	if err := sqlOpen(t, dsn).Ping(); err != nil {
+		t.Error(err)
+	}
+
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get("/dsn"); code != http.StatusServiceUnavailable {
+		t.Errorf("/dsn after shutdown = %d; want 503", code)
+	}
+}
+
+func TestShutdownFast(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var logs strings.Builder
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(&logs, format+"\n", args...)
+	}
+	p := &pqx.Postgres{Dir: t.TempDir()}
+	if err := p.Start(ctx, logf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A backend in an open transaction must not keep postgres from
+	// shutting down.
+	tx, err := sqlOpen(t, p.DSN("postgres")).Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() //nolint
+	if _, err := tx.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ShutdownFast(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(logs.String(), "fast shutdown request") {
+		t.Errorf("logs do not report a fast shutdown:\n%s", logs.String())
+	}
+}
+
+func TestDropLeftovers(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Create databases and exit without calling their cleanups, as a
+	// test binary killed by -timeout would.
+	p := &pqx.Postgres{Dir: dir}
+	if _, _, _, err := p.CreateDB(ctx, t.Logf, "leftover", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := p.CreateDB(ctx, t.Logf, "kept", "", pqx.WithKeep()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ShutdownFast(); err != nil {
+		t.Fatal(err)
+	}
+
+	p = startPostgres(t, func(p *pqx.Postgres) { p.Dir = dir })
+	db := sqlOpen(t, p.DSN("postgres"))
+	rows, err := db.Query(`SELECT datname FROM pg_database WHERE datname IN ('leftover', 'kept')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if got := strings.Join(names, ","); got != "kept" {
+		t.Errorf("databases after restart = %q; want %q", got, "kept")
+	}
+}
+
+func TestExternal(t *testing.T) {
+	ctx := context.Background()
+	server := startPostgres(t, nil)
+
+	p := &pqx.Postgres{External: server.DSN("postgres")}
+	db, _, cleanup, err := p.CreateDB(ctx, t.Logf, "external", "CREATE TABLE t (x int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	err = sqlOpen(t, server.DSN("postgres")).QueryRow(`SELECT count(*) FROM pg_database WHERE datname = 'external'`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("database not dropped on the external server")
+	}
+}
+
+func TestCreateDBRetry(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, nil)
+	if _, _, cleanup, err := p.CreateDB(ctx, t.Logf, "before", ""); err != nil {
+		t.Fatal(err)
+	} else {
+		cleanup()
+	}
+	p.Flush()
+
+	// Break the idle connections pqx manages postgres with, as a
+	// momentary hiccup under load would.
+	db := sqlOpen(t, p.DSN("postgres"))
+	var n int
+	err := db.QueryRow(`
+		SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity
+		WHERE datname = 'postgres' AND pid <> pg_backend_pid()`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("no control connections terminated")
+	}
+
+	if _, _, _, err := p.CreateDB(ctx, t.Logf, "after", ""); err != nil {
+		t.Fatalf("CreateDB after connection loss: %v", err)
+	}
+}
+
+func TestDied(t *testing.T) {
+	ctx := context.Background()
+	kill := func(t *testing.T, p *pqx.Postgres) {
+		t.Helper()
+		proc, err := os.FindProcess(p.Pid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proc.Kill(); err != nil {
+			t.Fatal(err)
+		}
+		db := sqlOpen(t, p.DSN("postgres"))
+		for db.Ping() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// Give orphaned backends time to notice and exit.
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		p := startPostgres(t, nil)
+		kill(t, p)
+		for i := 0; i < 2; i++ {
+			_, _, _, err := p.CreateDB(ctx, t.Logf, fmt.Sprintf("db%d", i), "")
+			var de *pqx.DiedError
+			if !errors.As(err, &de) {
+				t.Fatalf("CreateDB after death: err = %v; want a *DiedError", err)
+			}
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		p := startPostgres(t, func(p *pqx.Postgres) { p.Restart = true })
+		kill(t, p)
+		db, _, _, err := p.CreateDB(ctx, t.Logf, "restarted", "")
+		if err != nil {
+			t.Fatalf("CreateDB after death: %v", err)
+		}
+		if err := db.Ping(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSuperuserPassword(t *testing.T) {
+	dir := t.TempDir()
+	start := func() *pqx.Postgres {
+		t.Helper()
+		return startPostgres(t, func(p *pqx.Postgres) {
+			p.Dir = dir
+			p.SuperuserPassword = "s3cret"
+			p.PasswordAuth = "md5"
+		})
+	}
+
+	p := start()
+	db := sqlOpen(t, p.DSN("postgres"))
+	var verifier string
+	if err := db.QueryRow(`SELECT rolpassword FROM pg_authid WHERE rolname = current_user`).Scan(&verifier); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(verifier, "md5") {
+		t.Errorf("password stored as %q; want an md5 hash", verifier)
+	}
+	if err := sqlOpen(t, p.DSN("postgres")+" password=wrong").Ping(); err == nil {
+		t.Error("connected with the wrong password")
+	}
+
+	// Rotate the password, as a test might; the next start restores it.
+	if _, err := db.Exec(`ALTER ROLE CURRENT_USER PASSWORD 'rotated'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlOpen(t, p.DSN("postgres")+" password=rotated").Ping(); err != nil {
+		t.Errorf("connecting with the rotated password: %v", err)
+	}
+	db.Close()
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	p = start()
+	if err := sqlOpen(t, p.DSN("postgres")).Ping(); err != nil {
+		t.Errorf("connecting after restart: %v", err)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	db := pqxtest.CreateDB(t, `CREATE TABLE docs (id uuid DEFAULT uuid_generate_v4(), body text)`,
+		pqx.PresetUUID, pqx.PresetTextSearch)
+	if _, err := db.Exec(`INSERT INTO docs (body) VALUES ('Café')`); err != nil {
+		t.Fatal(err)
+	}
+	var body, config string
+	err := db.QueryRow(`SELECT unaccent(body), current_setting('default_text_search_config') FROM docs WHERE similarity(body, 'Cafe') > 0.1`).Scan(&body, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "Cafe" || config != "pg_catalog.english" {
+		t.Errorf("got %q with %q; want \"Cafe\" with pg_catalog.english", body, config)
+	}
+}
+
+func TestFiredTriggers(t *testing.T) {
+	db := pqxtest.CreateDB(t, `
+		CREATE TABLE items (n int);
+		CREATE TABLE audit (n int);
+		CREATE FUNCTION audit_fn() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			INSERT INTO audit VALUES (NEW.n);
+			RETURN NEW;
+		END $$;
+		CREATE FUNCTION unused_fn() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			RETURN NEW;
+		END $$;
+		CREATE TRIGGER audit_insert AFTER INSERT ON items FOR EACH ROW EXECUTE FUNCTION audit_fn();
+		CREATE TRIGGER audit_update AFTER UPDATE ON items FOR EACH ROW EXECUTE FUNCTION unused_fn();
+	`, pqx.WithTriggerLogging())
+
+	fired := pqxtest.FiredTriggers(t, db, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), `INSERT INTO items VALUES (1)`)
+		return err
+	})
+	if got := strings.Join(fired, ","); got != "audit_insert on items" {
+		t.Errorf("fired triggers = %q; want %q", got, "audit_insert on items")
+	}
+	pqxtest.AssertRowCount(t, db, 1, `SELECT * FROM audit`)
+}
+
+func TestJobQueue(t *testing.T) {
+	q := pqxtest.CreateJobQueue(t, `CREATE TABLE results (payload text)`)
+	for _, p := range []string{"a", "b", "c", "d"} {
+		q.Enqueue(t, p)
+	}
+	q.Work(t, 2, 10*time.Second, func(ctx context.Context, tx *sql.Tx, job pqxtest.Job) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO results VALUES ($1)`, job.Payload)
+		return err
+	})
+	q.AssertProcessed(t)
+	pqxtest.AssertRowCount(t, q.DB, 4, `SELECT DISTINCT payload FROM results`)
+
+	id := q.Enqueue(t, "bad")
+	q.Work(t, 1, 10*time.Second, func(ctx context.Context, tx *sql.Tx, job pqxtest.Job) error {
+		return errors.New("boom")
+	})
+	jobs := q.Jobs(t)
+	if last := jobs[len(jobs)-1]; last.ID != id || last.Done || last.Error != "boom" {
+		t.Errorf("failed job = %+v; want job %d failed with boom", last, id)
+	}
+}
+
+func TestImportSchema(t *testing.T) {
+	pqxtest.CreateDB(t, `
+		CREATE TABLE orgs (id int PRIMARY KEY);
+		CREATE TABLE users (id int PRIMARY KEY, org int REFERENCES orgs);
+	`)
+	schema, err := pqx.ImportSchema(context.Background(), pqxtest.DSNForTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := pqxtest.CreateDB(t, schema)
+	if _, err := db.Exec(`INSERT INTO users VALUES (1, 1)`); err == nil {
+		t.Error("inserted a user violating the imported foreign key")
+	}
+}
+
+func TestRestoreMasks(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, nil)
+	_, srcDSN, cleanup, err := p.CreateDB(ctx, t.Logf, "src", `
+		CREATE TABLE users (id int PRIMARY KEY, email text UNIQUE, ssn text);
+		INSERT INTO users VALUES (1, 'ann@corp.com', '123-45-6789'), (2, 'bob@corp.com', '987-65-4321');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	out, err := exec.Command(filepath.Join(p.BinDir(), "pg_dump"), "--no-owner", "--file", dump, "--dbname", srcDSN).CombinedOutput()
+	if err != nil {
+		t.Fatalf("pg_dump: %v\n%s", err, out)
+	}
+
+	db, _, cleanup, err := p.CreateDB(ctx, t.Logf, "masked", "", pqx.WithRestore(dump,
+		pqx.EmailMask("users", "email"),
+		pqx.NullMask("users", "ssn"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	pqxtest.AssertRowCount(t, db, 2, `SELECT * FROM users WHERE email LIKE '%@example.com' AND ssn IS NULL`)
+}
+
+func TestSessionSetup(t *testing.T) {
+	var calls int32
+	db := pqxtest.CreateDB(t, "", pqx.WithSessionSetup(func(ctx context.Context, conn *sql.Conn) error {
+		atomic.AddInt32(&calls, 1)
+		_, err := conn.ExecContext(ctx, `SET statement_timeout = '1234ms'`)
+		return err
+	}))
+
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		var got string
+		if err := conn.QueryRowContext(ctx, `SHOW statement_timeout`).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != "1234ms" {
+			t.Errorf("statement_timeout = %q; want 1234ms", got)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n < 2 {
+		t.Errorf("setup called %d times; want once per connection", n)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	db, px := pqxtest.CreateProxiedDB(t, "")
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	px.Pause()
+	done := make(chan error, 1)
+	go func() { done <- db.Ping() }()
+	select {
+	case err := <-done:
+		t.Fatalf("ping returned through paused proxy: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	px.Resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	px.DropConnections()
+	db.Exec(`SELECT 1`) //nolint // may see the dropped connection
+	if _, err := db.Exec(`SELECT 1`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpills(t *testing.T) {
+	db := pqxtest.CreateDB(t, "", pqx.WithWorkMem("64kB"), pqx.WithTempFileLimit("10MB"))
+	const sorted = `SELECT g FROM generate_series(1, 100000) g ORDER BY g DESC`
+	pqxtest.AssertSpills(t, db, true, sorted)
+	pqxtest.AssertSpills(t, db, false, `SELECT 1`)
+
+	const huge = `SELECT g FROM generate_series(1, 10000000) g ORDER BY g DESC`
+	_, err := db.Exec(huge)
+	if err == nil {
+		t.Fatal("expected temp_file_limit error")
+	}
+}
+
+func TestReplicaPair(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rp, err := pqx.StartReplicaPair(ctx, pqx.ReplicaPairOptions{
+		Dir:    t.TempDir(),
+		Schema: `CREATE TABLE foo (n int PRIMARY KEY)`,
+		Tables: []string{"foo"},
+		Logf:   t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Shutdown() //nolint
+
+	if _, err := rp.PublisherDB.Exec(`INSERT INTO foo VALUES (1), (2)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := rp.SubscriberDB.QueryRow(`SELECT count(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("subscriber has %d rows; want 2", n)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	primary := startPostgres(t, nil)
+	db, _, cleanup, err := primary.CreateDB(ctx, t.Logf, "replicated", `CREATE TABLE foo (n int)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	r, err := primary.StartReplica(ctx, t.Logf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown() //nolint
+
+	if _, err := db.Exec(`INSERT INTO foo VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WaitForReplay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := sql.Open("postgres", r.DSN("replicated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	var n int
+	if err := rdb.QueryRow(`SELECT count(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("replica has %d rows; want 1", n)
+	}
+	if _, err := rdb.Exec(`INSERT INTO foo VALUES (2)`); err == nil {
+		t.Error("replica accepted a write")
+	}
+
+	// A paused replica serves stale reads until resumed.
+	if err := r.PauseReplay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO foo VALUES (3)`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := rdb.QueryRow(`SELECT count(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("paused replica has %d rows; want 1", n)
+	}
+	if err := r.ResumeReplay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WaitForReplay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.QueryRow(`SELECT count(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("resumed replica has %d rows; want 2", n)
+	}
+}
+
+func TestCaptureChanges(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) { p.Logical = true })
+	db, _, cleanup, err := p.CreateDB(context.Background(), t.Logf, "capture", `
+		CREATE TABLE foo (n int PRIMARY KEY);
+		CREATE TABLE bar (n int);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	c := pqxtest.CaptureChanges(t, db, "foo")
+	_, err = db.Exec(`
+		INSERT INTO foo VALUES (1);
+		INSERT INTO bar VALUES (1);
+		DELETE FROM foo;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.Changes(t)
+	var ops []string
+	for _, ch := range got {
+		if ch.Table != "public.foo" {
+			t.Errorf("captured change to %s", ch.Table)
+		}
+		ops = append(ops, ch.Op)
+	}
+	if strings.Join(ops, ",") != "INSERT,DELETE" {
+		t.Errorf("ops = %v; want [INSERT DELETE]", ops)
+	}
+	if got := c.Changes(t); len(got) != 0 {
+		t.Errorf("changes not consumed: %v", got)
+	}
+}
+
+func TestFDWPair(t *testing.T) {
+	local, remote := pqxtest.CreateFDWPair(t, "", `CREATE TABLE foo (n int)`)
+	if _, err := remote.Exec(`INSERT INTO foo VALUES (7)`); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := local.QueryRow(`SELECT n FROM remote.foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("n = %d; want 7", n)
+	}
+}
+
+func TestCreateDBs(t *testing.T) {
+	dbs := pqxtest.CreateDBs(t, 3, `CREATE TABLE foo (n int)`)
+	if len(dbs) != 3 {
+		t.Fatalf("got %d databases; want 3", len(dbs))
+	}
+	if _, err := dbs[0].Exec(`INSERT INTO foo VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	for i, db := range dbs[1:] {
+		var n int
+		if err := db.QueryRow(`SELECT count(*) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("database %d shares rows with database 0", i+1)
+		}
+	}
+
+	infos := pqxtest.Databases(t)
+	if len(infos) != 3 {
+		t.Fatalf("Databases = %v; want 3", infos)
+	}
+	for i, dsn := range pqxtest.DSNs(t) {
+		if dsn != infos[i].DSN || !strings.Contains(dsn, infos[i].Name) {
+			t.Errorf("DSNs()[%d] = %q; want dsn for %v", i, dsn, infos[i])
+		}
+	}
+}
+
+func TestRestoreToTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	p := startPostgres(t, func(p *pqx.Postgres) { p.Archive = true })
+	db, _, cleanup, err := p.CreateDB(ctx, t.Logf, "pitr", `CREATE TABLE foo (n int)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	backup := t.TempDir()
+	if err := p.BaseBackup(ctx, backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO foo VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	var target time.Time
+	if err := db.QueryRow(`SELECT clock_timestamp()`).Scan(&target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO foo VALUES (2)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ArchiveWAL(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := p.RestoreToTime(ctx, t.Logf, backup, t.TempDir(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown() //nolint
+	rdb, err := sql.Open("postgres", r.DSN("pitr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	var n int
+	if err := rdb.QueryRow(`SELECT count(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("restored %d rows; want 1", n)
+	}
+}
+
+func TestTablespace(t *testing.T) {
+	ts := pqxtest.CreateTablespace(t)
+	db := pqxtest.CreateDB(t, `CREATE TABLE foo (n int)`, pqx.WithTablespace(ts))
+	var got string
+	const q = `
+		SELECT t.spcname FROM pg_database d
+		JOIN pg_tablespace t ON t.oid = d.dattablespace
+		WHERE d.datname = current_database()`
+	if err := db.QueryRow(q).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != ts {
+		t.Errorf("database tablespace = %q; want %q", got, ts)
+	}
+}
+
+func TestUnloggedTables(t *testing.T) {
+	db := pqxtest.CreateDB(t, `
+		CREATE TABLE parent (id int PRIMARY KEY);
+		CREATE TABLE child (parent_id int REFERENCES parent);
+	`, pqx.WithUnloggedTables())
+	var logged int
+	const q = `SELECT count(*) FROM pg_class WHERE relname IN ('parent', 'child') AND relpersistence <> 'u'`
+	if err := db.QueryRow(q).Scan(&logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged != 0 {
+		t.Errorf("%d tables still logged", logged)
+	}
+}
+
+func TestInvalidMemorySetting(t *testing.T) {
+	p := &pqx.Postgres{Dir: t.TempDir(), WorkMem: "lots"}
+	err := p.Start(context.Background(), t.Logf)
+	if err == nil || !strings.Contains(err.Error(), "work_mem") {
+		t.Fatalf("Start = %v; want invalid work_mem error", err)
+	}
+}
+
+func TestParallelSettings(t *testing.T) {
+	const schema = `CREATE TABLE foo AS SELECT g AS n FROM generate_series(1, 1000) g`
+	plan := func(db *sql.DB) string {
+		t.Helper()
+		rows, err := db.Query(`EXPLAIN (COSTS OFF) SELECT count(*) FROM foo`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var plan strings.Builder
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				t.Fatal(err)
+			}
+			plan.WriteString(line + "\n")
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return plan.String()
+	}
+
+	db := pqxtest.CreateDB(t, schema, pqx.WithParallel(pqx.Parallel{
+		MaxWorkers:          2,
+		MaxWorkersPerGather: 2,
+		Force:               true,
+	}))
+	if p := plan(db); !strings.Contains(p, "Gather") {
+		t.Errorf("forced plan is not parallel:\n%s", p)
+	}
+
+	db = pqxtest.CreateDB(t, schema, pqx.WithParallel(pqx.Parallel{}))
+	if p := plan(db); strings.Contains(p, "Gather") {
+		t.Errorf("disabled plan is parallel:\n%s", p)
+	}
+}
+
+func TestCreateDBExists(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, nil)
+
+	_, _, cleanup, err := p.CreateDB(ctx, t.Logf, "dup", "", pqx.WithKeep())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+
+	_, _, _, err = p.CreateDB(ctx, t.Logf, "dup", "")
+	if !errors.Is(err, pqx.ErrDatabaseExists) {
+		t.Fatalf("err = %v; want ErrDatabaseExists", err)
+	}
+
+	_, _, cleanup, err = p.CreateDB(ctx, t.Logf, "dup", "", pqx.WithReplace())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+}
+
+func TestSubtestDSN(t *testing.T) {
+	pqxtest.CreateDB(t, "")
+	parent := pqxtest.DSNForTest(t)
+	t.Run("inherit", func(t *testing.T) {
+		if got := pqxtest.DSNForTest(t); got != parent {
+			t.Errorf("DSNForTest = %q; want parent's %q", got, parent)
+		}
+	})
+	t.Run("own", func(t *testing.T) {
+		pqxtest.CreateDB(t, "")
+		if got := pqxtest.DSNForTest(t); got == parent {
+			t.Error("DSNForTest returned parent's dsn; want own")
+		}
+		if got := len(pqxtest.Databases(t)); got != 2 {
+			t.Errorf("len(Databases) = %d; want 2", got)
+		}
+	})
+	if got := len(pqxtest.Databases(t)); got != 1 {
+		t.Errorf("len(Databases) = %d; want 1 (subtest databases are not visible)", got)
+	}
+}
+
+func TestRunCases(t *testing.T) {
+	const schema = `CREATE TABLE foo (n int); INSERT INTO foo VALUES (1)`
+	pqxtest.RunCases(t, schema, map[string]int{
+		"a": 2,
+		"b": 3,
+	}, func(t *testing.T, db *sql.DB, n int) {
+		if _, err := db.Exec(`INSERT INTO foo VALUES ($1)`, n); err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		if err := db.QueryRow(`SELECT count(*) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("count = %d; want 2 (one row from the template, one from this case)", count)
+		}
+	})
+}
+
+func TestPackageSchema(t *testing.T) {
+	db := pqxtest.CreateDB(t, "")
+	if _, err := db.Exec(`INSERT INTO package_schema VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	db = pqxtest.CreateDB(t, `CREATE TABLE foo (n int)`)
+	if _, err := db.Exec(`SELECT * FROM package_schema`); err == nil {
+		t.Error("package schema applied to database with its own schema")
+	}
+}
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, nil)
+
+	tmpl, err := p.Template(ctx, t.Logf, `CREATE TABLE foo (id serial, n int)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := p.NewPool(ctx, t.Logf, 1, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	use := func() (name string, id int) {
+		t.Helper()
+		db, name, _, release, err := pl.Get(ctx, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		if err := db.QueryRow(`INSERT INTO foo (n) VALUES (1) RETURNING id`).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return name, id
+	}
+	name1, id1 := use()
+	name2, id2 := use()
+	if name1 != name2 {
+		t.Errorf("second Get returned %q; want reused %q", name2, name1)
+	}
+	if id1 != 1 || id2 != 1 {
+		t.Errorf("ids = %d, %d; want 1, 1 (sequence reset)", id1, id2)
+	}
+
+	for _, o := range []pqx.DBOption{pqx.WithFakeClock(), pqx.WithSchemas(map[string]string{"app": ""})} {
+		if _, _, _, _, err := pl.Get(ctx, t.Logf, o); err == nil {
+			t.Error("Get with an option needing populate succeeded; want error")
+		}
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	ctx := context.Background()
+	const schema = `CREATE TABLE foo (id serial)`
+	p := startPostgres(t, func(p *pqx.Postgres) {
+		p.PoolSize = 1
+		p.PoolSchema = schema
+	})
+
+	use := func(name string, opts ...pqx.DBOption) (dbname string, id int) {
+		t.Helper()
+		db, _, cleanup, err := p.CreateDB(ctx, t.Logf, name, schema, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+		if err := db.QueryRow(`INSERT INTO foo DEFAULT VALUES RETURNING id, current_database()`).Scan(&id, &dbname); err != nil {
+			t.Fatal(err)
+		}
+		return dbname, id
+	}
+	name1, id1 := use("pooled1")
+	name2, id2 := use("pooled2")
+	if name1 != name2 || name1 == "pooled1" {
+		t.Errorf("CreateDB used %q, then %q; want the same pooled database", name1, name2)
+	}
+	if id1 != 1 || id2 != 1 {
+		t.Errorf("ids = %d, %d; want 1, 1 (sequence reset)", id1, id2)
+	}
+	if name, _ := use("clock", pqx.WithFakeClock()); name != "clock" {
+		t.Errorf("CreateDB with WithFakeClock used %q; want a new database", name)
+	}
+}
+
+func TestDropStats(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, func(p *pqx.Postgres) { p.DropWorkers = 1 })
+
+	for i := 0; i < 3; i++ {
+		_, _, cleanup, err := p.CreateDB(ctx, t.Logf, fmt.Sprintf("drop%d", i), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+	}
+	p.Flush()
+	got := p.DropStats()
+	want := pqx.DropStats{Dropped: 3}
+	if got != want {
+		t.Errorf("DropStats = %+v; want %+v", got, want)
+	}
+}
+
+func TestRecycle(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, nil)
+
+	const schema = `CREATE TABLE foo (id serial)`
+	for i := 0; i < 2; i++ {
+		db, _, cleanup, err := p.CreateDB(ctx, t.Logf, fmt.Sprintf("recycle%d", i), schema, pqx.WithRecycle())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var id int
+		if err := db.QueryRow(`INSERT INTO foo DEFAULT VALUES RETURNING id`).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		if id != 1 {
+			t.Errorf("[%d]: id = %d; want 1", i, id)
+		}
+		cleanup()
+		p.Flush()
+	}
+	if got := p.DropStats().Dropped; got != 0 {
+		t.Errorf("Dropped = %d; want 0", got)
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	m := pqx.NewManager(&pqx.Postgres{Dir: t.TempDir()}, t.Logf)
+
+	db, _, cleanup, err := m.CreateDB(ctx, "a", `CREATE TABLE foo (n int)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO foo VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	cleanup() // no-op
+
+	if _, _, _, err := m.CreateDB(ctx, "b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Postgres().DropStats().Dropped; got != 2 {
+		t.Errorf("Dropped = %d; want 2", got)
+	}
+	if _, _, _, err := m.CreateDB(ctx, "c", ""); err == nil {
+		t.Error("CreateDB after Close succeeded")
+	}
+}
+
+func TestRerun(t *testing.T) {
+	if os.Getenv("TESTING_RERUN") != "" {
+		return // the child
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each test is run four times: twice by -test.count, in each of two
+	// calls to m.Run.
+	cmd := exec.Command(exe,
+		"-test.run=^(TestPackageSchema|TestRunCases|TestSubtestDSN|TestNotices)$",
+		"-test.count=2",
+	)
+	cmd.Env = append(os.Environ(), "TESTING_RERUN=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("rerun failed: %v\n%s", err, out)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	r := &pqx.Registry{Dir: t.TempDir()}
+	t.Cleanup(func() { r.Shutdown() }) //nolint
+
+	ps, err := r.Start(ctx, t.Logf, "a", "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := map[string]bool{}
+	for _, p := range ps {
+		dsn := p.DSN("postgres")
+		if ports[dsn] {
+			t.Errorf("two instances share dsn %q", dsn)
+		}
+		ports[dsn] = true
+	}
+	if got := r.Get("b"); got != ps[1] {
+		t.Errorf("Get(b) = %p; want %p", got, ps[1])
+	}
+	if got := strings.Join(r.Names(), ","); got != "a,b,c" {
+		t.Errorf("Names = %q; want a,b,c", got)
+	}
+
+	p := &pqx.Postgres{Dir: ps[0].Dir}
+	if err := p.Start(ctx, t.Logf); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Start with a used data directory = %v; want in use error", err)
+	}
+}
+
+func TestStartErrorIncludesLog(t *testing.T) {
+	// A shared_buffers below the minimum makes postgres exit right away with
+	// an explanation in its log.
+	p := &pqx.Postgres{Dir: t.TempDir(), SharedBuffers: "1", Backoff: pqx.Backoff{MaxAttempts: 3}}
+	err := p.Start(context.Background(), t.Logf)
+	if err == nil {
+		p.Shutdown() //nolint
+		t.Fatal("Start succeeded")
+	}
+	if !strings.Contains(err.Error(), "postgres log:") || !strings.Contains(err.Error(), "shared_buffers") {
+		t.Errorf("Start error does not include postgres log:\n%v", err)
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, pqx.DefaultVersion, "data")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "PG_VERSION"), []byte("9.6\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &pqx.Postgres{Dir: dir}
+	var vme *pqx.VersionMismatchError
+	if err := p.Start(context.Background(), t.Logf); !errors.As(err, &vme) || vme.Have != "9.6" {
+		t.Fatalf("Start = %v; want VersionMismatchError for 9.6", err)
+	}
+
+	p = &pqx.Postgres{Dir: dir, Reinit: true}
+	if err := p.Start(context.Background(), t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	p.Shutdown() //nolint
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	ctx := context.Background()
+	p := startPostgres(t, func(p *pqx.Postgres) { p.DataChecksums = true })
+	db, _, cleanup, err := p.CreateDB(ctx, t.Logf, "checksums", `CREATE TABLE foo AS SELECT generate_series(1, 100) n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := p.VerifyChecksums(ctx); err == nil {
+		t.Error("VerifyChecksums succeeded while running")
+	}
+	cleanup()
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.VerifyChecksums(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	const schema = `CREATE TABLE foo AS SELECT g AS n FROM generate_series(1, 1000) g`
+	db := pqxtest.CreateDB(t, schema, pqx.WithAnalyze())
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM pg_stats WHERE tablename = 'foo'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("no statistics for foo after WithAnalyze")
+	}
+}
+
+func TestRandomSeed(t *testing.T) {
+	random := func() float64 {
+		t.Helper()
+		db := pqxtest.CreateDB(t, "", pqx.WithRandomSeed(0.5))
+		var f float64
+		if err := db.QueryRow(`SELECT random()`).Scan(&f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	if a, b := random(), random(); a != b {
+		t.Errorf("random() = %v, %v; want equal with the same seed", a, b)
+	}
+}
+
+func TestRandomSeedInvalid(t *testing.T) {
+	p := &pqx.Postgres{Dir: t.TempDir()}
+	for _, seed := range []float64{1.5, math.NaN(), math.Inf(-1)} {
+		if _, _, cleanup, err := p.CreateDB(context.Background(), t.Logf, "seed", "", pqx.WithRandomSeed(seed)); err == nil {
+			cleanup()
+			t.Errorf("CreateDB with seed %v succeeded", seed)
+		}
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	db := pqxtest.CreateDB(t, `CREATE TABLE foo (at timestamptz DEFAULT now())`, pqx.WithFakeClock())
+	want := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	pqxtest.SetNow(t, db, want)
+	if _, err := db.Exec(`INSERT INTO foo DEFAULT VALUES`); err != nil {
+		t.Fatal(err)
+	}
+	var got time.Time
+	if err := db.QueryRow(`SELECT at FROM foo`).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("now() = %v; want %v", got, want)
+	}
+
+	pqxtest.SetNow(t, db, time.Time{})
+	if err := db.QueryRow(`SELECT now()`).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(got) > time.Hour {
+		t.Errorf("now() = %v after reset; want real time", got)
+	}
+}
+
+func TestRLS(t *testing.T) {
+	db := pqxtest.CreateDB(t, `
+		CREATE TABLE docs (owner text, body text);
+		INSERT INTO docs VALUES ('alice', 'a'), ('bob', 'b'), ('bob', 'c');
+		ALTER TABLE docs ENABLE ROW LEVEL SECURITY;
+		CREATE POLICY own ON docs USING (owner = current_setting('app.user'));
+	`)
+	role := pqxtest.CreateRole(t, db, "app")
+	conn := pqxtest.AsRole(t, db, role)
+	if _, err := conn.ExecContext(context.Background(), `SET app.user = 'bob'`); err != nil {
+		t.Fatal(err)
+	}
+	pqxtest.AssertRowCount(t, conn, 2, `SELECT * FROM docs`)
+	pqxtest.AssertRowCount(t, db, 3, `SELECT * FROM docs`) // superuser bypasses RLS
+}
+
+func TestSearchPath(t *testing.T) {
+	db := pqxtest.CreateDB(t, `
+		CREATE SCHEMA app;
+		CREATE TABLE app.foo (n int);
+	`, pqx.WithSearchPath("app", "public"))
+	if _, err := db.Exec(`INSERT INTO foo VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	var schemas []string
+	if err := db.QueryRow(`SELECT current_schemas(false)`).Scan(pq.Array(&schemas)); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(schemas, ","); got != "app,public" {
+		t.Errorf("current_schemas = %q; want app,public", got)
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	db := pqxtest.CreateDB(t, "", pqx.WithSchemas(map[string]string{
+		// billing sorts first, but depends on accounts
+		"billing":  `CREATE TABLE invoices (account int REFERENCES accounts)`,
+		"accounts": `CREATE TABLE accounts (id int PRIMARY KEY)`,
+	}))
+	if _, err := db.Exec(`INSERT INTO accounts VALUES (1); INSERT INTO invoices VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM billing.invoices`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d invoices; want 1", n)
+	}
+}
+
+func TestGen(t *testing.T) {
+	db := pqxtest.CreateDB(t, `
+		CREATE TYPE mood AS ENUM ('happy', 'sad');
+		CREATE TABLE users (
+			id int PRIMARY KEY,
+			email varchar(20) UNIQUE NOT NULL,
+			mood mood NOT NULL,
+			created timestamptz NOT NULL
+		);
+		CREATE TABLE orders (
+			id serial PRIMARY KEY,
+			user_id int NOT NULL REFERENCES users,
+			total numeric NOT NULL,
+			note text
+		);
+	`)
+
+	g := &pqxgen.Generator{Rand: rand.New(rand.NewSource(1)), NullFraction: 0.5}
+	// orders is listed first, but depends on users
+	if err := g.Fill(context.Background(), db, 100, "orders", "users"); err != nil {
+		t.Fatal(err)
+	}
+	pqxtest.AssertRowCount(t, db, 100, `SELECT * FROM users`)
+	pqxtest.AssertRowCount(t, db, 100, `SELECT * FROM orders`)
+}
+
+func TestSeed(t *testing.T) {
+	const schema = `CREATE TABLE seeded (n int)`
+	seeds := 0
+	seed := func(ctx context.Context, db *sql.DB) error {
+		seeds++
+		_, err := db.ExecContext(ctx, `INSERT INTO seeded SELECT generate_series(1, 10)`)
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		db := pqxtest.CreateDB(t, schema, pqx.WithSeed(seed))
+		pqxtest.AssertRowCount(t, db, 10, `SELECT * FROM seeded`)
+	}
+	if seeds != 1 {
+		t.Errorf("seeded %d times; want 1", seeds)
+	}
+}
+
+func TestTwoPhase(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) { p.MaxPreparedTransactions = 8 })
+	db, _, cleanup, err := p.CreateDB(context.Background(), t.Logf, "twophase", `CREATE TABLE ledger (n int)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	insert := func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), `INSERT INTO ledger VALUES (1)`)
+		return err
+	}
+	pqxtest.PrepareTransaction(t, db, "a", insert)
+	pqxtest.PrepareTransaction(t, db, "b", insert)
+	if got := pqxtest.PreparedTransactions(t, db); strings.Join(got, ",") != "a,b" {
+		t.Fatalf("prepared = %q; want [a b]", got)
+	}
+	pqxtest.AssertRowCount(t, db, 0, `SELECT * FROM ledger`)
+
+	pqxtest.CommitPrepared(t, db, "a")
+	pqxtest.RollbackPrepared(t, db, "b")
+	pqxtest.AssertRowCount(t, db, 1, `SELECT * FROM ledger`)
+	if got := pqxtest.PreparedTransactions(t, db); len(got) != 0 {
+		t.Errorf("prepared = %q; want none", got)
+	}
+}
+
+func TestLogTimestamps(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) { p.LogTimestamps = true })
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var lines []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	db, _, cleanup, err := p.CreateDB(ctx, logf, "timestamps", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	db.Exec(`SELECT * FROM missing`) //nolint
+	p.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, line := range lines {
+		if !strings.Contains(line, "missing") {
+			continue
+		}
+		ts := strings.TrimSpace(line)
+		if len(ts) < len(pqx.LogTimeFormat) {
+			t.Fatalf("line too short for a timestamp: %q", line)
+		}
+		if _, err := time.Parse(pqx.LogTimeFormat, ts[:len(pqx.LogTimeFormat)]); err != nil {
+			t.Errorf("line not prefixed with a timestamp: %q: %v", line, err)
+		}
+		return
+	}
+	t.Errorf("no log line for the failed query in %q", lines)
+}
+
+func TestBinDir(t *testing.T) {
+	p := startPostgres(t, nil)
+	if _, err := os.Stat(filepath.Join(p.BinDir(), "pg_dump")); err != nil {
+		t.Error(err)
+	}
+	if got := p.ResolvedVersion(); got != pqx.DefaultVersion {
+		t.Errorf("ResolvedVersion = %q; want %q", got, pqx.DefaultVersion)
+	}
+}
+
+func TestPgCtl(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) { p.PgCtl = true })
+	ctx := context.Background()
+	db, _, cleanup, err := p.CreateDB(ctx, t.Logf, "pgctl", `CREATE TABLE foo (n int)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO foo VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if p.Pid() == 0 {
+		t.Error("Pid = 0")
+	}
+	if err := p.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(p.Dir, p.ResolvedVersion(), "data", "postmaster.pid")
+	if _, err := os.Stat(pidFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("postmaster.pid remains after Shutdown: %v", err)
+	}
+}
+
+func TestSocketDir(t *testing.T) {
+	dir := t.TempDir()
+	p := startPostgres(t, func(p *pqx.Postgres) { p.SocketDir = dir })
+	dsn := strings.Replace(p.DSN("postgres"), "host=localhost", "host="+dir, 1)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connecting over socket in %s: %v", dir, err)
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	t.Setenv("PQX_PORT_RANGE", "41000-41999")
+	p := startPostgres(t, nil)
+	var port int
+	for _, f := range strings.Fields(p.DSN("postgres")) {
+		if strings.HasPrefix(f, "port=") {
+			port, _ = strconv.Atoi(strings.TrimPrefix(f, "port="))
+		}
+	}
+	if port < 41000 || port > 41999 {
+		t.Errorf("port = %d; want one in PQX_PORT_RANGE", port)
+	}
+}
+
+func TestPortKey(t *testing.T) {
+	start := func() (*pqx.Postgres, string) {
+		t.Helper()
+		p := startPostgres(t, func(p *pqx.Postgres) { p.PortKey = "blake.io/pqx" })
+		_, port, err := net.SplitHostPort(p.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p, port
+	}
+
+	p1, port1 := start()
+	_, port2 := start()
+	if port2 == port1 {
+		t.Errorf("second instance got port %s of the running first", port1)
+	}
+	if err := p1.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, port3 := start(); port3 != port1 {
+		t.Errorf("port after restart = %s; want %s", port3, port1)
+	}
+}
+
+func TestAnnotateLogs(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) { p.AnnotateLogs = true })
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var msgs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, fmt.Sprintf(format, args...))
+	}
+	db, _, cleanup, err := p.CreateDB(ctx, logf, "annotate", `CREATE TABLE foo (id int PRIMARY KEY)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	db.Exec(`INSERT INTO foo VALUES (1), (1)`) //nolint
+	p.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, msg := range msgs {
+		if strings.Contains(msg, "23505") && strings.Contains(msg, "DETAIL:") && strings.Contains(msg, "STATEMENT:") {
+			return
+		}
+	}
+	t.Errorf("no single message with the SQLSTATE, DETAIL, and STATEMENT of the error in %q", msgs)
+}
+
+func TestPLpgSQLStack(t *testing.T) {
+	p := startPostgres(t, nil)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var msgs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, fmt.Sprintf(format, args...))
+	}
+	db, _, cleanup, err := p.CreateDB(ctx, logf, "stack", `
+		CREATE FUNCTION inner_fn() RETURNS void LANGUAGE plpgsql AS $$
+		BEGIN
+			RAISE EXCEPTION 'boom';
+		END $$;
+		CREATE FUNCTION outer_fn() RETURNS void LANGUAGE plpgsql AS $$
+		BEGIN
+			PERFORM inner_fn();
+		END $$;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	db.Exec(`SELECT outer_fn()`) //nolint
+	p.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, msg := range msgs {
+		if strings.Contains(msg, "function inner_fn()") && strings.Contains(msg, "function outer_fn()") {
+			return
+		}
+	}
+	t.Errorf("no single message with the PL/pgSQL stack in %q", msgs)
+}
+
+func TestConfig(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) {
+		p.Config = map[string]string{
+			"max_connections": "37",
+			"shared_buffers":  "16MB", // overrides pqx's 12MB
+			"work_mem":        "3MB",
+		}
+	})
+	db := sqlOpen(t, p.DSN("postgres"))
+	for name, want := range p.Config {
+		var got string
+		if err := db.QueryRow("SHOW " + name).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s = %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestCachedSchema(t *testing.T) {
+	p := startPostgres(t, nil)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		db, _, cleanup, err := p.CreateDB(ctx, t.Logf, fmt.Sprintf("cached_%d", i), `CREATE TABLE foo (n int)`, pqx.WithCachedSchema())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO foo VALUES (1)"); err != nil {
+			t.Error(err)
+		}
+		cleanup()
+	}
+	if s := p.SetupStats(); s.TemplateHits != 1 || s.TemplateMisses != 1 {
+		t.Errorf("got %+v; want 1 template hit and 1 miss", s)
+	}
+}
+
+func TestCreateDBOptions(t *testing.T) {
+	p := startPostgres(t, nil)
+	ctx := context.Background()
+	admin := sqlOpen(t, p.DSN("postgres"))
+	if _, err := admin.Exec("CREATE ROLE app"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, cleanup, err := p.CreateDB(ctx, t.Logf, "prodlike", "",
+		pqx.WithOwner("app"),
+		pqx.WithEncoding("LATIN1"),
+		pqx.WithLocale("C", "C"),
+		pqx.WithConnLimit(5),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	var owner, encoding, collate, ctype string
+	var limit int
+	err = admin.QueryRow(`
+		SELECT pg_get_userbyid(datdba), pg_encoding_to_char(encoding), datcollate, datctype, datconnlimit
+		FROM pg_database WHERE datname = 'prodlike'`).Scan(&owner, &encoding, &collate, &ctype, &limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprintf("%s %s %s %s %d", owner, encoding, collate, ctype, limit)
+	if want := "app LATIN1 C C 5"; got != want {
+		t.Errorf("database settings = %q; want %q", got, want)
+	}
+}
+
+// countingDriver is lib/pq's driver, counting the connections it opens.
+type countingDriver struct {
+	pq.Driver
+	opens int64
+}
+
+func (d *countingDriver) Open(dsn string) (driver.Conn, error) {
+	atomic.AddInt64(&d.opens, 1)
+	return d.Driver.Open(dsn)
+}
+
+var counting = &countingDriver{}
+
+func init() { sql.Register("pqx-counting", counting) }
+
+func TestDriverName(t *testing.T) {
+	p := startPostgres(t, func(p *pqx.Postgres) { p.DriverName = "pqx-counting" })
+	opens := atomic.LoadInt64(&counting.opens)
+	if opens == 0 {
+		t.Error("pqx's own connection did not use DriverName")
+	}
+	db, _, cleanup, err := p.CreateDB(context.Background(), t.Logf, "driver", `
+		CREATE TABLE a (n int);
+		CREATE TABLE b (n int);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if _, err := db.Exec("INSERT INTO b VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&counting.opens) == opens {
+		t.Error("returned *sql.DB did not use DriverName")
+	}
+}
+
+// nativePool stands in for a driver's native pool, such as a
+// pgxpool.Pool, whose Close returns nothing.
+type nativePool struct {
+	*sql.DB
+	closed bool
+}
+
+func (p *nativePool) Close() {
+	p.DB.Close()
+	p.closed = true
+}
+
+func TestCreatePool(t *testing.T) {
+	var pool *nativePool
+	t.Run("sub", func(t *testing.T) {
+		pool = pqxtest.CreatePool(t, `CREATE TABLE foo (n int)`, func(ctx context.Context, dsn string) (*nativePool, error) {
+			db, err := sql.Open("postgres", dsn)
+			return &nativePool{DB: db}, err
+		})
+		if _, err := pool.Exec("INSERT INTO foo VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !pool.closed {
+		t.Error("pool not closed when the test ended")
+	}
+}
+
+func TestSetupStats(t *testing.T) {
+	p := startPostgres(t, nil)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := p.Template(ctx, t.Logf, `CREATE TABLE foo (n int)`); err != nil {
+			t.Fatal(err)
+		}
+		_, _, cleanup, err := p.CreateDB(ctx, t.Logf, fmt.Sprintf("stats_%d", i), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+	}
+	s := p.SetupStats()
+	if s.InitdbCached || s.Start == 0 {
+		t.Errorf("got %+v; want a fresh initdb and a nonzero start time", s)
+	}
+	if s.Boot < s.Initdb+s.Start || s.Boot > s.Fetch+s.Prepare+s.Initdb+s.Start+time.Second {
+		t.Errorf("got %+v; want a boot time covering all phases", s)
+	}
+	if s.CreateDBs != 2 || s.TemplateHits != 1 || s.TemplateMisses != 1 {
+		t.Errorf("got %+v; want 2 CreateDBs, 1 template hit and 1 miss", s)
+	}
+	t.Log(s)
+}
+
+func TestMaxDiskUsage(t *testing.T) {
+	p := startPostgres(t, nil)
+	ctx := context.Background()
+	n, err := p.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("DiskUsage = 0")
+	}
+
+	p.MaxDiskUsage = n / 2
+	var due *pqx.DiskUsageError
+	if _, _, _, err := p.CreateDB(ctx, t.Logf, "over", ""); !errors.As(err, &due) {
+		t.Fatalf("CreateDB = %v; want a *DiskUsageError", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	primary := startPostgres(t, nil)
+	px, err := primary.NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer px.Close()
+	db, _, cleanup, err := primary.CreateDB(ctx, t.Logf, "failover", `CREATE TABLE foo (n int)`, pqx.WithProxy(px))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	r, err := primary.StartReplica(ctx, t.Logf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown() //nolint
+	if _, err := db.Exec(`INSERT INTO foo VALUES (1)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WaitForReplay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Failover(ctx, px); err != nil {
+		t.Fatal(err)
+	}
+	// The first use of a dropped connection may fail, as it would for
+	// an application; retry as one would.
+	for i := 0; ; i++ {
+		_, err := db.Exec(`INSERT INTO foo VALUES (2)`)
+		if err == nil {
+			break
+		}
+		if i == 2 {
+			t.Fatal(err)
+		}
+	}
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("promoted replica has %d rows; want 2", n)
+	}
+}
+
+func TestApplicationName(t *testing.T) {
+	db := pqxtest.CreateDB(t, "")
+	var name string
+	if err := db.QueryRow(`SELECT current_setting('application_name')`).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "testapplicationname" {
+		t.Errorf("application_name = %q; want %q", name, "testapplicationname")
+	}
+	if dsn := pqxtest.DSNForTest(t); !strings.Contains(dsn, "fallback_application_name=testapplicationname") {
+		t.Errorf("DSN %q lacks fallback_application_name", dsn)
+	}
+}
+
+func TestDSNOption(t *testing.T) {
+	db := pqxtest.CreateDB(t, "", pqx.WithDSNOption("options", "-c statement_timeout=1234"))
+	for _, q := range []*sql.DB{db, sqlOpen(t, pqxtest.DSNForTest(t))} {
+		var timeout string
+		if err := q.QueryRow(`SHOW statement_timeout`).Scan(&timeout); err != nil {
+			t.Fatal(err)
+		}
+		if timeout != "1234ms" {
+			t.Errorf("statement_timeout = %q; want 1234ms", timeout)
+		}
+	}
+}
+
+func sqlOpen(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestActivity(t *testing.T) {
+	db := pqxtest.CreateDB(t, "")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT 'leaked'`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range pqxtest.Activity(t, db) {
+		if strings.Contains(s.Query, "leaked") {
+			if s.State != "idle" || s.ApplicationName != "testactivity" {
+				t.Errorf("got %v; want an idle session of testactivity", s)
+			}
+			return
+		}
+	}
+	t.Error("leaked session not found")
+}
+
+func TestLogLevel(t *testing.T) {
+	start := func(level pqx.Level) []string {
+		t.Helper()
+		var (
+			mu    sync.Mutex
+			lines []string
+		)
+		logf := func(format string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}
+		p := &pqx.Postgres{Dir: t.TempDir(), LogLevel: level}
+		if err := p.Start(context.Background(), logf); err != nil {
+			t.Fatal(err)
+		}
+		p.Shutdown() //nolint
+		mu.Lock()
+		defer mu.Unlock()
+		return lines
+	}
+	initdbLogged := func(lines []string) bool {
+		for _, line := range lines {
+			if strings.HasPrefix(line, "[initdb] ") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if lines := start(pqx.LevelDebug); !initdbLogged(lines) {
+		t.Errorf("initdb output not logged at LevelDebug:\n%s", strings.Join(lines, "\n"))
+	}
+	lines := start(pqx.LevelInfo)
+	if initdbLogged(lines) {
+		t.Errorf("initdb output logged at LevelInfo:\n%s", strings.Join(lines, "\n"))
+	}
+	if len(lines) == 0 {
+		t.Error("postgres output not logged at LevelInfo")
+	}
+	if lines := start(pqx.LevelError); len(lines) > 0 {
+		t.Errorf("logged at LevelError:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestSuperuserMismatch(t *testing.T) {
+	dir := t.TempDir()
+	p := startPostgres(t, func(p *pqx.Postgres) {
+		p.Dir = dir
+		p.Superuser = "alice"
+	})
+	p.Shutdown() //nolint
+
+	p = &pqx.Postgres{Dir: dir, Superuser: "bob"}
+	err := p.Start(context.Background(), t.Logf)
+	if err == nil {
+		p.Shutdown() //nolint
+		t.Fatal("Start succeeded with another Superuser")
+	}
+	if !strings.Contains(err.Error(), "set Superuser") {
+		t.Errorf("Start = %v; want an explanation", err)
+	}
+}
+
+// TestChildLeavePrepared is run by TestCheckPrepared.
+func TestChildLeavePrepared(t *testing.T) {
+	if os.Getenv("TESTING_CHILD") == "" {
+		return
+	}
+	db := pqxtest.CreateDB(t, `CREATE TABLE ledger (n int)`)
+	pqxtest.PrepareTransaction(t, db, "forgotten", func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), `INSERT INTO ledger VALUES (1)`)
+		return err
+	})
+}
+
+func TestCheckPrepared(t *testing.T) {
+	if os.Getenv("TESTING_CHILD") != "" {
+		return
+	}
+	out, err := runChild(t, "TestChildLeavePrepared", "1", nil, "-pqxtest.checkprepared")
+	if err == nil {
+		t.Fatalf("with -pqxtest.checkprepared, a test leaving a prepared transaction passed:\n%s", out)
+	}
+	if !strings.Contains(out, "left prepared transactions: forgotten") {
+		t.Errorf("output does not name the prepared transaction:\n%s", out)
+	}
+}
+
+// TestChildLogs is run by TestQuiet and TestMetadata. It fails if
+// TESTING_CHILD is "fail".
+func TestChildLogs(t *testing.T) {
+	if os.Getenv("TESTING_CHILD") == "" {
+		return
+	}
+	db := pqxtest.CreateDB(t, "")
+	db.Exec(`SELECT * FROM quiet_missing`) //nolint
+	if os.Getenv("TESTING_CHILD") == "fail" {
+		t.Error("failing as asked")
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	const logged = `relation "quiet_missing" does not exist`
+	out, err := runChild(t, "TestChildLogs", "pass", nil, "-pqxtest.quiet")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if strings.Contains(out, logged) {
+		t.Errorf("logs of a passing test written with -pqxtest.quiet:\n%s", out)
+	}
+	out, err = runChild(t, "TestChildLogs", "fail", nil, "-pqxtest.quiet")
+	if err == nil {
+		t.Fatalf("failing test passed:\n%s", out)
+	}
+	if !strings.Contains(out, logged) {
+		t.Errorf("logs of a failing test not written with -pqxtest.quiet:\n%s", out)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metadata")
+	out, err := runChild(t, "TestChildLogs", "pass", []string{"PQX_METADATA=" + file})
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines of metadata; want 1:\n%s", len(lines), data)
+	}
+	var m struct {
+		Name       string `json:"name"`
+		DSN        string `json:"dsn"`
+		Test       string `json:"test"`
+		SchemaHash string `json:"schema_hash"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Test != "TestChildLogs" {
+		t.Errorf("test = %q; want TestChildLogs", m.Test)
+	}
+	if m.Name == "" || !strings.Contains(m.DSN, "dbname="+m.Name) {
+		t.Errorf("name = %q, dsn = %q; want the DSN of the named database", m.Name, m.DSN)
+	}
+	if m.SchemaHash == "" {
+		t.Error("schema_hash is empty")
+	}
+}
@@ -0,0 +1,355 @@
+// Package pqxgen fills tables with random, plausible rows, for quickly
+// getting a database with realistic volume for integration and performance
+// tests.
+//
+// Columns are generated according to their types, NOT NULL constraints,
+// and single-column foreign keys, primary keys, and unique constraints.
+// Columns with defaults, including identity, serial, and generated
+// columns, are left to their defaults. For example:
+//
+//	db := pqxtest.CreateDB(t, schema)
+//	if err := pqxgen.Fill(ctx, db, 1000, "users", "orders"); err != nil {
+//		t.Fatal(err)
+//	}
+package pqxgen
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Fill is like Generator.Fill with a randomly seeded Generator.
+func Fill(ctx context.Context, db *sql.DB, n int, tables ...string) error {
+	g := &Generator{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	return g.Fill(ctx, db, n, tables...)
+}
+
+// A Generator generates random rows.
+type Generator struct {
+	// Rand is the source of randomness. Using a Rand with a fixed seed,
+	// against the same schema, generates the same rows. It must be set.
+	Rand *rand.Rand
+
+	// NullFraction is the fraction of values of nullable columns that
+	// are NULL. If zero, nullable columns are never NULL.
+	NullFraction float64
+}
+
+// Fill inserts n random rows into each of tables, in an order such that
+// tables referenced by foreign keys are filled before tables referencing
+// them. Foreign key columns get values sampled from the referenced column,
+// which must have rows unless the column is nullable.
+func (g *Generator) Fill(ctx context.Context, db *sql.DB, n int, tables ...string) error {
+	var ts []*table
+	for _, name := range tables {
+		t, err := describe(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("pqxgen: %s: %w", name, err)
+		}
+		ts = append(ts, t)
+	}
+	ts, err := sortByDeps(ts)
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		if err := g.fill(ctx, db, t, n); err != nil {
+			return fmt.Errorf("pqxgen: %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+type table struct {
+	name string // as formatted by regclass
+	cols []*column
+}
+
+type column struct {
+	name    string
+	typ     string // pg_type.typname
+	enum    []string
+	maxLen  int // for varchar and char; zero if unlimited
+	notNull bool
+	unique  bool
+	refs    string // referenced table, as formatted by regclass
+	refCol  string
+}
+
+func describe(ctx context.Context, db *sql.DB, name string) (*table, error) {
+	t := &table{}
+	if err := db.QueryRowContext(ctx, "SELECT $1::regclass::text", name).Scan(&t.name); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.attname, t.typname, a.attnotnull,
+			CASE WHEN t.typname IN ('varchar', 'bpchar') AND a.atttypmod > 4 THEN a.atttypmod - 4 ELSE 0 END,
+			coalesce((SELECT array_agg(e.enumlabel ORDER BY e.enumsortorder)::text[] FROM pg_enum e WHERE e.enumtypid = t.oid), '{}'),
+			EXISTS (
+				SELECT 1 FROM pg_constraint c
+				WHERE c.conrelid = a.attrelid AND c.contype IN ('p', 'u') AND c.conkey = ARRAY[a.attnum]
+			),
+			coalesce((
+				SELECT format('%s.%s', c.confrelid::regclass, af.attname)
+				FROM pg_constraint c
+				JOIN pg_attribute af ON af.attrelid = c.confrelid AND af.attnum = c.confkey[1]
+				WHERE c.conrelid = a.attrelid AND c.contype = 'f' AND c.conkey = ARRAY[a.attnum]
+				LIMIT 1
+			), '')
+		FROM pg_attribute a
+		JOIN pg_type t ON t.oid = a.atttypid
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		  AND NOT a.atthasdef AND a.attidentity = '' AND a.attgenerated = ''
+		ORDER BY a.attnum`, t.name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &column{}
+		var ref string
+		if err := rows.Scan(&c.name, &c.typ, &c.notNull, &c.maxLen, pq.Array(&c.enum), &c.unique, &ref); err != nil {
+			return nil, err
+		}
+		if i := strings.LastIndex(ref, "."); i >= 0 {
+			c.refs, c.refCol = ref[:i], ref[i+1:]
+		}
+		t.cols = append(t.cols, c)
+	}
+	return t, rows.Err()
+}
+
+// sortByDeps orders ts so that tables referenced by foreign keys come before
+// those referencing them.
+func sortByDeps(ts []*table) ([]*table, error) {
+	byName := map[string]*table{}
+	for _, t := range ts {
+		byName[t.name] = t
+	}
+	var sorted []*table
+	state := map[string]int{} // 1: visiting, 2: done
+	var visit func(t *table) error
+	visit = func(t *table) error {
+		switch state[t.name] {
+		case 1:
+			return fmt.Errorf("pqxgen: foreign key cycle involving %s", t.name)
+		case 2:
+			return nil
+		}
+		state[t.name] = 1
+		for _, c := range t.cols {
+			if dep := byName[c.refs]; dep != nil && dep != t {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[t.name] = 2
+		sorted = append(sorted, t)
+		return nil
+	}
+	for _, t := range ts {
+		if err := visit(t); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// maxParams is kept below the 65535 parameters postgres allows per statement.
+const maxParams = 60000
+
+func (g *Generator) fill(ctx context.Context, db *sql.DB, t *table, n int) error {
+	if len(t.cols) == 0 {
+		for i := 0; i < n; i++ {
+			if _, err := db.ExecContext(ctx, "INSERT INTO "+t.name+" DEFAULT VALUES"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gens := make([]func() (any, error), len(t.cols))
+	names := make([]string, len(t.cols))
+	for i, c := range t.cols {
+		gen, err := g.generator(ctx, db, t, c)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", c.name, err)
+		}
+		gens[i] = gen
+		names[i] = quoteIdent(c.name)
+	}
+
+	perStmt := maxParams / len(t.cols)
+	for done := 0; done < n; {
+		rows := n - done
+		if rows > perStmt {
+			rows = perStmt
+		}
+		var q strings.Builder
+		fmt.Fprintf(&q, "INSERT INTO %s (%s) VALUES ", t.name, strings.Join(names, ", "))
+		args := make([]any, 0, rows*len(t.cols))
+		for r := 0; r < rows; r++ {
+			if r > 0 {
+				q.WriteString(", ")
+			}
+			q.WriteString("(")
+			for i, gen := range gens {
+				v, err := gen()
+				if err != nil {
+					return fmt.Errorf("column %s: %w", t.cols[i].name, err)
+				}
+				args = append(args, v)
+				if i > 0 {
+					q.WriteString(", ")
+				}
+				fmt.Fprintf(&q, "$%d", len(args))
+			}
+			q.WriteString(")")
+		}
+		if _, err := db.ExecContext(ctx, q.String(), args...); err != nil {
+			return err
+		}
+		done += rows
+	}
+	return nil
+}
+
+// generator returns a function generating values for c.
+func (g *Generator) generator(ctx context.Context, db *sql.DB, t *table, c *column) (func() (any, error), error) {
+	gen, err := g.valueGenerator(ctx, db, t, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.notNull || g.NullFraction <= 0 {
+		return gen, nil
+	}
+	return func() (any, error) {
+		if g.Rand.Float64() < g.NullFraction {
+			return nil, nil
+		}
+		return gen()
+	}, nil
+}
+
+func (g *Generator) valueGenerator(ctx context.Context, db *sql.DB, t *table, c *column) (func() (any, error), error) {
+	r := g.Rand
+	if c.refs != "" {
+		return g.sampler(ctx, db, c)
+	}
+	if len(c.enum) > 0 {
+		return func() (any, error) { return c.enum[r.Intn(len(c.enum))], nil }, nil
+	}
+	switch c.typ {
+	case "int2", "int4", "int8", "numeric":
+		if c.unique {
+			// Count up from the largest existing value to avoid
+			// collisions.
+			var next int64
+			q := fmt.Sprintf("SELECT coalesce(max(%s), 0)::int8 + 1 FROM %s", quoteIdent(c.name), t.name)
+			if err := db.QueryRowContext(ctx, q).Scan(&next); err != nil {
+				return nil, err
+			}
+			return func() (any, error) {
+				next++
+				return next - 1, nil
+			}, nil
+		}
+		max := int64(1 << 31)
+		if c.typ == "int2" {
+			max = 1 << 15
+		}
+		return func() (any, error) { return r.Int63n(max), nil }, nil
+	case "float4", "float8":
+		return func() (any, error) { return r.Float64() * 1000, nil }, nil
+	case "bool":
+		return func() (any, error) { return r.Intn(2) == 1, nil }, nil
+	case "text", "varchar", "bpchar", "citext":
+		seq := 0
+		return func() (any, error) {
+			s := words[r.Intn(len(words))] + " " + words[r.Intn(len(words))]
+			if c.unique {
+				seq++
+				s = fmt.Sprintf("%s %d%d", s, seq, r.Int63())
+			}
+			if c.maxLen > 0 && len(s) > c.maxLen {
+				s = s[len(s)-c.maxLen:]
+			}
+			return s, nil
+		}, nil
+	case "uuid":
+		return func() (any, error) {
+			var b [16]byte
+			r.Read(b[:]) //nolint
+			b[6] = b[6]&0x0f | 0x40
+			b[8] = b[8]&0x3f | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+		}, nil
+	case "timestamp", "timestamptz", "date":
+		end := time.Now()
+		start := end.AddDate(-5, 0, 0)
+		return func() (any, error) {
+			return start.Add(time.Duration(r.Int63n(int64(end.Sub(start))))), nil
+		}, nil
+	case "json", "jsonb":
+		return func() (any, error) {
+			return fmt.Sprintf(`{"n": %d, "s": %q}`, r.Intn(1000), words[r.Intn(len(words))]), nil
+		}, nil
+	case "bytea":
+		return func() (any, error) {
+			b := make([]byte, 8+r.Intn(24))
+			r.Read(b) //nolint
+			return b, nil
+		}, nil
+	}
+	if !c.notNull {
+		return func() (any, error) { return nil, nil }, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", c.typ)
+}
+
+// sampler returns a function returning values sampled from the column
+// referenced by c.
+func (g *Generator) sampler(ctx context.Context, db *sql.DB, c *column) (func() (any, error), error) {
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE %[1]s IS NOT NULL LIMIT 10000", quoteIdent(c.refCol), c.refs)
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var vals []any
+	for rows.Next() {
+		var v any
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		if c.notNull {
+			return nil, fmt.Errorf("referenced table %s has no rows", c.refs)
+		}
+		return func() (any, error) { return nil, nil }, nil
+	}
+	return func() (any, error) { return vals[g.Rand.Intn(len(vals))], nil }, nil
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+var words = strings.Fields(`
+	alpha bravo charlie delta echo foxtrot golf hotel india juliet kilo lima
+	mike november oscar papa quebec romeo sierra tango uniform victor whiskey
+	xray yankee zulu amber birch cedar dune ember fjord grove harbor island
+	jasper knoll lagoon meadow nectar orchard prairie quartz river summit
+	timber upland valley willow yarrow zephyr`)
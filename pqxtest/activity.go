@@ -0,0 +1,65 @@
+package pqxtest
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Session is a server process connected to a database, as reported by
+// pg_stat_activity.
+type Session struct {
+	Pid             int
+	ApplicationName string
+	State           string // e.g. "active", "idle", "idle in transaction"
+	Query           string // the current or, if idle, last query
+	WaitEventType   string // empty if not waiting
+	WaitEvent       string
+	BackendStart    time.Time
+	StateChange     time.Time
+}
+
+func (s Session) String() string {
+	wait := ""
+	if s.WaitEvent != "" {
+		wait = fmt.Sprintf(" waiting on %s:%s", s.WaitEventType, s.WaitEvent)
+	}
+	return fmt.Sprintf("pid %d (%s) %s%s: %s", s.Pid, s.ApplicationName, s.State, wait, strings.Join(strings.Fields(s.Query), " "))
+}
+
+// Activity returns the sessions connected to db's database, other than the
+// one used to query them, ordered by when they connected. It is useful for
+// including a snapshot of what was running in the failure of a test that
+// deadlocks or leaks connections:
+//
+//	for _, s := range pqxtest.Activity(t, db) {
+//		t.Log(s)
+//	}
+func Activity(t testing.TB, db *sql.DB) []Session {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT pid, application_name, coalesce(state, ''), coalesce(query, ''),
+			coalesce(wait_event_type, ''), coalesce(wait_event, ''),
+			backend_start, coalesce(state_change, backend_start)
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND pid <> pg_backend_pid()
+		ORDER BY backend_start`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ss []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.Pid, &s.ApplicationName, &s.State, &s.Query, &s.WaitEventType, &s.WaitEvent, &s.BackendStart, &s.StateChange); err != nil {
+			t.Fatal(err)
+		}
+		ss = append(ss, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
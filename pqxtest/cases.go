@@ -0,0 +1,45 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"testing"
+
+	"blake.io/pqx"
+)
+
+// RunCases runs f for each case in cases as a subtest of t named after its
+// key, in sorted order. Each subtest gets a fresh database, created by
+// CreateDB, with schema applied. The schema is applied only once, to a
+// template database that each case's database is cloned from, so cases do
+// not pay the cost of applying it.
+//
+// For example:
+//
+//	pqxtest.RunCases(t, schema, map[string]int{
+//		"zero": 0,
+//		"many": 100,
+//	}, func(t *testing.T, db *sql.DB, n int) {
+//		...
+//	})
+func RunCases[Case any](t *testing.T, schema string, cases map[string]Case, f func(t *testing.T, db *sql.DB, c Case)) {
+	t.Helper()
+	pg := shared(t)
+	tmpl, err := pg.Template(context.Background(), testLogf(t), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(cases))
+	for name := range cases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := cases[name]
+		t.Run(name, func(t *testing.T) {
+			db := CreateDB(t, "", pqx.WithTemplate(tmpl))
+			f(t, db, c)
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"blake.io/pqx"
+)
+
+// SetNow sets the time returned by now() in db, which must have been created
+// with pqx.WithFakeClock, failing t on error. If now is the zero time, now()
+// returns the real time again.
+func SetNow(t testing.TB, db *sql.DB, now time.Time) {
+	t.Helper()
+	if err := pqx.SetNow(context.Background(), db, now); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package pqxtest
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	covMu   sync.Mutex
+	covered = map[string]int{} // tests touching each object, by "kind name"
+)
+
+// objectUse returns a count of the uses of each table and function in db's
+// database, keyed by kind and schema-qualified name, as counted by the
+// statistics collector. Functions are only counted if track_functions is
+// set for the sessions calling them.
+func objectUse(db *sql.DB) (map[string]int64, error) {
+	rows, err := db.Query(`
+		SELECT 'table ' || format('%I.%I', schemaname, relname),
+			seq_scan + coalesce(idx_scan, 0) + n_tup_ins + n_tup_upd + n_tup_del
+		FROM pg_stat_user_tables
+		UNION ALL
+		SELECT 'function ' || p.oid::regprocedure, coalesce(s.calls, 0)
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		LEFT JOIN pg_stat_user_functions s ON s.funcid = p.oid
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema', 'pqx')
+		  AND n.nspname NOT LIKE 'pg_toast%'
+		  AND NOT EXISTS (
+			SELECT FROM pg_depend d
+			WHERE d.classid = 'pg_proc'::regclass AND d.objid = p.oid AND d.deptype = 'e'
+		  )`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var n int64
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		m[name] = n
+	}
+	return m, rows.Err()
+}
+
+// recordCoverage records the objects in the database at dsn that were used
+// since before was taken. Like reportTableAccess, it closes db first so the
+// statistics collector counts the uses by its sessions.
+func recordCoverage(t testing.TB, db *sql.DB, dsn string, before map[string]int64) {
+	t.Helper()
+	db.Close()
+	sdb, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Errorf("pqxtest: recording coverage: %v", err)
+		return
+	}
+	defer sdb.Close()
+	after, err := objectUse(sdb)
+	if err != nil {
+		t.Errorf("pqxtest: recording coverage: %v", err)
+		return
+	}
+	covMu.Lock()
+	defer covMu.Unlock()
+	for name, n := range after {
+		if _, ok := covered[name]; !ok {
+			covered[name] = 0
+		}
+		if n > before[name] {
+			covered[name]++
+		}
+	}
+}
+
+// writeCoverage writes a report of the objects recorded by recordCoverage
+// to the file name: for each, the number of tests that used it, with the
+// objects no test used first.
+func writeCoverage(name string) error {
+	covMu.Lock()
+	defer covMu.Unlock()
+	names := make([]string, 0, len(covered))
+	used := 0
+	for n, tests := range covered {
+		names = append(names, n)
+		if tests > 0 {
+			used++
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := covered[names[i]] > 0, covered[names[j]] > 0
+		if a != b {
+			return !a
+		}
+		return names[i] < names[j]
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "pqxtest: SQL coverage: %d of %d objects used by tests\n", used, len(names))
+	for _, n := range names {
+		if tests := covered[n]; tests == 0 {
+			fmt.Fprintf(&b, "%s: never used\n", n)
+		} else {
+			fmt.Fprintf(&b, "%s: used by %d tests\n", n, tests)
+		}
+	}
+	return os.WriteFile(name, []byte(b.String()), 0644)
+}
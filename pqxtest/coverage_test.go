@@ -0,0 +1,35 @@
+package pqxtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kr.dev/diff"
+)
+
+func TestWriteCoverage(t *testing.T) {
+	covMu.Lock()
+	covered = map[string]int{
+		"table public.a":          2,
+		"table public.b":          0,
+		"function public.f(text)": 1,
+	}
+	covMu.Unlock()
+	t.Cleanup(func() { covered = map[string]int{} })
+
+	name := filepath.Join(t.TempDir(), "coverage.txt")
+	if err := writeCoverage(name); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `pqxtest: SQL coverage: 2 of 3 objects used by tests
+table public.b: never used
+function public.f(text): used by 1 tests
+table public.a: used by 2 tests
+`
+	diff.Test(t, t.Errorf, string(got), want)
+}
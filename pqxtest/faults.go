@@ -0,0 +1,77 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"blake.io/pqx"
+	"blake.io/pqx/proxy"
+)
+
+// KillConnections terminates all server-side connections to db's database,
+// as if the server had dropped them, and returns the number terminated.
+// Subsequent queries on db will see connection errors until database/sql
+// discards the dead connections, which makes it useful for exercising
+// retry and reconnect logic.
+func KillConnections(t testing.TB, db *sql.DB) int {
+	t.Helper()
+	var name string
+	if err := db.QueryRow("SELECT current_database()").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	n, err := sharedPG.KillConnections(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// KillIdleConnections terminates the server-side connections to db's
+// database that have been idle for longer than age, such as those held by a
+// lazily created global pool in the code under test, and returns the number
+// terminated. To do so automatically before the database is dropped, pass
+// pqx.WithKillIdle to CreateDB.
+func KillIdleConnections(t testing.TB, db *sql.DB, age time.Duration) int {
+	t.Helper()
+	var name string
+	if err := db.QueryRow("SELECT current_database()").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	n, err := sharedPG.KillIdleConnections(context.Background(), name, age)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// CreateProxiedDB is like CreateDB, but the returned database, and its DSN
+// reported by DSNForTest, connect to postgres through a proxy that can be
+// used to inject latency, stalls, and dropped connections. The proxy is
+// closed when the test ends.
+func CreateProxiedDB(t testing.TB, schema string, opts ...pqx.DBOption) (*sql.DB, *proxy.Proxy) {
+	t.Helper()
+	pg := shared(t)
+	px, err := pg.NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	db := CreateDB(t, schema, append(opts, pqx.WithProxy(px))...)
+	return db, px
+}
+
+// AssertSpills fails the test unless running query on db spills to
+// temporary files on disk (want is true) or does not spill (want is false).
+// The query is rolled back after running. See pqx.TempBlocksWritten.
+func AssertSpills(t testing.TB, db *sql.DB, want bool, query string, args ...any) {
+	t.Helper()
+	n, err := pqx.TempBlocksWritten(context.Background(), db, query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n > 0; got != want {
+		t.Errorf("query spilled = %v (%d temp blocks written); want %v\n%s", got, n, want, query)
+	}
+}
@@ -0,0 +1,26 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// CreateFDWPair creates two databases, remote with remoteSchema and local
+// with localSchema, and connects local to remote with postgres_fdw such
+// that remote's public tables are available in local as remote.<table>.
+// See pqx.Postgres.ConnectFDW.
+func CreateFDWPair(t testing.TB, localSchema, remoteSchema string) (local, remote *sql.DB) {
+	t.Helper()
+	remote = CreateDB(t, remoteSchema)
+	local = CreateDB(t, localSchema)
+
+	var remoteName string
+	if err := remote.QueryRow("SELECT current_database()").Scan(&remoteName); err != nil {
+		t.Fatal(err)
+	}
+	if err := sharedPG.ConnectFDW(context.Background(), local, "remote", remoteName); err != nil {
+		t.Fatal(err)
+	}
+	return local, remote
+}
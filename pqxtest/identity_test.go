@@ -0,0 +1,9 @@
+package pqxtest
+
+import "testing"
+
+func TestPackageIdentity(t *testing.T) {
+	if got, want := packageIdentity(), "blake.io/pqx/pqxtest"; got != want {
+		t.Errorf("packageIdentity() = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,221 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"blake.io/pqx"
+	"github.com/lib/pq"
+)
+
+// jobQueueSchema creates the table and notification trigger used by a
+// JobQueue.
+const jobQueueSchema = `
+CREATE TABLE pqxtest_jobs (
+	id       bigserial PRIMARY KEY,
+	payload  text NOT NULL,
+	done     boolean NOT NULL DEFAULT false,
+	error    text,
+	attempts int NOT NULL DEFAULT 0
+);
+CREATE FUNCTION pqxtest_jobs_notify() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+	PERFORM pg_notify('pqxtest_jobs', NEW.id::text);
+	RETURN NEW;
+END $$;
+CREATE TRIGGER pqxtest_jobs_notify AFTER INSERT ON pqxtest_jobs
+	FOR EACH ROW EXECUTE FUNCTION pqxtest_jobs_notify();
+`
+
+// A JobQueue is a harness for testing queue workers built on LISTEN/NOTIFY
+// and SELECT ... FOR UPDATE SKIP LOCKED. Jobs are rows of the table
+// pqxtest_jobs, and inserting one notifies the channel pqxtest_jobs with
+// its id.
+type JobQueue struct {
+	DB *sql.DB // the database holding the queue
+
+	dsn string
+}
+
+// A Job is a job in a JobQueue.
+type Job struct {
+	ID       int64
+	Payload  string
+	Done     bool   // handled without error
+	Error    string // the error returned by the handler, if any
+	Attempts int
+}
+
+// CreateJobQueue creates a database, as CreateDB does, with schema, or the
+// package schema if it is empty, and the queue's table applied, and returns
+// a JobQueue for it.
+func CreateJobQueue(t testing.TB, schema string, opts ...pqx.DBOption) *JobQueue {
+	t.Helper()
+	if schema == "" {
+		schema = packageSchema
+	}
+	db := CreateDB(t, schema+";\n"+jobQueueSchema, opts...)
+	infos := Databases(t)
+	return &JobQueue{DB: db, dsn: infos[len(infos)-1].DSN}
+}
+
+// Enqueue adds a job with payload to q and returns its id.
+func (q *JobQueue) Enqueue(t testing.TB, payload string) int64 {
+	t.Helper()
+	var id int64
+	if err := q.DB.QueryRow(`INSERT INTO pqxtest_jobs (payload) VALUES ($1) RETURNING id`, payload).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// Work runs n workers that claim pending jobs, one at a time, using SELECT
+// ... FOR UPDATE SKIP LOCKED, and call handle with each in the transaction
+// that claimed it. A job is done if handle returns nil, and failed, and not
+// retried, otherwise. Idle workers wait for a notification of a new job,
+// or poll for jobs whose notifications they missed.
+//
+// Work returns when no jobs are pending, and fails t if that has not
+// happened within timeout; ctx passed to handle is canceled then.
+func (q *JobQueue) Work(t testing.TB, n int, timeout time.Duration, handle func(ctx context.Context, tx *sql.Tx, job Job) error) {
+	t.Helper()
+	l := pq.NewListener(q.dsn, 10*time.Millisecond, time.Second, nil)
+	defer l.Close()
+	if err := l.Listen("pqxtest_jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				claimed, err := q.workOne(ctx, handle)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					errc <- err
+					return
+				}
+				if claimed {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-l.Notify:
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		}()
+	}
+
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-errc:
+			cancel()
+			wg.Wait()
+			t.Fatal(err)
+		case <-ctx.Done():
+			wg.Wait()
+			t.Fatalf("pqxtest: %d jobs still pending after %v", q.pending(t), timeout)
+		case <-tick.C:
+			if q.pending(t) == 0 {
+				cancel()
+				wg.Wait()
+				return
+			}
+		}
+	}
+}
+
+// workOne claims a pending job and handles it, and reports whether there
+// was one.
+func (q *JobQueue) workOne(ctx context.Context, handle func(context.Context, *sql.Tx, Job) error) (bool, error) {
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() //nolint
+
+	var job Job
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, payload, attempts FROM pqxtest_jobs
+		WHERE NOT done AND error IS NULL
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`).Scan(&job.ID, &job.Payload, &job.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	job.Attempts++
+
+	if herr := handle(ctx, tx, job); herr != nil {
+		// Record the failure outside of the transaction handle may
+		// have aborted.
+		tx.Rollback() //nolint
+		_, err := q.DB.ExecContext(ctx, `UPDATE pqxtest_jobs SET error = $2, attempts = attempts + 1 WHERE id = $1`, job.ID, herr.Error())
+		return true, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE pqxtest_jobs SET done = true, attempts = attempts + 1 WHERE id = $1`, job.ID); err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
+
+func (q *JobQueue) pending(t testing.TB) int {
+	t.Helper()
+	var n int
+	if err := q.DB.QueryRow(`SELECT count(*) FROM pqxtest_jobs WHERE NOT done AND error IS NULL`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Jobs returns all jobs in q, in the order they were enqueued.
+func (q *JobQueue) Jobs(t testing.TB) []Job {
+	t.Helper()
+	rows, err := q.DB.Query(`SELECT id, payload, done, coalesce(error, ''), attempts FROM pqxtest_jobs ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		var j Job
+		if err := rows.Scan(&j.ID, &j.Payload, &j.Done, &j.Error, &j.Attempts); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+// AssertProcessed fails t unless every job in q was handled exactly once
+// without error.
+func (q *JobQueue) AssertProcessed(t testing.TB) {
+	t.Helper()
+	for _, j := range q.Jobs(t) {
+		if !j.Done || j.Attempts != 1 {
+			t.Errorf("pqxtest: job %d (%q): done=%v attempts=%d error=%q; want done once", j.ID, j.Payload, j.Done, j.Attempts, j.Error)
+		}
+	}
+}
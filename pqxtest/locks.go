@@ -0,0 +1,60 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+)
+
+// HoldAdvisoryLock acquires the session-level advisory lock for key on its
+// own connection to db, blocking until the lock is acquired. The lock is
+// held until the returned release function is called or the test ends,
+// whichever comes first.
+//
+// It is useful for testing how code that uses pg_advisory_lock, such as
+// leader election or migration guards, behaves under contention.
+func HoldAdvisoryLock(t testing.TB, db *sql.DB, key int64) (release func()) {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			defer conn.Close()
+			if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key); err != nil {
+				t.Errorf("pqxtest: releasing advisory lock %d: %v", key, err)
+			}
+		})
+	}
+	t.Cleanup(release)
+	return release
+}
+
+// AdvisoryLockHeld reports whether any session currently holds the
+// session-level advisory lock for key in db's database.
+func AdvisoryLockHeld(t testing.TB, db *sql.DB, key int64) bool {
+	t.Helper()
+	const q = `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_locks
+			WHERE locktype = 'advisory'
+			  AND granted
+			  AND objsubid = 1
+			  AND database = (SELECT oid FROM pg_database WHERE datname = current_database())
+			  AND (classid::bigint << 32 | objid::bigint) = $1
+		)`
+	var held bool
+	if err := db.QueryRow(q, key).Scan(&held); err != nil {
+		t.Fatal(err)
+	}
+	return held
+}
@@ -0,0 +1,69 @@
+package pqxtest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// dbMetadata describes a database created by CreateDB, for tools reading
+// PQX_METADATA.
+type dbMetadata struct {
+	Name       string `json:"name"`
+	DSN        string `json:"dsn"`
+	Test       string `json:"test"`
+	SchemaHash string `json:"schema_hash"`
+}
+
+var (
+	metaOnce sync.Once
+	metaMu   sync.Mutex
+	metaOut  io.Writer // nil if PQX_METADATA is unset
+)
+
+// writeMetadata writes m as a line of JSON to the file or file descriptor
+// named by PQX_METADATA, if set.
+func writeMetadata(m dbMetadata) {
+	metaOnce.Do(func() {
+		v := os.Getenv("PQX_METADATA")
+		if v == "" {
+			return
+		}
+		if fd, err := strconv.Atoi(v); err == nil {
+			metaOut = os.NewFile(uintptr(fd), "PQX_METADATA")
+			return
+		}
+		f, err := os.OpenFile(v, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Printf("pqxtest: PQX_METADATA: %v", err)
+			return
+		}
+		metaOut = f
+	})
+	if metaOut == nil {
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("pqxtest: PQX_METADATA: %v", err)
+		return
+	}
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	// Written with a single call so lines from concurrent test
+	// processes appending to the same file do not interleave.
+	if _, err := metaOut.Write(append(data, '\n')); err != nil {
+		log.Printf("pqxtest: PQX_METADATA: %v", err)
+	}
+}
+
+// schemaHash returns a short hash identifying schema.
+func schemaHash(schema string) string {
+	sum := sha256.Sum256([]byte(schema))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,33 @@
+package pqxtest
+
+import (
+	"context"
+	"testing"
+
+	"blake.io/pqx"
+)
+
+// CreatePool is like CreateDB, but returns a connection pool for the
+// database opened by open with its DSN, for drivers with a native API that
+// is not database/sql, such as pgxpool:
+//
+//	pool := pqxtest.CreatePool(t, schema, pgxpool.New)
+//
+// The pool is closed before the database is dropped.
+func CreatePool[P interface{ Close() }](t testing.TB, schema string, open func(ctx context.Context, dsn string) (P, error), opts ...pqx.DBOption) P {
+	t.Helper()
+	CreateDB(t, schema, opts...)
+	dmu.Lock()
+	infos := dbs[t.Name()]
+	dsn := infos[len(infos)-1].DSN
+	dmu.Unlock()
+
+	pool, err := open(context.Background(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered after CreateDB's cleanup, so it runs before the
+	// database is dropped.
+	t.Cleanup(pool.Close)
+	return pool
+}
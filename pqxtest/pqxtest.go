@@ -49,6 +49,9 @@
 // also means you can't use those nifty driver specific functions you love.
 // Pqxtest returns a real *sql.DB.
 //
+// For tests that only read and write rows, where the speed is worth those
+// caveats, CreateTxDB opts into a transaction on a shared database.
+//
 // # Speed
 //
 // Pqx is fast. It is designed to give you all the benefits of writing tests
@@ -96,6 +99,10 @@
 //	    logplex.go:123: STATEMENT:  SELECT * FROM bar
 //	    example_test.go:65: pq: relation "bar" does not exist
 //
+// Logs are routed as postgres writes each line, not when the test ends, so
+// with "go test -v" they stream in while a long-running test is still in
+// progress.
+//
 // Tip: Try running these tests with "go test -v -pqxtest.d=2" to see more detailed logs in the
 // tests, or set it to 3 and see even more verbose logs.
 //
@@ -115,12 +122,78 @@
 // The following environment variables are recognized:
 //
 //	PQX_PG_VERSION: Specifies the version of postgres to use. The default is pqx.DefaultVersion.
+//	PQX_PG_PORT: Specifies the port postgres listens on. The default is a random free port.
+//	PQX_PORT_RANGE: Specifies a range of ports, like 20000-29999, to choose free
+//	  ports from when PQX_PG_PORT is unset; see pqx.Postgres.Port.
+//	PQX_CACHE_DIR: Specifies the directory postgres binaries are cached in. The
+//	  default is pqx in $XDG_CACHE_HOME, or in $HOME/.cache if that is unset.
+//	PQX_EXTERNAL_DSN: Specifies the DSN of an already-running postgres, such as
+//	  a CI service, to create and drop databases on instead of starting one;
+//	  see pqx.Postgres.External. Its logs are not routed to tests.
+//	PQX_METADATA: Names a file, or, if a number, an open file descriptor, to
+//	  which CreateDB appends a line of JSON describing each database it creates,
+//	  with its "name", "dsn", "test" name, and "schema_hash", for tools that map
+//	  test failures to databases.
 //
 // # Flags
 //
-// pqxtest recognizes the following flag:
+// pqxtest recognizes the following flags:
 //
+//	-pqxtest.checkprepared: Fails tests that leave prepared transactions
+//	  behind in their databases, and rolls those transactions back so the
+//	  databases can be dropped.
+//	-pqxtest.coverage=<file>: Experimental. Writes a report to file, after
+//	  the tests run, of the tables and functions in test databases and the
+//	  number of tests that used each, listing those no test used first.
 //	-pqxtest.d=<level>: Sets the debug level for the Postgres instance. See Logs for more details.
+//	-pqxtest.driver=<name>: Opens the *sql.DB returned by CreateDB with the
+//	  database/sql driver registered as name, such as "pgx", which the test
+//	  binary must import; see pqx.Postgres.DriverName.
+//	-pqxtest.http=<addr>: Serves /healthz and /dsn on addr, such as
+//	  localhost:8432, for scripts and editors waiting for the instance to be
+//	  ready; see pqx.Postgres.Handler.
+//	-pqxtest.lazy: Starts the Postgres instance when the first database is
+//	  created instead of before running tests; see StartLazy.
+//	-pqxtest.port=<port>: Overrides PQX_PG_PORT.
+//	-pqxtest.pool=<n>: Creates n databases at start that CreateDB checks out,
+//	  instead of creating a database, when called with an empty schema and no
+//	  options. They are reset, rather than dropped, after each test; see
+//	  pqx.Pool.
+//	-pqxtest.profile: Prints a summary of the time spent setting up postgres
+//	  and databases after the tests run, like "fetch 0ms (cached), initdb 0ms
+//	  (cached), start 612ms, boot 640ms, 143 CreateDB avg 38ms, 9 template
+//	  hits"; see
+//	  pqx.SetupStats.
+//	-pqxtest.quiet: Buffers the logs of each test's databases and writes them
+//	  to the test's log only if it fails, keeping the output of passing
+//	  tests clean.
+//	-pqxtest.recycle: Resets databases after each test and reuses them for
+//	  later tests with the same schema, instead of dropping them; see
+//	  pqx.WithRecycle.
+//	-pqxtest.restart: Restarts the Postgres instance if CreateDB finds it has
+//	  died, such as from being killed by the OOM killer, instead of failing
+//	  the remaining tests with the error and last logs of its death; see
+//	  pqx.Postgres.Restart.
+//	-pqxtest.stablenames: Names each database after its test, without a random
+//	  suffix, replacing any database of that name left by a previous run and
+//	  keeping it after the test for inspection by external tools. Databases
+//	  of tests that are renamed or removed are never replaced, so they
+//	  remain until dropped by hand, or with the data directory.
+//	-pqxtest.stableport: Derives the port, unless set by -pqxtest.port, from
+//	  the module path and the package's directory in it, so it is the same
+//	  on every run and in every checkout, keeping saved DSNs and IDE data
+//	  sources valid; see pqx.Postgres.PortKey.
+//	-pqxtest.tablereport: Logs, at the end of each test, the tables of its
+//	  databases that it read and wrote, to find tests that touch more state
+//	  than expected or that could share a template.
+//	-pqxtest.templates: Applies each schema passed to CreateDB once, in a
+//	  template database, and clones databases for it from the template, as
+//	  is done for the package schema; see pqx.WithCachedSchema.
+//	-pqxtest.timestamps: Prefixes postgres logs with the time they were
+//	  logged, and logs timestamped markers when each test's database is
+//	  created and cleaned up, to show when statements ran relative to test
+//	  steps; see pqx.Postgres.LogTimestamps.
+//	-pqxtest.version=<version>: Overrides PQX_PG_VERSION.
 //
 // Flags may be specified with go test like:
 //
@@ -128,53 +201,131 @@
 package pqxtest
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 	"unicode"
 
 	"blake.io/pqx"
-	"blake.io/pqx/internal/logplex"
 )
 
 // Flags
 var (
-	flagDebugLevel = flag.Int("pqxtest.d", 0, "postgres debug level (see `postgres -d`)")
+	flagCheckPrepared = flag.Bool("pqxtest.checkprepared", false, "fail tests that leave prepared transactions behind")
+	flagCoverage      = flag.String("pqxtest.coverage", "", "write a report of the tables and functions used by tests to `file` (experimental)")
+	flagDriver        = flag.String("pqxtest.driver", "", "database/sql driver `name` for the *sql.DB returned by CreateDB")
+	flagHTTP          = flag.String("pqxtest.http", "", "serve the instance's readiness and DSN over HTTP on `addr`")
+	flagDebugLevel    = flag.Int("pqxtest.d", 0, "postgres debug level (see `postgres -d`)")
+	flagLazy          = flag.Bool("pqxtest.lazy", false, "start postgres on the first call to CreateDB instead of before running tests")
+	flagPort          = flag.Int("pqxtest.port", envInt("PQX_PG_PORT"), "port postgres listens on (overrides PQX_PG_PORT)")
+	flagVersion       = flag.String("pqxtest.version", os.Getenv("PQX_PG_VERSION"), "postgres version (overrides PQX_PG_VERSION)")
+	flagPool          = flag.Int("pqxtest.pool", 0, "number of databases to create at start for reuse by CreateDB")
+	flagProfile       = flag.Bool("pqxtest.profile", false, "print the time spent setting up postgres and databases after running tests")
+	flagQuiet         = flag.Bool("pqxtest.quiet", false, "log databases' logs only for tests that fail")
+	flagRestart       = flag.Bool("pqxtest.restart", false, "restart postgres if it dies during the run")
+	flagRecycle       = flag.Bool("pqxtest.recycle", false, "reset and reuse databases across tests with the same schema instead of dropping them")
+	flagTemplates     = flag.Bool("pqxtest.templates", false, "clone databases from a template per schema instead of applying the schema for each")
+	flagTableReport   = flag.Bool("pqxtest.tablereport", false, "log the tables each test read and wrote")
+	flagTimestamps    = flag.Bool("pqxtest.timestamps", false, "prefix logs with timestamps and mark when databases are created and cleaned up")
+	flagStablePort    = flag.Bool("pqxtest.stableport", false, "derive the port from the package's import path so it is the same on every run")
+	flagStableNames   = flag.Bool("pqxtest.stablenames", false, "name databases after their tests only, replacing and keeping them across runs")
 )
 
 var (
-	sharedPG *pqx.Postgres
+	sharedPG  *pqx.Postgres
+	lazyStart func() // set by StartLazy
+	configs   []func(*pqx.Postgres)
 
-	dmu  sync.Mutex
-	dsns = map[testing.TB][]string{}
+	dmu     sync.Mutex
+	dbs     = map[string][]DBInfo{} // keyed by test name
+	notices = map[testing.TB][]pqx.Notice{}
 )
 
 // DSN returns the main dsn for the running postgres instance. It must only be
 // call after a call to Start.
 func DSN() string {
+	if lazyStart != nil {
+		lazyStart()
+	}
 	return sharedPG.DSN("postgres")
 }
 
-// DSNForTest returns the dsn for the first test database created using t. It
-// must only be called after a call to CreateDB.
+// shared returns the shared Postgres instance, starting it first if its
+// start was deferred by StartLazy. It fails t if there is no instance.
+func shared(t testing.TB) *pqx.Postgres {
+	t.Helper()
+	if lazyStart != nil {
+		lazyStart()
+	}
+	if sharedPG == nil {
+		t.Fatal("pqxtest.TestMain not called")
+	}
+	return sharedPG
+}
+
+// DSNForTest returns the dsn for the first test database created using t
+// or, if t created none, by its nearest parent test that did. It fails the
+// test if there is no such database; databases created by subtests are not
+// visible to their parents.
 func DSNForTest(t testing.TB) string {
+	t.Helper()
+	infos := Databases(t)
+	if len(infos) == 0 {
+		t.Fatalf("pqxtest: no database created by %s or its parent tests", t.Name())
+	}
+	return infos[0].DSN
+}
+
+// DBInfo describes a database created by CreateDB.
+type DBInfo struct {
+	Name string // the database name
+	DSN  string // the dsn for connecting to the database
+}
+
+// Databases returns the databases created using t, in the order they were
+// created, followed by those created by each of its parent tests, nearest
+// first. This allows helpers shared by a test and its subtests to find the
+// databases created by the parent.
+func Databases(t testing.TB) []DBInfo {
 	dmu.Lock()
 	defer dmu.Unlock()
-	return dsns[t][0]
+	var infos []DBInfo
+	name := t.Name()
+	for {
+		infos = append(infos, dbs[name]...)
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return infos
+		}
+		name = name[:i]
+	}
+}
+
+// DSNs returns the dsns of all databases returned by Databases.
+func DSNs(t testing.TB) []string {
+	var dsns []string
+	for _, d := range Databases(t) {
+		dsns = append(dsns, d.DSN)
+	}
+	return dsns
 }
 
 // TestMain is a convenience function for running tests with a live Postgres
@@ -184,16 +335,41 @@ func DSNForTest(t testing.TB) string {
 // Users that need do more in their TestMain, can use it as a reference.
 func TestMain(m *testing.M) {
 	flag.Parse()
-	Start(5*time.Second, *flagDebugLevel)
+	if *flagLazy {
+		StartLazy(5*time.Second, *flagDebugLevel)
+	} else {
+		Start(5*time.Second, *flagDebugLevel)
+	}
 	defer Shutdown() //nolint
 	code := m.Run()
+	if *flagProfile && sharedPG != nil {
+		fmt.Fprintf(os.Stderr, "pqxtest: setup: %v\n", sharedPG.SetupStats())
+	}
+	if *flagCoverage != "" {
+		if err := writeCoverage(*flagCoverage); err != nil {
+			log.Printf("pqxtest: writing coverage: %v", err)
+		}
+	}
 	Shutdown()
 	os.Exit(code)
 }
 
+// Configure registers f to be called with the shared Postgres instance
+// before Start starts it, allowing a package to set options such as
+// Logical. It must be called before TestMain or Start, for example:
+//
+//	func TestMain(m *testing.M) {
+//		pqxtest.Configure(func(p *pqx.Postgres) { p.Logical = true })
+//		pqxtest.TestMain(m)
+//	}
+func Configure(f func(p *pqx.Postgres)) {
+	configs = append(configs, f)
+}
+
 // Start starts a Postgres instance. The version used is determined by the
-// PQX_PG_VERSION environment variable if set, otherwise pqx.DefaultVersion is
-// used.
+// -pqxtest.version flag or PQX_PG_VERSION environment variable if set,
+// otherwise pqx.DefaultVersion is used. Likewise, the port is determined
+// by -pqxtest.port or PQX_PG_PORT, otherwise a random free port is used.
 //
 // The Postgres instance is started in a temporary directory named after the
 // current working directory and reused across runs.
@@ -201,23 +377,93 @@ func Start(timeout time.Duration, debugLevel int) {
 	maybeBecomeSupervisor()
 
 	sharedPG = &pqx.Postgres{
-		Version:    os.Getenv("PQX_PG_VERSION"),
-		Dir:        getSharedDir(),
-		DebugLevel: debugLevel,
+		Version:       *flagVersion,
+		Port:          *flagPort,
+		Dir:           getSharedDir(),
+		DebugLevel:    debugLevel,
+		LogTimestamps: *flagTimestamps,
+		External:      os.Getenv("PQX_EXTERNAL_DSN"),
+		Restart:       *flagRestart,
+		DriverName:    *flagDriver,
+		PoolSize:      *flagPool,
+		PoolSchema:    packageSchema,
+	}
+	if *flagStablePort && sharedPG.Port == 0 {
+		sharedPG.PortKey = packageIdentity()
+	}
+	for _, f := range configs {
+		f(sharedPG)
+	}
+	if *flagHTTP != "" {
+		// Served before starting, so clients may wait for readiness.
+		ln, err := net.Listen("tcp", *flagHTTP)
+		if err != nil {
+			log.Fatalf("error serving HTTP: %v", err)
+		}
+		go http.Serve(ln, sharedPG.Handler()) //nolint
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	startLog := new(lockedBuffer)
-	if err := sharedPG.Start(ctx, logplex.LogfFromWriter(startLog)); err != nil {
-		if _, err := startLog.WriteTo(os.Stderr); err != nil {
-			log.Fatalf("error writing start log: %v", err)
-		}
+	// Errors from Start include the tail of the initdb and postgres
+	// output, so there is no need to keep the logs, but pqx's own
+	// messages, such as that it is waiting for another test process
+	// using the same directory, explain a slow start.
+	if err := sharedPG.Start(ctx, pqxMessages); err != nil {
 		log.Fatalf("error starting Postgres: %v", err)
 	}
 
-	shutThisDownAfterMyDeath(sharedPG.Pid())
+	if sharedPG.External == "" {
+		shutThisDownAfterMyDeath(sharedPG.PidFile())
+		shutdownOnSignal()
+	}
+
+	if packageSchema != "" && *flagPool == 0 {
+		// Create the package schema's template while tests start;
+		// CreateDB waits for it, and reports any error. With a pool,
+		// Start created it.
+		go sharedPG.Template(context.Background(), nil, packageSchema) //nolint
+	}
+}
+
+// pqxMessages logs the messages of pqx itself, and not those of postgres,
+// passed to it.
+func pqxMessages(format string, args ...any) {
+	if strings.HasPrefix(format, "pqx: ") {
+		log.Printf(format, args...)
+	}
+}
+
+// Reset prepares the shared Postgres instance for another run of the tests
+// in the same process, for TestMain functions that call m.Run more than
+// once. It drops the databases shared by CreateTxDB, waits for databases
+// created by the previous run to be dropped, and recreates template
+// databases, such as the one for SetSchema, when next needed. The pool
+// created by -pqxtest.pool, if any, is likewise recreated when next needed.
+func Reset() {
+	if sharedPG == nil {
+		return
+	}
+	dropTxDBs()
+	if err := sharedPG.Reset(context.Background()); err != nil {
+		log.Fatalf("error resetting Postgres: %v", err)
+	}
+	dmu.Lock()
+	dbs = map[string][]DBInfo{}
+	notices = map[testing.TB][]pqx.Notice{}
+	dmu.Unlock()
+}
+
+// StartLazy is like Start, but defers starting the instance until it is
+// first needed, such as by the first call to CreateDB, so that runs that
+// select only tests without databases do not pay for starting it.
+func StartLazy(timeout time.Duration, debugLevel int) {
+	maybeBecomeSupervisor()
+	var once sync.Once
+	lazyStart = func() {
+		once.Do(func() { Start(timeout, debugLevel) })
+	}
 }
 
 // Shutdown shuts down the shared Postgres instance.
@@ -225,6 +471,7 @@ func Shutdown() {
 	if sharedPG == nil {
 		return
 	}
+	dropTxDBs()
 	if err := sharedPG.ShutdownAlone(); err != nil {
 		log.Printf("error shutting down Postgres: %v", err)
 	}
@@ -233,36 +480,215 @@ func Shutdown() {
 // CreateDB creates and returns a database using the shared Postgres instance.
 // The database will automatically be cleaned up just before the test ends.
 //
-// All logs associated with the database will be written to t.Logf.
-func CreateDB(t testing.TB, schema string) *sql.DB {
+// If schema is empty and a package schema was set with SetSchema, the
+// database is cloned from a template with that schema applied.
+//
+// Connections to the database, through the returned *sql.DB or DSN, have
+// application_name set to the test's name, so pg_stat_activity and server
+// logs attribute them to it.
+//
+// All logs associated with the database will be written to t.Logf, or,
+// with -pqxtest.quiet, only if t fails, and all notices sent by the server
+// after the schema is applied are recorded for Notices, unless the database
+// is opened with another driver by -pqxtest.driver.
+func CreateDB(t testing.TB, schema string, opts ...pqx.DBOption) *sql.DB {
 	t.Helper()
-	if sharedPG == nil {
-		t.Fatal("pqxtest.TestMain not called")
-	}
+	pg := shared(t)
+	logf := testLogf(t)
 	t.Cleanup(func() {
-		sharedPG.Flush()
+		pg.Flush()
 	})
 
-	name := cleanName(t.Name())
-	name = fmt.Sprintf("%s_%s", name, randomString())
-	db, dsn, cleanup, err := sharedPG.CreateDB(context.Background(), t.Logf, name, schema)
+	var recording int32
+	onNotice := pqx.WithNoticeHandler(func(n pqx.Notice) {
+		if atomic.LoadInt32(&recording) == 0 {
+			return // raised by schema
+		}
+		dmu.Lock()
+		notices[t] = append(notices[t], n)
+		dmu.Unlock()
+	})
+
+	var (
+		db      *sql.DB
+		name    string
+		dsn     string
+		cleanup func()
+		err     error
+	)
+	appName := pqx.WithApplicationName(cleanName(t.Name()))
+	if *flagCoverage != "" {
+		// Count calls of SQL and PL/pgSQL functions for coverage.
+		opts = append(opts[:len(opts):len(opts)], pqx.WithFunctionTracking())
+	}
+	if *flagPool > 0 && schema == "" && len(opts) == 0 && !*flagStableNames {
+		// Checked out of the pool created at start, so named by it.
+		db, dsn, cleanup, err = sharedPG.CreateDB(context.Background(), logf, dbName(t), packageSchema, onNotice, appName)
+		if err == nil {
+			if err = db.QueryRow("SELECT current_database()").Scan(&name); err != nil {
+				cleanup()
+			}
+		}
+	} else {
+		db, name, dsn, cleanup, err = createDB(t, logf, schema, append([]pqx.DBOption{onNotice, appName}, opts...))
+	}
 	if err != nil {
 		t.Fatal(err)
 	}
+	atomic.StoreInt32(&recording, 1)
 	t.Cleanup(func() {
 		cleanup()
 		dmu.Lock()
-		delete(dsns, t)
+		delete(dbs, t.Name())
+		delete(notices, t)
 		dmu.Unlock()
 	})
 
+	if *flagTimestamps {
+		logMarker(logf, "database %s created", name)
+		t.Cleanup(func() { logMarker(logf, "cleaning up database %s", name) })
+	}
+	if *flagTableReport {
+		before, err := tableAccessStats(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { reportTableAccess(t, db, dsn, before) })
+	}
+	if *flagCoverage != "" {
+		before, err := objectUse(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Registered before checkPrepared, which runs first and
+		// needs db, since recordCoverage closes it.
+		t.Cleanup(func() { recordCoverage(t, db, dsn, before) })
+	}
+	if *flagCheckPrepared {
+		// Registered after cleanup, so it runs before the database
+		// is dropped.
+		t.Cleanup(func() { checkPrepared(t, db) })
+	}
+
 	dmu.Lock()
-	dsns[t] = append(dsns[t], dsn)
+	dbs[t.Name()] = append(dbs[t.Name()], DBInfo{Name: name, DSN: dsn})
 	dmu.Unlock()
 
+	if schema == "" {
+		schema = packageSchema
+	}
+	writeMetadata(dbMetadata{
+		Name:       name,
+		DSN:        dsn,
+		Test:       t.Name(),
+		SchemaHash: schemaHash(schema),
+	})
+
 	return db
 }
 
+// logMarker logs a message to logf prefixed with the current time,
+// formatted like the timestamps of postgres log lines.
+func logMarker(logf func(string, ...any), format string, args ...any) {
+	logf("%s [pqxtest] %s", time.Now().UTC().Format(pqx.LogTimeFormat), fmt.Sprintf(format, args...))
+}
+
+// testLogf returns the function that logs for t's databases. It is t.Logf
+// unless -pqxtest.quiet is set, in which case lines are buffered and
+// written to t when it finishes, only if it failed.
+func testLogf(t testing.TB) func(string, ...any) {
+	if !*flagQuiet {
+		return t.Logf
+	}
+	var mu sync.Mutex
+	var lines []string
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if t.Failed() {
+			for _, line := range lines {
+				t.Log(line)
+			}
+		}
+		lines = nil
+	})
+	return func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+}
+
+// createDB creates a database for t with sharedPG.CreateDB, cloning the
+// package schema if schema is empty, and returns it along with its name.
+func createDB(t testing.TB, logf func(string, ...any), schema string, opts []pqx.DBOption) (*sql.DB, string, string, func(), error) {
+	ctx := context.Background()
+	if schema == "" && packageSchema != "" {
+		tmpl, err := sharedPG.Template(ctx, logf, packageSchema)
+		if err != nil {
+			return nil, "", "", nil, err
+		}
+		opts = append([]pqx.DBOption{pqx.WithTemplate(tmpl)}, opts...)
+	}
+	if *flagTemplates && schema != "" {
+		opts = append(opts, pqx.WithCachedSchema())
+	}
+	if *flagStableNames {
+		opts = append(opts, pqx.WithReplace(), pqx.WithKeep())
+	} else if *flagRecycle {
+		opts = append(opts, pqx.WithRecycle())
+	}
+
+	name := dbName(t)
+	db, dsn, cleanup, err := sharedPG.CreateDB(ctx, logf, name, schema, opts...)
+	for i := 0; i < 3 && errors.Is(err, pqx.ErrDatabaseExists); i++ {
+		// A leftover from a crashed run; try another suffix.
+		name = dbName(t)
+		db, dsn, cleanup, err = sharedPG.CreateDB(ctx, logf, name, schema, opts...)
+	}
+	return db, pqx.DBName(name), dsn, cleanup, err
+}
+
+// dbName returns the name of the next database created using t. It is
+// random unless -pqxtest.stablenames is set, in which case it is derived
+// only from the test name and the number of databases t already created,
+// so it is the same on every run.
+func dbName(t testing.TB) string {
+	name := cleanName(t.Name())
+	if !*flagStableNames {
+		return fmt.Sprintf("%s_%s", name, randomString())
+	}
+	dmu.Lock()
+	n := len(dbs[t.Name()])
+	dmu.Unlock()
+	if n > 0 {
+		name = fmt.Sprintf("%s_%d", name, n+1)
+	}
+	return name
+}
+
+// CreateDBs is like CreateDB, but creates n isolated databases with the
+// same schema. It is useful for testing code that routes between, or
+// operates across, several databases, such as multi-tenant routers.
+func CreateDBs(t testing.TB, n int, schema string, opts ...pqx.DBOption) []*sql.DB {
+	t.Helper()
+	dbs := make([]*sql.DB, n)
+	for i := range dbs {
+		dbs[i] = CreateDB(t, schema, opts...)
+	}
+	return dbs
+}
+
+// Notices returns the notices and warnings, in the order received, sent by
+// the server to connections of all databases created by CreateDB using t.
+// Notices raised while applying the schema are not included, and none are
+// recorded with -pqxtest.driver.
+func Notices(t testing.TB) []pqx.Notice {
+	dmu.Lock()
+	defer dmu.Unlock()
+	return append([]pqx.Notice(nil), notices[t]...)
+}
+
 // BlockForPSQL logs the psql commands for connecting to all databases created
 // by CreateDB in a test, and blocks the current goroutine allowing the user to
 // interact with the databases.
@@ -294,10 +720,7 @@ func BlockForPSQL(t testing.TB) {
 		}
 	}
 
-	dmu.Lock()
-	dsns := dsns[t]
-	dmu.Unlock()
-
+	dsns := DSNs(t)
 	if len(dsns) == 0 {
 		logf("[pqx]: BlockForPSQL: no databases to interact with")
 	}
@@ -309,6 +732,13 @@ func BlockForPSQL(t testing.TB) {
 	select {}
 }
 
+// envInt returns the integer value of the environment variable name, or 0
+// if it is not set or not an integer.
+func envInt(name string) int {
+	n, _ := strconv.Atoi(os.Getenv(name))
+	return n
+}
+
 func getSharedDir() string {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -317,6 +747,36 @@ func getSharedDir() string {
 	return filepath.Join(os.TempDir(), "pqx", cwd)
 }
 
+// packageIdentity returns the module path of the main module joined with
+// the path of the current directory in it, or, outside of a module, the
+// current directory.
+func packageIdentity() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	for dir := cwd; ; dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			rel, _ := filepath.Rel(dir, cwd)
+			return path.Join(modulePath(data), filepath.ToSlash(rel))
+		}
+		if filepath.Dir(dir) == dir {
+			return cwd
+		}
+	}
+}
+
+// modulePath returns the module path declared in the go.mod file data.
+func modulePath(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "module" {
+			return strings.Trim(f[1], `"`)
+		}
+	}
+	return ""
+}
+
 func cleanName(name string) string {
 	rr := []rune(name)
 	for i, r := range rr {
@@ -335,51 +795,94 @@ func randomString() string {
 	return fmt.Sprintf("%x", buf)
 }
 
-type lockedBuffer struct {
-	mu sync.Mutex
-	b  bytes.Buffer
-}
-
-func (b *lockedBuffer) Write(p []byte) (int, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	return b.b.Write(p)
-}
-
-func (b *lockedBuffer) WriteTo(w io.Writer) (int64, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	return b.b.WriteTo(w)
-}
-
 func maybeBecomeSupervisor() {
-	pid, _ := strconv.Atoi(os.Getenv("_PQX_SUP_PID"))
-	if pid == 0 {
+	pidFile := os.Getenv("_PQX_SUP_PIDFILE")
+	if pidFile == "" {
 		return
 	}
 	log.SetFlags(0)
+	// Outlive interrupts sent to the whole process group, such as by
+	// Ctrl-C, so postgres is always stopped.
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
 	awaitParentDeath()
+
+	// The pid is read only now, since postgres may have been
+	// restarted with a new one; see pqx.Postgres.Restart. Postgres
+	// removes the file when it stops.
+	data, err := os.ReadFile(pidFile)
+	if errors.Is(err, os.ErrNotExist) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("reading pid: %v", err)
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		log.Fatalf("reading pid: %v", err)
+	}
 	p, err := os.FindProcess(pid)
 	if err != nil {
 		log.Fatalf("find process: %v", err)
 	}
-	if err := p.Signal(syscall.Signal(syscall.SIGQUIT)); err != nil {
+
+	// The parent may have died without running its deferred Shutdown,
+	// such as when go test's -timeout panics, with drops in flight. A
+	// fast shutdown, unlike an immediate one, leaves the data directory
+	// clean for the next run, which drops the leftover databases.
+	// Postgres is already gone if the parent shut it down on a signal.
+	if err := p.Signal(syscall.SIGINT); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			os.Exit(0)
+		}
+		log.Fatalf("error signaling process: %v", err)
+	}
+	deadline := time.Now().Add(supervisorStopTimeout)
+	for time.Now().Before(deadline) {
+		if p.Signal(syscall.Signal(0)) != nil {
+			os.Exit(0)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := p.Signal(syscall.SIGQUIT); err != nil && !errors.Is(err, syscall.ESRCH) {
 		log.Fatalf("error signaling process: %v", err)
 	}
 	os.Exit(0)
 }
 
+// supervisorStopTimeout is how long the supervisor waits for a fast
+// shutdown of postgres before resorting to an immediate one.
+const supervisorStopTimeout = 10 * time.Second
+
 func awaitParentDeath() {
 	_, _ = os.Stdin.Read(make([]byte, 1))
 }
 
-func shutThisDownAfterMyDeath(pid int) {
+// shutdownOnSignal shuts down the shared instance cleanly, and exits, when
+// the process is interrupted or terminated, such as by Ctrl-C during go
+// test, rather than leaving postgres to the supervisor, which shuts it down
+// immediately.
+func shutdownOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		signal.Stop(c)
+		log.Printf("pqxtest: %v: shutting down Postgres", sig)
+		if err := sharedPG.ShutdownFast(); err != nil {
+			log.Printf("error shutting down Postgres: %v", err)
+		}
+		os.Exit(1)
+	}()
+}
+
+func shutThisDownAfterMyDeath(pidFile string) {
 	exe, err := os.Executable()
 	if err != nil {
 		panic(err)
 	}
 	sup := exec.Command(exe)
-	sup.Env = append(os.Environ(), "_PQX_SUP_PID="+strconv.Itoa(pid))
+	sup.Env = append(os.Environ(), "_PQX_SUP_PIDFILE="+pidFile)
 	sup.Stdout = os.Stdout
 	sup.Stderr = os.Stderr
 
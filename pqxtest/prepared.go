@@ -0,0 +1,29 @@
+package pqxtest
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// checkPrepared fails t if db's database has prepared transactions, which
+// would otherwise block dropping it, and rolls them back.
+func checkPrepared(t testing.TB, db *sql.DB) {
+	t.Helper()
+	gids, err := preparedTransactions(db)
+	if err != nil {
+		t.Errorf("pqxtest: checking prepared transactions: %v", err)
+		return
+	}
+	if len(gids) == 0 {
+		return
+	}
+	t.Errorf("pqxtest: test left prepared transactions: %s", strings.Join(gids, ", "))
+	for _, gid := range gids {
+		if _, err := db.Exec("ROLLBACK PREPARED " + pq.QuoteLiteral(gid)); err != nil {
+			t.Errorf("pqxtest: rolling back prepared transaction %s: %v", gid, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"blake.io/pqx"
+)
+
+// CreateLogicalSlot creates a logical replication slot named name in db's
+// database using the output plugin, and drops it when the test ends so the
+// database can be dropped. The shared instance must be configured with
+// Logical; see Configure.
+func CreateLogicalSlot(t testing.TB, db *sql.DB, name, plugin string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := pqx.CreateLogicalSlot(ctx, db, name, plugin); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := pqx.DropSlot(ctx, db, name); err != nil {
+			t.Errorf("pqxtest: dropping slot %q: %v", name, err)
+		}
+	})
+}
+
+// A Change is a row change decoded from the WAL by a ChangeCapture.
+type Change struct {
+	Table string // the schema-qualified table name, e.g. "public.foo"
+	Op    string // one of "INSERT", "UPDATE", "DELETE", or "TRUNCATE"
+
+	// Data is the change as decoded by the output plugin: the row's
+	// columns in test_decoding's text format, or the wal2json
+	// (format-version 2) JSON object describing the change.
+	Data string
+}
+
+// A ChangeCapture decodes changes committed to a database's tables. It is
+// created by CaptureChanges.
+type ChangeCapture struct {
+	db     *sql.DB
+	slot   string
+	plugin string
+	tables []string
+}
+
+// CaptureChanges starts capturing changes committed to tables in db's
+// database, or changes to all tables if none are given, using a temporary
+// logical replication slot. Tables may be schema-qualified; unqualified
+// names match a table in any schema. The shared instance must be
+// configured with Logical; see Configure.
+//
+// The wal2json output plugin is used if the server has it; otherwise
+// test_decoding, which is bundled with postgres, is used.
+func CaptureChanges(t testing.TB, db *sql.DB, tables ...string) *ChangeCapture {
+	t.Helper()
+	c := &ChangeCapture{
+		db:     db,
+		slot:   "pqx_capture_" + randomString(),
+		tables: tables,
+	}
+	ctx := context.Background()
+	for _, plugin := range []string{"wal2json", "test_decoding"} {
+		if err := pqx.CreateLogicalSlot(ctx, db, c.slot, plugin); err != nil {
+			if plugin == "test_decoding" {
+				t.Fatal(err)
+			}
+			continue
+		}
+		c.plugin = plugin
+		break
+	}
+	t.Cleanup(func() {
+		if err := pqx.DropSlot(ctx, db, c.slot); err != nil {
+			t.Errorf("pqxtest: dropping slot %q: %v", c.slot, err)
+		}
+	})
+	return c
+}
+
+// Changes returns the changes committed since CaptureChanges or the last
+// call to Changes, in commit order.
+func (c *ChangeCapture) Changes(t testing.TB) []Change {
+	t.Helper()
+	q := "SELECT data FROM pg_logical_slot_get_changes($1, NULL, NULL)"
+	if c.plugin == "wal2json" {
+		q = "SELECT data FROM pg_logical_slot_get_changes($1, NULL, NULL, 'format-version', '2')"
+	}
+	rows, err := c.db.Query(q, c.slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var changes []Change
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			t.Fatal(err)
+		}
+		ch, ok := parseChange(c.plugin, data)
+		if ok && c.captures(ch.Table) {
+			changes = append(changes, ch)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func (c *ChangeCapture) captures(table string) bool {
+	if len(c.tables) == 0 {
+		return true
+	}
+	_, unqualified, _ := strings.Cut(table, ".")
+	for _, name := range c.tables {
+		if name == table || name == unqualified {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChange parses a row of output from plugin. It reports false for
+// output that does not describe a row change, such as BEGIN and COMMIT.
+func parseChange(plugin, data string) (Change, bool) {
+	if plugin == "wal2json" {
+		var v struct {
+			Action string
+			Schema string
+			Table  string
+		}
+		if err := json.Unmarshal([]byte(data), &v); err != nil {
+			return Change{}, false
+		}
+		op := map[string]string{
+			"I": "INSERT",
+			"U": "UPDATE",
+			"D": "DELETE",
+			"T": "TRUNCATE",
+		}[v.Action]
+		if op == "" {
+			return Change{}, false
+		}
+		return Change{Table: v.Schema + "." + v.Table, Op: op, Data: data}, true
+	}
+
+	// test_decoding: "table public.foo: INSERT: n[integer]:1"
+	if !strings.HasPrefix(data, "table ") {
+		return Change{}, false
+	}
+	table, rest, _ := strings.Cut(strings.TrimPrefix(data, "table "), ": ")
+	op, rest, _ := strings.Cut(rest, ":")
+	return Change{Table: table, Op: op, Data: strings.TrimSpace(rest)}, true
+}
@@ -0,0 +1,39 @@
+package pqxtest
+
+import (
+	"testing"
+
+	"kr.dev/diff"
+)
+
+func TestParseChange(t *testing.T) {
+	cases := []struct {
+		plugin string
+		data   string
+		want   Change
+		ok     bool
+	}{
+		{"test_decoding", "BEGIN 734", Change{}, false},
+		{"test_decoding", "COMMIT 734", Change{}, false},
+		{
+			"test_decoding", "table public.foo: INSERT: n[integer]:1 s[text]:'a: b'",
+			Change{Table: "public.foo", Op: "INSERT", Data: "n[integer]:1 s[text]:'a: b'"}, true,
+		},
+		{
+			"test_decoding", "table public.foo: TRUNCATE: (no-flags)",
+			Change{Table: "public.foo", Op: "TRUNCATE", Data: "(no-flags)"}, true,
+		},
+		{"wal2json", `{"action":"B"}`, Change{}, false},
+		{
+			"wal2json", `{"action":"D","schema":"app","table":"bar","identity":[]}`,
+			Change{Table: "app.bar", Op: "DELETE", Data: `{"action":"D","schema":"app","table":"bar","identity":[]}`}, true,
+		},
+	}
+	for _, tt := range cases {
+		got, ok := parseChange(tt.plugin, tt.data)
+		if ok != tt.ok {
+			t.Errorf("parseChange(%q, %q) ok = %v; want %v", tt.plugin, tt.data, ok, tt.ok)
+		}
+		diff.Test(t, t.Errorf, got, tt.want)
+	}
+}
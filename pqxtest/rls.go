@@ -0,0 +1,93 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// CreateRole creates a role, named name followed by a random suffix, that
+// may log in but is not a superuser and does not bypass row-level security,
+// and returns its name. The role is granted all privileges on the tables
+// and sequences currently in the public schema of db's database; objects
+// created after must be granted explicitly. The role, and anything it owns
+// in db's database, is dropped when the test ends.
+//
+// Roles are shared by all databases of an instance, which is why names
+// are made unique.
+func CreateRole(t testing.TB, db *sql.DB, name string) string {
+	t.Helper()
+	ctx := context.Background()
+	role := cleanName(name) + "_" + randomString()
+	qrole := pq.QuoteIdentifier(role)
+	stmts := []string{
+		"CREATE ROLE " + qrole + " LOGIN NOSUPERUSER NOBYPASSRLS",
+		"GRANT USAGE ON SCHEMA public TO " + qrole,
+		"GRANT ALL ON ALL TABLES IN SCHEMA public TO " + qrole,
+		"GRANT ALL ON ALL SEQUENCES IN SCHEMA public TO " + qrole,
+	}
+	for _, q := range stmts {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		// DROP OWNED also revokes the privileges granted above.
+		if _, err := db.ExecContext(ctx, "DROP OWNED BY "+qrole); err != nil {
+			t.Errorf("pqxtest: dropping objects owned by role %s: %v", role, err)
+			return
+		}
+		if _, err := db.ExecContext(ctx, "DROP ROLE "+qrole); err != nil {
+			t.Errorf("pqxtest: dropping role %s: %v", role, err)
+		}
+	})
+	return role
+}
+
+// AsRole returns a dedicated connection to db on which queries run as role,
+// using SET ROLE, such that row-level security policies apply as they would
+// for role. The connection is closed when the test ends; it is never
+// returned to db's pool with the role set.
+func AsRole(t testing.TB, db *sql.DB, role string) *sql.Conn {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "SET ROLE "+pq.QuoteIdentifier(role)); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Close only returns the connection to the pool; reporting it
+		// bad makes database/sql discard it instead.
+		conn.Raw(func(any) error { return driver.ErrBadConn }) //nolint
+		conn.Close()
+	})
+	return conn
+}
+
+// A Queryer runs queries; *sql.DB, *sql.Conn, and *sql.Tx are Queryers.
+type Queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// AssertRowCount fails the test unless query returns want rows when run
+// with q, such as a connection returned by AsRole, for asserting which rows
+// are visible under row-level security.
+func AssertRowCount(t testing.TB, q Queryer, want int, query string, args ...any) {
+	t.Helper()
+	var got int
+	err := q.QueryRowContext(context.Background(), fmt.Sprintf("SELECT count(*) FROM (%s) q", query), args...).Scan(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %d rows; want %d\n%s", got, want, query)
+	}
+}
@@ -0,0 +1,42 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// An Execer executes statements; *sql.Conn and *sql.Tx are Execers.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+var savepoints int64
+
+// Savepoint creates a savepoint in the transaction x, such as one returned
+// by CreateTxDB, and rolls back to it when the test ends, undoing the
+// test's writes while keeping those made before. Calling it at the start
+// of each subtest lets table-driven cases share one expensive database
+// while isolating their writes from each other.
+//
+// If x is a *sql.Conn, a transaction must have been started on it with
+// BEGIN. Subtests using the same x must not run in parallel.
+func Savepoint(t testing.TB, x Execer) {
+	t.Helper()
+	ctx := context.Background()
+	name := fmt.Sprintf("pqxtest_%d", atomic.AddInt64(&savepoints, 1))
+	if _, err := x.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := x.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); err != nil {
+			t.Errorf("pqxtest: rolling back to savepoint: %v", err)
+			return
+		}
+		if _, err := x.ExecContext(ctx, "RELEASE SAVEPOINT "+name); err != nil {
+			t.Errorf("pqxtest: releasing savepoint: %v", err)
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package pqxtest
+
+import (
+	"io/fs"
+	"log"
+	"strings"
+)
+
+var packageSchema string
+
+// SetSchema sets the schema of databases created by CreateDB with an empty
+// schema. It is applied once, to a template database that those databases
+// are cloned from, so tests do not pay the cost of applying it. It must be
+// called before any tests run, typically from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		pqxtest.SetSchema(schema)
+//		pqxtest.TestMain(m)
+//	}
+func SetSchema(schema string) {
+	packageSchema = schema
+}
+
+// SetSchemaFS is like SetSchema, but the schema is the contents of the
+// files in fsys matching pattern, such as "migrations/*.sql", applied in
+// lexical order of their names.
+func SetSchemaFS(fsys fs.FS, pattern string) {
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		log.Fatalf("pqxtest: SetSchemaFS: %v", err)
+	}
+	if len(names) == 0 {
+		log.Fatalf("pqxtest: SetSchemaFS: no files match %q", pattern)
+	}
+	var b strings.Builder
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			log.Fatalf("pqxtest: SetSchemaFS: %v", err)
+		}
+		b.Write(data)
+		b.WriteString("\n")
+	}
+	SetSchema(b.String())
+}
@@ -0,0 +1,43 @@
+package pqxtest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// CreateTablespace creates a tablespace in a temporary directory and returns
+// its name. The tablespace is dropped when the test ends, after the
+// databases created in it, so it must be created before them. Use
+// pqx.WithTablespace to create a database in it:
+//
+//	ts := pqxtest.CreateTablespace(t)
+//	db := pqxtest.CreateDB(t, schema, pqx.WithTablespace(ts))
+func CreateTablespace(t testing.TB) string {
+	t.Helper()
+	pg := shared(t)
+	name := "pqx_ts_" + randomString()
+	dir := t.TempDir()
+	if err := pg.CreateTablespace(context.Background(), name, dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Databases in the tablespace are dropped in the background,
+		// so give them a moment to go away.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for {
+			err := pg.DropTablespace(ctx, name)
+			if err == nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				t.Errorf("pqxtest: dropping tablespace %q: %v", name, err)
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	})
+	return name
+}
@@ -0,0 +1,74 @@
+package pqxtest
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tableAccess counts accesses to a table.
+type tableAccess struct {
+	reads  int64 // sequential and index scans
+	writes int64 // rows inserted, updated, and deleted
+}
+
+// tableAccessStats returns the accesses to each user table in db's
+// database, keyed by schema-qualified name, as counted by the statistics
+// collector.
+func tableAccessStats(db *sql.DB) (map[string]tableAccess, error) {
+	rows, err := db.Query(`
+		SELECT format('%I.%I', schemaname, relname),
+			seq_scan + coalesce(idx_scan, 0),
+			n_tup_ins + n_tup_upd + n_tup_del
+		FROM pg_stat_user_tables`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := map[string]tableAccess{}
+	for rows.Next() {
+		var name string
+		var a tableAccess
+		if err := rows.Scan(&name, &a.reads, &a.writes); err != nil {
+			return nil, err
+		}
+		m[name] = a
+	}
+	return m, rows.Err()
+}
+
+// reportTableAccess logs to t the tables in the database at dsn that were
+// accessed since before was taken. The statistics collector counts
+// accesses when sessions end, so db, the test's connections to it, is
+// closed first.
+func reportTableAccess(t testing.TB, db *sql.DB, dsn string, before map[string]tableAccess) {
+	t.Helper()
+	db.Close()
+	sdb, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Errorf("pqxtest: reporting table access: %v", err)
+		return
+	}
+	defer sdb.Close()
+	after, err := tableAccessStats(sdb)
+	if err != nil {
+		t.Errorf("pqxtest: reporting table access: %v", err)
+		return
+	}
+	var lines []string
+	for name, a := range after {
+		b := before[name]
+		reads, writes := a.reads-b.reads, a.writes-b.writes
+		if reads > 0 || writes > 0 {
+			lines = append(lines, fmt.Sprintf("  %s: %d scans, %d rows written", name, reads, writes))
+		}
+	}
+	if len(lines) == 0 {
+		t.Logf("pqxtest: no tables accessed")
+		return
+	}
+	sort.Strings(lines)
+	t.Logf("pqxtest: tables accessed:\n%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,63 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// FiredTriggers runs f in a transaction on a dedicated connection to db,
+// commits it, and returns the triggers, as "name on table", whose functions
+// were called while it ran, in sorted order. Triggers implemented by
+// functions in C, such as those enforcing foreign keys, are not included,
+// and all triggers sharing a function that was called are.
+func FiredTriggers(t testing.TB, db *sql.DB, f func(conn *sql.Conn) error) []string {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	exec := func(q string) {
+		t.Helper()
+		if _, err := conn.ExecContext(ctx, q); err != nil {
+			conn.ExecContext(ctx, "ROLLBACK") //nolint
+			t.Fatal(err)
+		}
+	}
+	exec("SET track_functions = 'pl'")
+	defer conn.ExecContext(ctx, "RESET track_functions") //nolint
+	exec("BEGIN")
+	if err := f(conn); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK") //nolint
+		t.Fatal(err)
+	}
+
+	// The calls made by the current transaction are visible before
+	// they are reported to the statistics collector.
+	rows, err := conn.QueryContext(ctx, `
+		SELECT DISTINCT format('%s on %s', t.tgname, t.tgrelid::regclass)
+		FROM pg_trigger t
+		JOIN pg_stat_xact_user_functions f ON f.funcid = t.tgfoid
+		WHERE NOT t.tgisinternal
+		ORDER BY 1`)
+	if err != nil {
+		conn.ExecContext(ctx, "ROLLBACK") //nolint
+		t.Fatal(err)
+	}
+	var fired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		fired = append(fired, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	exec("COMMIT")
+	return fired
+}
@@ -0,0 +1,85 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// PrepareTransaction begins a transaction on its own connection to db, runs
+// f in it, and prepares it for two-phase commit with PREPARE TRANSACTION
+// using gid as its identifier. The transaction outlives the connection,
+// which is closed before PrepareTransaction returns, until it is finished
+// with CommitPrepared or RollbackPrepared from any session, as a
+// transaction coordinator would. If f returns an error, the transaction is
+// rolled back and t fails.
+//
+// The server must allow prepared transactions; see
+// pqx.Postgres.MaxPreparedTransactions.
+func PrepareTransaction(t testing.TB, db *sql.DB, gid string, f func(conn *sql.Conn) error) {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f(conn); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK") //nolint
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "PREPARE TRANSACTION "+pq.QuoteLiteral(gid)); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK") //nolint
+		t.Fatalf("pqxtest: preparing transaction %s: %v", gid, err)
+	}
+}
+
+// CommitPrepared commits the prepared transaction gid in db's database.
+func CommitPrepared(t testing.TB, db *sql.DB, gid string) {
+	t.Helper()
+	if _, err := db.Exec("COMMIT PREPARED " + pq.QuoteLiteral(gid)); err != nil {
+		t.Fatalf("pqxtest: committing prepared transaction %s: %v", gid, err)
+	}
+}
+
+// RollbackPrepared rolls back the prepared transaction gid in db's
+// database.
+func RollbackPrepared(t testing.TB, db *sql.DB, gid string) {
+	t.Helper()
+	if _, err := db.Exec("ROLLBACK PREPARED " + pq.QuoteLiteral(gid)); err != nil {
+		t.Fatalf("pqxtest: rolling back prepared transaction %s: %v", gid, err)
+	}
+}
+
+// PreparedTransactions returns the identifiers of the prepared transactions
+// in db's database, in the order they were prepared.
+func PreparedTransactions(t testing.TB, db *sql.DB) []string {
+	t.Helper()
+	gids, err := preparedTransactions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gids
+}
+
+func preparedTransactions(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT gid FROM pg_prepared_xacts WHERE database = current_database() ORDER BY prepared`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var gids []string
+	for rows.Next() {
+		var gid string
+		if err := rows.Scan(&gid); err != nil {
+			return nil, err
+		}
+		gids = append(gids, gid)
+	}
+	return gids, rows.Err()
+}
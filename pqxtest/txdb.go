@@ -0,0 +1,94 @@
+package pqxtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+
+	"blake.io/pqx"
+)
+
+var (
+	txMu  sync.Mutex
+	txDBs = map[string]*txDB{} // keyed by schema
+)
+
+type txDB struct {
+	db      *sql.DB
+	cleanup func()
+}
+
+// CreateTxDB returns a transaction on a database with schema applied that
+// is shared by all tests calling CreateTxDB with the same schema. The
+// transaction is rolled back when the test ends, so its writes are never
+// seen by other tests.
+//
+// This is the global transaction trick described in the package
+// documentation, made explicit: it is much faster than CreateDB for tests
+// that only read and write rows, but the code under test must run all of
+// its queries with the returned *sql.Tx, and it must not commit, change
+// the schema, or depend on anything a transaction changes, such as now()
+// or sequence values, which are not rolled back. Concurrent tests may also
+// block each other on locks, such as those taken for unique indexes.
+//
+// If schema is empty, the package schema set with SetSchema is used. Logs
+// of the shared database are not routed to tests. The shared databases are
+// dropped by Shutdown and Reset.
+func CreateTxDB(t testing.TB, schema string) *sql.Tx {
+	t.Helper()
+	shared(t)
+	db, err := sharedTxDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			t.Errorf("pqxtest: rolling back transaction: %v", err)
+		}
+	})
+	return tx
+}
+
+// sharedTxDB returns the database shared by CreateTxDB for schema,
+// creating it if needed.
+func sharedTxDB(schema string) (*sql.DB, error) {
+	txMu.Lock()
+	defer txMu.Unlock()
+	if d := txDBs[schema]; d != nil {
+		return d.db, nil
+	}
+
+	ctx := context.Background()
+	logf := func(string, ...any) {}
+	var opts []pqx.DBOption
+	if schema == "" && packageSchema != "" {
+		tmpl, err := sharedPG.Template(ctx, logf, packageSchema)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, pqx.WithTemplate(tmpl))
+	}
+	name := fmt.Sprintf("txdb_%s", randomString())
+	db, _, cleanup, err := sharedPG.CreateDB(ctx, logf, name, schema, opts...)
+	if err != nil {
+		return nil, err
+	}
+	txDBs[schema] = &txDB{db: db, cleanup: cleanup}
+	return db, nil
+}
+
+// dropTxDBs drops the databases shared by CreateTxDB.
+func dropTxDBs() {
+	txMu.Lock()
+	defer txMu.Unlock()
+	for schema, d := range txDBs {
+		d.cleanup()
+		delete(txDBs, schema)
+	}
+}
@@ -0,0 +1,252 @@
+// Package proxy provides a TCP proxy for injecting latency, bandwidth limits,
+// stalls, and dropped connections between a client and a server, such as
+// between code under test and postgres.
+//
+// A Proxy forwards each accepted connection to its target. Its knobs may be
+// changed at any time and take effect for data not yet forwarded:
+//
+//	px, err := proxy.Listen("localhost:5432")
+//	...
+//	px.SetLatency(50 * time.Millisecond) // slow network
+//	px.Pause()                           // stall all traffic
+//	px.Resume()
+//	px.DropConnections()                 // simulate a network partition
+//	px.SetTarget("localhost:5433")       // fail over to another server
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Proxy forwards TCP connections to a target address.
+type Proxy struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	target    string
+	unpaused  *sync.Cond // signaled when paused becomes false or the proxy closes
+	paused    bool
+	closed    bool
+	latency   time.Duration
+	bandwidth int // bytes per second; zero means unlimited
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+// Listen returns a Proxy listening on a random port on the loopback
+// interface that forwards connections to target.
+func Listen(target string) (*Proxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		target: target,
+		ln:     ln,
+		conns:  map[net.Conn]bool{},
+	}
+	p.unpaused = sync.NewCond(&p.mu)
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Addr returns the address, in host:port form, clients should dial to reach
+// the target through p.
+func (p *Proxy) Addr() string { return p.ln.Addr().String() }
+
+// Host returns the host of Addr.
+func (p *Proxy) Host() string { return p.ln.Addr().(*net.TCPAddr).IP.String() }
+
+// Port returns the port of Addr.
+func (p *Proxy) Port() string { return strconv.Itoa(p.ln.Addr().(*net.TCPAddr).Port) }
+
+// SetLatency delays each chunk of data forwarded, in either direction, by d.
+func (p *Proxy) SetLatency(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latency = d
+}
+
+// SetBandwidth limits the rate data is forwarded, in each direction of each
+// connection, to bytesPerSecond. If bytesPerSecond is zero, the rate is not
+// limited.
+func (p *Proxy) SetBandwidth(bytesPerSecond int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bandwidth = bytesPerSecond
+}
+
+// Pause stops forwarding data on all connections, new and existing, until
+// Resume is called. Connections are accepted but otherwise stall.
+func (p *Proxy) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+}
+
+// Resume resumes forwarding data after a call to Pause.
+func (p *Proxy) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = false
+	p.unpaused.Broadcast()
+}
+
+// SetTarget changes the address new connections are forwarded to, such as
+// to redirect clients to a promoted replica. Connections already open are
+// not affected; use DropConnections to close them.
+func (p *Proxy) SetTarget(target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target = target
+}
+
+// DropConnections abruptly closes all connections currently open through p.
+// New connections are still accepted.
+func (p *Proxy) DropConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+// Close stops accepting connections, closes all open connections, and waits
+// for all forwarding to stop.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.unpaused.Broadcast()
+	p.mu.Unlock()
+
+	err := p.ln.Close()
+	p.DropConnections()
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return // closed
+		}
+		p.mu.Lock()
+		target := p.target
+		p.mu.Unlock()
+		server, err := net.Dial("tcp", target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		if !p.track(client, server) {
+			client.Close()
+			server.Close()
+			return
+		}
+		p.wg.Add(1)
+		go p.link(client, server)
+	}
+}
+
+// track records conns as open so they may be dropped; it reports false if p
+// is closed.
+func (p *Proxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = true
+	}
+	return true
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+// link forwards data in both directions between client and server until
+// both directions are done, and then closes both.
+func (p *Proxy) link(client, server net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(client, server)
+	defer server.Close()
+	defer client.Close()
+
+	var g sync.WaitGroup
+	g.Add(2)
+	go func() {
+		defer g.Done()
+		p.forward(server, client)
+	}()
+	go func() {
+		defer g.Done()
+		p.forward(client, server)
+	}()
+	g.Wait()
+}
+
+// forward copies from src to dst, applying p's knobs to each chunk. If src
+// reaches EOF, dst is half-closed so the other direction may finish;
+// otherwise, on any failure, both connections are closed.
+func (p *Proxy) forward(dst, src net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !p.wait(n) {
+				break
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if tc, ok := dst.(*net.TCPConn); ok {
+				tc.CloseWrite() //nolint
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	src.Close()
+	dst.Close()
+}
+
+// wait blocks while p is paused, then sleeps for the latency and bandwidth
+// cost of forwarding n bytes. It reports false if p was closed.
+func (p *Proxy) wait(n int) bool {
+	p.mu.Lock()
+	for p.paused && !p.closed {
+		p.unpaused.Wait()
+	}
+	closed, latency, bw := p.closed, p.latency, p.bandwidth
+	p.mu.Unlock()
+	if closed {
+		return false
+	}
+
+	d := latency
+	if bw > 0 {
+		d += time.Duration(n) * time.Second / time.Duration(bw)
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return true
+}
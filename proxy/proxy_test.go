@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer returns the address of a server that echoes each line it
+// receives.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c) //nolint
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startProxy(t *testing.T) *Proxy {
+	t.Helper()
+	px, err := Listen(echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	return px
+}
+
+func roundTrip(t *testing.T, c net.Conn, r *bufio.Reader, msg string) (string, error) {
+	t.Helper()
+	if _, err := io.WriteString(c, msg+"\n"); err != nil {
+		return "", err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return line[:len(line)-1], nil
+}
+
+func dial(t *testing.T, px *Proxy) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", px.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, bufio.NewReader(c)
+}
+
+func TestForward(t *testing.T) {
+	px := startProxy(t)
+	c, r := dial(t, px)
+	got, err := roundTrip(t, c, r, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Errorf("got %q; want %q", got, "hello")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	px := startProxy(t)
+	const latency = 50 * time.Millisecond
+	px.SetLatency(latency)
+
+	c, r := dial(t, px)
+	start := time.Now()
+	if _, err := roundTrip(t, c, r, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	// one delay in each direction
+	if d := time.Since(start); d < 2*latency {
+		t.Errorf("round trip took %v; want at least %v", d, 2*latency)
+	}
+}
+
+func TestPause(t *testing.T) {
+	px := startProxy(t)
+	c, r := dial(t, px)
+
+	px.Pause()
+	done := make(chan string)
+	go func() {
+		got, _ := roundTrip(t, c, r, "paused")
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		t.Fatalf("got %q while paused", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	px.Resume()
+	if got := <-done; got != "paused" {
+		t.Errorf("got %q; want %q", got, "paused")
+	}
+}
+
+func TestDropConnections(t *testing.T) {
+	px := startProxy(t)
+	c, r := dial(t, px)
+	if _, err := roundTrip(t, c, r, "before"); err != nil {
+		t.Fatal(err)
+	}
+	px.DropConnections()
+	if _, err := roundTrip(t, c, r, "after"); err == nil {
+		t.Fatal("expected error after drop")
+	}
+
+	// new connections still work
+	c, r = dial(t, px)
+	if _, err := roundTrip(t, c, r, "again"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTarget(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	px, err := Listen(dead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { px.Close() })
+	c, r := dial(t, px)
+	if _, err := roundTrip(t, c, r, "dead"); err == nil {
+		t.Fatal("expected error forwarding to a closed port")
+	}
+
+	px.SetTarget(echoServer(t))
+	c, r = dial(t, px)
+	if got, err := roundTrip(t, c, r, "redirected"); err != nil || got != "redirected" {
+		t.Errorf("got %q, %v; want %q", got, err, "redirected")
+	}
+}
@@ -0,0 +1,123 @@
+package pqx
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+const recyclePrefix = "pqx_recycle_"
+
+// recycleKey returns a key identifying databases created by CreateDB with
+// schema and c, such that one may be reused in place of another.
+func recycleKey(schema string, c *dbConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%t\x00%t\x00%s", schema, c.template, c.tablespace, c.unlogged, c.fakeClock, seedName(c.seed))
+	fmt.Fprintf(h, "\x00%s\x00%s\x00%s\x00%s\x00%d", c.owner, c.encoding, c.collate, c.ctype, c.connLimit)
+	for _, name := range c.extensions {
+		fmt.Fprintf(h, "\x00extension\x00%s", name)
+	}
+	if c.restore != "" {
+		fmt.Fprintf(h, "\x00restore\x00%s", c.restore)
+		for _, m := range c.masks {
+			fmt.Fprintf(h, "\x00%s\x00%s\x00%s", m.Table, m.Column, m.Expr)
+		}
+	}
+	// The search path decides the schemas that unqualified names in
+	// schema create objects in.
+	for _, name := range c.searchPath {
+		fmt.Fprintf(h, "\x00search_path\x00%s", name)
+	}
+	for _, name := range sortedKeys(c.schemas) {
+		fmt.Fprintf(h, "\x00%s\x00%s", name, c.schemas[name])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// takeRecycled renames a recycled database for key to name, and reports
+// whether it did. The first call for key adopts recycled databases left by
+// previous runs.
+func (p *Postgres) takeRecycled(ctx context.Context, key, name string) bool {
+	p.rmu.Lock()
+	if p.recycled == nil {
+		p.recycled = map[string][]string{}
+	}
+	names, ok := p.recycled[key]
+	if !ok {
+		names = p.leftoverRecycled(ctx, key)
+	}
+	var old string
+	if len(names) > 0 {
+		old, names = names[len(names)-1], names[:len(names)-1]
+	}
+	p.recycled[key] = names
+	p.rmu.Unlock()
+
+	if old == "" {
+		return false
+	}
+	q := fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", pq.QuoteIdentifier(old), pq.QuoteIdentifier(name))
+	if _, err := p.db.ExecContext(ctx, q); err != nil {
+		p.log.debugf("pqx: reusing recycled database %s: %v", old, err)
+		return false
+	}
+	return true
+}
+
+// leftoverRecycled returns the names of recycled databases for key that
+// exist but are not known to p, such as those left by a previous run
+// against the same data directory.
+func (p *Postgres) leftoverRecycled(ctx context.Context, key string) []string {
+	rows, err := p.db.QueryContext(ctx, "SELECT datname FROM pg_database WHERE left(datname, length($1)) = $1", recyclePrefix+key+"_")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// recycleDB queues the database name to be reset and renamed for reuse by
+// takeRecycled with key. Databases are reset before being renamed, so any
+// database with a recycled name is ready for reuse.
+func (p *Postgres) recycleDB(key, name string) {
+	p.enqueue(func() {
+		ctx := context.Background()
+		newName := recyclePrefix + key + "_" + randomSuffix()
+
+		err := p.resetDB(ctx, name)
+		if err == nil {
+			// resetDB leaves no connections, but clients may have
+			// reconnected since.
+			_, err = p.KillConnections(ctx, name)
+		}
+		if err == nil {
+			// Likewise, settings may have been changed since
+			// resetDB removed them; configureDB applies those of
+			// the next user.
+			_, err = p.db.ExecContext(ctx, "ALTER DATABASE "+pq.QuoteIdentifier(name)+" RESET ALL")
+		}
+		if err == nil {
+			q := fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", pq.QuoteIdentifier(name), pq.QuoteIdentifier(newName))
+			_, err = p.db.ExecContext(ctx, q)
+		}
+		if err != nil {
+			p.log.infof("pqx: recycling database %s: %v; dropping it", name, err)
+			p.drop(name)
+			return
+		}
+
+		p.rmu.Lock()
+		p.recycled[key] = append(p.recycled[key], newName)
+		p.rmu.Unlock()
+	})
+}
@@ -0,0 +1,131 @@
+package pqx
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A Registry manages a set of named instances in one process, such as a
+// farm of servers for testing a sharding router or connection pooler. Each
+// instance keeps its data in a subdirectory of Dir named after it, with
+// characters other than letters, digits, and underscores replaced, and
+// listens on its own random port.
+type Registry struct {
+	// Dir is the directory instances keep their data in.
+	Dir string
+
+	// Configure, if not nil, is called with each new instance, before it
+	// is started, to set options such as Version or Logical. It must not
+	// set Dir or Port.
+	Configure func(name string, p *Postgres)
+
+	mu        sync.Mutex
+	instances map[string]*Postgres
+}
+
+// Start returns the instances with names, creating and starting any not
+// already started. Instances are started concurrently. If any fails to
+// start, the first error is returned, and those that failed are forgotten,
+// so that a later Start tries them again.
+func (r *Registry) Start(ctx context.Context, logf func(string, ...any), names ...string) ([]*Postgres, error) {
+	ps := make([]*Postgres, len(names))
+	r.mu.Lock()
+	if r.instances == nil {
+		r.instances = map[string]*Postgres{}
+	}
+	for i, name := range names {
+		p := r.instances[name]
+		if p == nil {
+			p = &Postgres{Dir: filepath.Join(r.Dir, instanceDir(name))}
+			if r.Configure != nil {
+				r.Configure(name, p)
+			}
+			r.instances[name] = p
+		}
+		ps[i] = p
+	}
+	r.mu.Unlock()
+
+	errs := make([]error, len(ps))
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		i, p := i, p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Start(ctx, prefixLogf(logf, "["+names[i]+"] ")); err != nil {
+				errs[i] = fmt.Errorf("pqx: starting %s: %w", names[i], err)
+				r.mu.Lock()
+				if r.instances[names[i]] == p {
+					delete(r.instances, names[i])
+				}
+				r.mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// instanceDir returns the name of the directory of the instance name.
+// Names are cleaned so their directories stay in Dir, and those changed
+// are suffixed with a hash of the name so they do not collide.
+func instanceDir(name string) string {
+	dir := cleanFileName(name)
+	if dir != name || name == "" {
+		sum := sha256.Sum256([]byte(name))
+		dir += "_" + hex.EncodeToString(sum[:4])
+	}
+	return dir
+}
+
+// Get returns the instance named name, or nil if it was not started by
+// Start.
+func (r *Registry) Get(name string) *Postgres {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.instances[name]
+}
+
+// Names returns the names of all instances, in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.instances))
+	for name := range r.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Shutdown shuts down all started instances and forgets them. It returns
+// the first error encountered, after attempting to shut down all
+// instances.
+func (r *Registry) Shutdown() error {
+	r.mu.Lock()
+	instances := r.instances
+	r.instances = nil
+	r.mu.Unlock()
+
+	var first error
+	for name, p := range instances {
+		if p.cmd == nil {
+			continue // failed to start
+		}
+		if err := p.Shutdown(); err != nil && first == nil {
+			first = fmt.Errorf("pqx: shutting down %s: %w", name, err)
+		}
+	}
+	return first
+}
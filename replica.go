@@ -0,0 +1,124 @@
+package pqx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"blake.io/pqx/proxy"
+)
+
+// A Replica is a hot standby instance that streams and replays the WAL of a
+// primary instance. Its embedded Postgres may be used like any other, except
+// that it only accepts read-only queries.
+type Replica struct {
+	*Postgres
+	primary *Postgres
+}
+
+// StartReplica creates a hot standby of p with pg_basebackup in dir, starts
+// it, and returns once it accepts read-only connections. The standby's data
+// directory is recreated if it already exists. It must only be called
+// after Start.
+//
+// The caller must call Shutdown on the returned Replica when finished.
+func (p *Postgres) StartReplica(ctx context.Context, logf func(string, ...any), dir string) (*Replica, error) {
+	if p.cmd == nil {
+		return nil, fmt.Errorf("pqx: StartReplica called before Start")
+	}
+	r := &Replica{
+		Postgres: p.sibling(dir),
+		primary:  p,
+	}
+	dataDir := r.dataDir()
+	if err := os.RemoveAll(dataDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dataDir), 0755); err != nil {
+		return nil, err
+	}
+	// -R writes standby.signal and primary_conninfo so the copy starts
+	// as a standby of p.
+	if err := p.baseBackup(ctx, dataDir, "-R"); err != nil {
+		return nil, err
+	}
+	if err := r.Start(ctx, logf); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// WaitForReplay waits until r has replayed all WAL written by its primary
+// before WaitForReplay was called, such that all transactions committed on
+// the primary are visible on r.
+func (r *Replica) WaitForReplay(ctx context.Context) error {
+	var lsn string
+	if err := r.primary.db.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()").Scan(&lsn); err != nil {
+		return err
+	}
+	return poll(ctx, func() (bool, error) {
+		var replayed bool
+		err := r.db.QueryRowContext(ctx, "SELECT coalesce(pg_last_wal_replay_lsn() >= $1::pg_lsn, false)", lsn).Scan(&replayed)
+		return replayed, err
+	})
+}
+
+// ReplayLSN returns the last WAL location replayed by r.
+func (r *Replica) ReplayLSN(ctx context.Context) (string, error) {
+	var lsn string
+	err := r.db.QueryRowContext(ctx, "SELECT pg_last_wal_replay_lsn()").Scan(&lsn)
+	return lsn, err
+}
+
+// PauseReplay pauses the replay of WAL on r, such that transactions
+// committed on the primary after PauseReplay returns are not visible on r
+// until ResumeReplay is called, simulating a lagging replica. WAL is still
+// received from the primary while paused.
+func (r *Replica) PauseReplay(ctx context.Context) error {
+	if _, err := r.db.ExecContext(ctx, "SELECT pg_wal_replay_pause()"); err != nil {
+		return err
+	}
+	// Pausing is only requested until replay reaches a point it can
+	// pause at, and WAL replayed until then is visible.
+	return poll(ctx, func() (bool, error) {
+		var state string
+		err := r.db.QueryRowContext(ctx, "SELECT pg_get_wal_replay_pause_state()").Scan(&state)
+		return state == "paused", err
+	})
+}
+
+// ResumeReplay resumes the replay of WAL on r paused by PauseReplay. Use
+// WaitForReplay to wait for r to catch up.
+func (r *Replica) ResumeReplay(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, "SELECT pg_wal_replay_resume()")
+	return err
+}
+
+// Promote promotes r to a primary that accepts writes, and waits for the
+// promotion to finish. The former primary keeps running independently;
+// writes to it are no longer replicated to r.
+func (r *Replica) Promote(ctx context.Context) error {
+	var ok bool
+	if err := r.db.QueryRowContext(ctx, "SELECT pg_promote(true, 60)").Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("pqx: promotion did not finish within 60 seconds")
+	}
+	return nil
+}
+
+// Failover promotes r, then redirects px, such as one passed to WithProxy
+// for a database on the primary, to r and drops the connections open
+// through it. Clients reconnecting with the DSN of px reach the same
+// database on r, as they would after a failover in production.
+func (r *Replica) Failover(ctx context.Context, px *proxy.Proxy) error {
+	if err := r.Promote(ctx); err != nil {
+		return err
+	}
+	px.SetTarget(r.Addr())
+	px.DropConnections()
+	return nil
+}
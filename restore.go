@@ -0,0 +1,98 @@
+package pqx
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// A Mask is a column-level transformation applied to data restored by
+// WithRestore, to sanitize production-like data before tests use it.
+type Mask struct {
+	Table  string // the table, optionally schema-qualified, like "app.users"
+	Column string
+
+	// Expr is the SQL expression computing the column's new value, which
+	// may refer to the column's current value by its name.
+	Expr string
+}
+
+// HashMask returns a Mask replacing the values of column in table with
+// their MD5 hashes, which keeps equal values equal and distinct values
+// distinct, preserving joins and unique constraints.
+func HashMask(table, column string) Mask {
+	return Mask{Table: table, Column: column, Expr: "md5(" + pq.QuoteIdentifier(column) + "::text)"}
+}
+
+// EmailMask is like HashMask, but keeps the values valid email addresses
+// at example.com.
+func EmailMask(table, column string) Mask {
+	return Mask{Table: table, Column: column, Expr: "md5(" + pq.QuoteIdentifier(column) + "::text) || '@example.com'"}
+}
+
+// NullMask returns a Mask setting column in table to NULL.
+func NullMask(table, column string) Mask {
+	return Mask{Table: table, Column: column, Expr: "NULL"}
+}
+
+// restore restores the dump in file into the database name, using
+// pg_restore for dumps in pg_dump's custom or directory formats, and psql
+// for plain SQL scripts.
+func (p *Postgres) restore(ctx context.Context, name, file string) error {
+	var cmd *exec.Cmd
+	if isArchiveDump(file) {
+		cmd = exec.CommandContext(ctx, filepath.Join(p.binDir, "pg_restore"),
+			"--no-owner", "--no-privileges", "--exit-on-error",
+			"--dbname", p.connDSN(name), file)
+	} else {
+		cmd = exec.CommandContext(ctx, filepath.Join(p.binDir, "psql"),
+			"-X", "-q", "-v", "ON_ERROR_STOP=1",
+			"--dbname", p.connDSN(name), "--file", file)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pqx: restoring %s: %w\n%s", file, err, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
+
+// isArchiveDump reports whether file is a dump for pg_restore, rather than
+// a plain SQL script: a directory, or a file in the custom format.
+func isArchiveDump(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false // let psql report the error
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return true
+	}
+	magic := make([]byte, 5)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == "PGDMP"
+}
+
+// applyMasks applies masks to the data in db.
+func applyMasks(ctx context.Context, db *sql.DB, masks []Mask) error {
+	for _, m := range masks {
+		var table []string
+		for _, part := range strings.Split(m.Table, ".") {
+			table = append(table, pq.QuoteIdentifier(part))
+		}
+		q := fmt.Sprintf("UPDATE %s SET %s = %s", strings.Join(table, "."), pq.QuoteIdentifier(m.Column), m.Expr)
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("pqx: masking %s.%s: %w", m.Table, m.Column, err)
+		}
+	}
+	return nil
+}
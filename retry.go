@@ -0,0 +1,95 @@
+package pqx
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"blake.io/pqx/internal/backoff"
+	"github.com/lib/pq"
+)
+
+// defaultCreateAttempts is the number of times CreateDB tries to create a
+// database while it fails with transient connection errors, unless
+// CreateAttempts is set.
+const defaultCreateAttempts = 3
+
+// createDatabase runs the CREATE DATABASE statement q for name, retrying
+// if it fails with a transient connection error, such as a connection
+// reset by a server under load. Before retrying, it discards the idle
+// control connections and pings postgres, so the retry uses a fresh one.
+func (p *Postgres) createDatabase(ctx context.Context, name, q string) error {
+	b := backoff.NewBackoff("create", p.log.debugf, time.Second)
+	b.Strategy = p.Backoff
+	b.Strategy.MaxAttempts = p.CreateAttempts
+	if b.Strategy.MaxAttempts == 0 {
+		b.Strategy.MaxAttempts = defaultCreateAttempts
+	}
+	retried := false
+	for {
+		_, err := p.db.ExecContext(ctx, q)
+		if retried && sqlState(err) == "42P04" { // duplicate_database
+			// The failed attempt created it before losing its
+			// connection.
+			return nil
+		}
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		b.BackOff(ctx, err)
+		if b.Exhausted() || ctx.Err() != nil {
+			return err
+		}
+		p.log.infof("pqx: creating database %s: %v; retrying (attempt %d)", name, err, b.Attempts()+1)
+		p.resetControlConns(ctx)
+		retried = true
+	}
+}
+
+// resetControlConns closes the idle connections p uses to manage postgres,
+// which may have been broken, and pings it with a new one.
+func (p *Postgres) resetControlConns(ctx context.Context) {
+	p.db.SetMaxIdleConns(0)
+	p.db.SetMaxIdleConns(2) // the database/sql default
+	if err := p.db.PingContext(ctx); err != nil {
+		p.log.debugf("pqx: ping after connection error: %v", err)
+	}
+}
+
+// isTransient reports whether err is a connection error that retrying on
+// a new connection may not repeat.
+func isTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if code := sqlState(err); code != "" {
+		switch code {
+		case "53300", // too_many_connections
+			"57P01", // admin_shutdown, such as a terminated backend
+			"57P03": // cannot_connect_now
+			return true
+		}
+		return strings.HasPrefix(code, "08") // connection_exception
+	}
+	var ne *net.OpError
+	return errors.As(err, &ne)
+}
+
+// sqlState returns the SQLSTATE code of the postgres error in err's chain,
+// reported by lib/pq or by a driver whose errors have a SQLState method,
+// such as pgx. Otherwise, it returns "".
+func sqlState(err error) string {
+	var pe *pq.Error
+	if errors.As(err, &pe) {
+		return string(pe.Code)
+	}
+	var se interface{ SQLState() string }
+	if errors.As(err, &se) {
+		return se.SQLState()
+	}
+	return ""
+}
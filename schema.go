@@ -0,0 +1,131 @@
+package pqx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// setUnlogged converts all ordinary, permanent user tables in db's database
+// to UNLOGGED.
+//
+// A permanent table may not reference an unlogged one, so a table can only
+// be converted after all tables referencing it are. Rather than sorting
+// tables by their foreign keys, conversion is retried until every table is
+// converted or no more progress can be made.
+func setUnlogged(ctx context.Context, db *sql.DB) error {
+	const q = `
+		SELECT format('%I.%I', n.nspname, c.relname)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'r'
+		  AND c.relpersistence = 'p'
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND n.nspname NOT LIKE 'pg_toast%'`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for len(pending) > 0 {
+		var failed []string
+		var firstErr error
+		for _, table := range pending {
+			if _, err := db.ExecContext(ctx, "ALTER TABLE "+table+" SET UNLOGGED"); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed = append(failed, table)
+			}
+		}
+		if len(failed) == len(pending) {
+			return fmt.Errorf("pqx: converting %s to UNLOGGED: %w", failed[0], firstErr)
+		}
+		pending = failed
+	}
+	return nil
+}
+
+// applySchemas creates each schema in schemas, keyed by name, and applies
+// its DDL with the schema first in the search_path, followed by the others
+// and public, so unqualified names are created in it and may refer to
+// objects in the others.
+//
+// Like setUnlogged, rather than working out the order schemas depend on
+// each other in, schemas that fail are retried until all are applied or no
+// more progress can be made. Each attempt is made in a transaction, so a
+// failed one leaves nothing behind.
+func applySchemas(ctx context.Context, db *sql.DB, schemas map[string]string) error {
+	names := sortedKeys(schemas)
+	pending := names
+	for len(pending) > 0 {
+		var failed []string
+		var firstErr error
+		for _, name := range pending {
+			if err := applySchema(ctx, db, name, schemas[name], names); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("pqx: applying schema %s: %w", name, queryError(schemas[name], err))
+				}
+				failed = append(failed, name)
+			}
+		}
+		if len(failed) == len(pending) {
+			return firstErr
+		}
+		pending = failed
+	}
+	return nil
+}
+
+func applySchema(ctx context.Context, db *sql.DB, name, ddl string, all []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint
+
+	path := []string{pq.QuoteIdentifier(name)}
+	for _, s := range all {
+		if s != name {
+			path = append(path, pq.QuoteIdentifier(s))
+		}
+	}
+	path = append(path, "public")
+	stmts := []string{
+		"CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(name),
+		"SET LOCAL search_path = " + strings.Join(path, ", "),
+		ddl,
+	}
+	for _, q := range stmts {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
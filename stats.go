@@ -0,0 +1,64 @@
+package pqx
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SetupStats reports the time a Postgres spent setting up postgres and
+// databases, for tracking the overhead of database tests.
+type SetupStats struct {
+	Fetch        time.Duration // finding, or downloading, postgres binaries
+	FetchCached  bool          // whether the binaries were already downloaded
+	Prepare      time.Duration // preparing directories and a port, while fetching
+	Initdb       time.Duration // initializing the data directory
+	InitdbCached bool          // whether the data directory was already initialized
+	Start        time.Duration // starting postgres until it accepted connections
+	Boot         time.Duration // all of the above; less than their sum, as some overlap
+
+	CreateDBs    int           // databases created by CreateDB
+	CreateDBTime time.Duration // total time spent in successful calls to CreateDB
+
+	TemplateHits   int // template databases reused, by Template or WithSeed
+	TemplateMisses int // template databases created
+}
+
+// String formats s like "fetch 0ms (cached), initdb 0ms (cached), start
+// 612ms, boot 640ms, 143 CreateDB avg 38ms, 9 template hits".
+func (s SetupStats) String() string {
+	ms := func(d time.Duration) string { return fmt.Sprintf("%dms", d.Milliseconds()) }
+	cached := func(c bool) string {
+		if c {
+			return " (cached)"
+		}
+		return ""
+	}
+	parts := []string{
+		"fetch " + ms(s.Fetch) + cached(s.FetchCached),
+		"initdb " + ms(s.Initdb) + cached(s.InitdbCached),
+		"start " + ms(s.Start),
+		"boot " + ms(s.Boot),
+	}
+	if s.CreateDBs > 0 {
+		avg := s.CreateDBTime / time.Duration(s.CreateDBs)
+		parts = append(parts, fmt.Sprintf("%d CreateDB avg %s", s.CreateDBs, ms(avg)))
+	}
+	if s.TemplateHits+s.TemplateMisses > 0 {
+		parts = append(parts, fmt.Sprintf("%d template hits", s.TemplateHits))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SetupStats returns the time p has spent setting up so far.
+func (p *Postgres) SetupStats() SetupStats {
+	p.smu.Lock()
+	defer p.smu.Unlock()
+	return p.setup
+}
+
+func (p *Postgres) recordSetup(f func(*SetupStats)) {
+	p.smu.Lock()
+	defer p.smu.Unlock()
+	f(&p.setup)
+}
@@ -0,0 +1,137 @@
+package pqx
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type template struct {
+	mu   sync.Mutex
+	name string // set once created
+}
+
+// Template returns the name of a database with schema applied, for use with
+// WithTemplate. The database is created the first time Template is called
+// with schema and reused by later calls, so databases cloned from it skip
+// the cost of applying schema. It replaces any template database left by a
+// previous run.
+//
+// Template databases are not dropped until the instance's data directory is
+// removed.
+func (p *Postgres) Template(ctx context.Context, logf func(string, ...any), schema string) (string, error) {
+	return p.template(ctx, logf, schema, &dbConfig{})
+}
+
+// template returns the name of a template database populated with schema
+// and c, as CreateDB would populate a database, creating it if needed.
+func (p *Postgres) template(ctx context.Context, logf func(string, ...any), schema string, c *dbConfig) (string, error) {
+	if err := p.startServer(ctx, logf); err != nil {
+		return "", err
+	}
+	hash := recycleKey(schema, c)
+
+	p.tmu.Lock()
+	if p.templates == nil {
+		p.templates = map[string]*template{}
+	}
+	tt := p.templates[hash]
+	if tt == nil {
+		tt = &template{}
+		p.templates[hash] = tt
+	}
+	p.tmu.Unlock()
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.name != "" {
+		p.recordSetup(func(s *SetupStats) { s.TemplateHits++ })
+		return tt.name, nil
+	}
+	p.recordSetup(func(s *SetupStats) { s.TemplateMisses++ })
+	name := "pqx_template_" + hash
+	if err := p.createTemplate(ctx, logf, name, schema, c); err != nil {
+		return "", err
+	}
+	tt.name = name
+	return name, nil
+}
+
+func (p *Postgres) createTemplate(ctx context.Context, logf func(string, ...any), name, schema string, c *dbConfig) error {
+	defer p.out.Flush()
+	p.watch(name, logf)
+	defer p.out.Unwatch(name)
+
+	if err := p.replaceDB(ctx, name); err != nil {
+		return err
+	}
+	if _, err := p.db.ExecContext(ctx, createDBQuery(name, c)); err != nil {
+		return err
+	}
+	if schema == "" && !c.fakeClock && len(c.schemas) == 0 && !c.needsTemplate() {
+		return nil
+	}
+	// Objects are created with the search_path CreateDB sets.
+	if err := p.configureDB(ctx, name, c); err != nil {
+		return err
+	}
+	db, err := openDB(p.connDSN(name), &dbConfig{})
+	if err != nil {
+		return err
+	}
+	// Databases cannot be cloned while connected to, so close before
+	// returning.
+	defer db.Close()
+	if err := p.populate(ctx, db, name, schema, c); err != nil {
+		return fmt.Errorf("pqx: creating template: %w", err)
+	}
+	// Statistics are copied along with the data, so analyze once here
+	// rather than in each copy.
+	_, err = db.ExecContext(ctx, "ANALYZE")
+	return err
+}
+
+// Reset prepares p for another run of the same tests, such as another call
+// to testing.M.Run against the same instance. It waits for queued drops to
+// finish, and drops all template and recycled databases, and those of the
+// pool, so that later calls start from scratch.
+func (p *Postgres) Reset(ctx context.Context) error {
+	p.waitDrops()
+
+	p.tmu.Lock()
+	var names []string
+	for _, tt := range p.templates {
+		tt.mu.Lock()
+		if tt.name != "" {
+			names = append(names, tt.name)
+		}
+		tt.mu.Unlock()
+	}
+	p.templates = nil
+	p.tmu.Unlock()
+
+	p.rmu.Lock()
+	for _, rs := range p.recycled {
+		names = append(names, rs...)
+	}
+	p.recycled = nil
+	p.rmu.Unlock()
+
+	p.pmu.Lock()
+	if p.pool != nil {
+		p.pool.mu.Lock()
+		names = append(names, p.pool.free...)
+		p.pool.free = nil
+		p.pool.mu.Unlock()
+		p.pool = nil
+	}
+	p.pmu.Unlock()
+
+	for _, name := range names {
+		if err := p.replaceDB(ctx, name); err != nil {
+			return err
+		}
+	}
+	p.out.Flush()
+	return nil
+}
@@ -0,0 +1,181 @@
+package pqx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A certAuthority signs the server and client certificates generated for
+// ClientCerts.
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// tlsSettings returns the settings enabling TLS, using the files written
+// by writeAuthFiles.
+func (p *Postgres) tlsSettings() [][2]string {
+	if !p.ClientCerts {
+		return nil
+	}
+	dir := p.authDir()
+	return [][2]string{
+		{"ssl", "on"},
+		{"ssl_cert_file", filepath.Join(dir, "server.crt")},
+		{"ssl_key_file", filepath.Join(dir, "server.key")},
+		{"ssl_ca_file", filepath.Join(dir, "root.crt")},
+	}
+}
+
+// writeCerts writes a newly generated certificate authority and server
+// certificate to dir.
+func (p *Postgres) writeCerts(dir string) error {
+	ca, err := newCertAuthority()
+	if err != nil {
+		return err
+	}
+	if err := writeCert(filepath.Join(dir, "root"), ca.cert, ca.key); err != nil {
+		return err
+	}
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if err := ca.issue(filepath.Join(dir, "server"), server); err != nil {
+		return err
+	}
+	p.ca = ca
+	return nil
+}
+
+func newCertAuthority() (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pqx test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// issue signs a certificate for tmpl, with a new key, and writes them to
+// base followed by ".crt" and ".key".
+func (ca *certAuthority) issue(base string, tmpl *x509.Certificate) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = ca.cert.NotAfter
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	return writeCert(base, cert, key)
+}
+
+// writeCert writes cert and key, PEM encoded, to base followed by ".crt"
+// and ".key". The key is only readable by its owner, as postgres and
+// lib/pq require.
+func writeCert(base string, cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := os.WriteFile(base+".crt", crt, 0644); err != nil {
+		return err
+	}
+	// Remove any existing key first, since WriteFile does not change
+	// the permissions of existing files.
+	os.Remove(base + ".key") //nolint
+	return os.WriteFile(base+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+// ClientCert generates a client certificate, signed by the certificate
+// authority generated for ClientCerts, that authenticates connections
+// over TLS as the role user, and returns the paths of the certificate, its
+// key, and the authority's certificate, for use as the sslcert, sslkey, and
+// sslrootcert of a DSN. See ClientCertDSN.
+//
+// The authority is regenerated, and previously generated client
+// certificates no longer accepted, each time p starts.
+func (p *Postgres) ClientCert(user string) (certFile, keyFile, rootCertFile string, err error) {
+	if p.ca == nil {
+		return "", "", "", errors.New("pqx: ClientCert requires ClientCerts to be set and postgres to be started")
+	}
+	base := filepath.Join(p.authDir(), "client_"+cleanFileName(user))
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: user},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if err := p.ca.issue(base, tmpl); err != nil {
+		return "", "", "", err
+	}
+	return base + ".crt", base + ".key", filepath.Join(p.authDir(), "root.crt"), nil
+}
+
+// ClientCertDSN returns a DSN for connecting to the database dbname over
+// TLS as the role user, authenticating with a client certificate generated
+// by ClientCert, and verifying the server's certificate.
+func (p *Postgres) ClientCertDSN(dbname, user string) (string, error) {
+	cert, key, root, err := p.ClientCert(user)
+	if err != nil {
+		return "", err
+	}
+	// Later values take precedence over those in the DSN from p.DSN.
+	dsn := p.DSN(dbname) + " sslmode=verify-full user=" + quoteDSNValue(user)
+	dsn += " sslcert=" + quoteDSNValue(cert)
+	dsn += " sslkey=" + quoteDSNValue(key)
+	dsn += " sslrootcert=" + quoteDSNValue(root)
+	return dsn, nil
+}
+
+// cleanFileName returns name with characters other than letters, digits,
+// and underscores replaced, for use in file names.
+func cleanFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,136 @@
+package pqx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"blake.io/pqx/internal/backoff"
+	"blake.io/pqx/internal/fetch"
+)
+
+// Upgrade upgrades the data of the instance kept in dir, as given by
+// Postgres.Dir, from postgres version fromVer to toVer using the
+// pg_upgrade bundled with toVer, so that it may be started with Version set
+// to toVer without losing its data. The data for fromVer is left in place.
+//
+// The data for toVer is initialized with the superuser and data checksums
+// setting of the data for fromVer, as pg_upgrade requires. The instance
+// must not be running, and must not yet have data for toVer.
+func Upgrade(ctx context.Context, dir, fromVer, toVer string) error {
+	oldData := filepath.Join(dir, fromVer, "data")
+	newData := filepath.Join(dir, toVer, "data")
+	if !isPostgresDir(oldData) {
+		return fmt.Errorf("pqx: Upgrade: no data for %s in %s", fromVer, dir)
+	}
+	if isPostgresDir(newData) {
+		return fmt.Errorf("pqx: Upgrade: data for %s already exists in %s", toVer, dir)
+	}
+	nologf := func(string, ...any) {}
+	oldBin, err := fetch.Binary(ctx, "", fromVer, backoff.Strategy{}, nologf)
+	if err != nil {
+		return err
+	}
+	newBin, err := fetch.Binary(ctx, "", toVer, backoff.Strategy{}, nologf)
+	if err != nil {
+		return err
+	}
+
+	user, err := installUser(ctx, oldBin, oldData)
+	if err != nil {
+		return fmt.Errorf("pqx: Upgrade: %w", err)
+	}
+	args := []string{"-U", user}
+	checksums, err := hasChecksums(ctx, oldBin, oldData)
+	if err != nil {
+		return fmt.Errorf("pqx: Upgrade: %w", err)
+	}
+	if checksums {
+		args = append(args, "--data-checksums")
+	}
+
+	var out bytes.Buffer
+	if err := os.MkdirAll(filepath.Dir(newData), 0755); err != nil {
+		return err
+	}
+	if err := initdb(ctx, &out, newBin, newData, args...); err != nil {
+		return fmt.Errorf("pqx: Upgrade: initdb: %w\n%s", err, out.Bytes())
+	}
+
+	// pg_upgrade writes its logs to the working directory.
+	work, err := os.MkdirTemp("", "pqx-upgrade")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	oldPort, err := reservePort("")
+	if err != nil {
+		return err
+	}
+	defer releasePort(oldPort)
+	newPort, err := reservePort("")
+	if err != nil {
+		return err
+	}
+	defer releasePort(newPort)
+	cmd := exec.CommandContext(ctx, filepath.Join(newBin, "pg_upgrade"),
+		"-b", oldBin,
+		"-B", newBin,
+		"-d", oldData,
+		"-D", newData,
+		"-p", oldPort,
+		"-P", newPort,
+		"-U", user,
+	)
+	cmd.Dir = work
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		// Leave no half-upgraded data behind for Start to find.
+		os.RemoveAll(newData) //nolint
+		return fmt.Errorf("pqx: Upgrade: pg_upgrade: %w\n%s", err, out.Bytes())
+	}
+	return nil
+}
+
+// installUser returns the name of the superuser created by initdb for the
+// data in dataDir, which must not be in use, by querying it in single-user
+// mode.
+func installUser(ctx context.Context, binDir, dataDir string) (string, error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, filepath.Join(binDir, "postgres"), "--single", "-D", dataDir, "template1")
+	cmd.Stdin = strings.NewReader("SELECT rolname FROM pg_authid WHERE oid = 10;\n")
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("finding superuser: %w\n%s", err, stderr.Bytes())
+	}
+	// Rows are printed like: 1: rolname = "alice"	(typeid = 19, ...)
+	m := regexp.MustCompile(`rolname = "([^"]*)"`).FindSubmatch(out.Bytes())
+	if m == nil {
+		return "", fmt.Errorf("finding superuser: unexpected output:\n%s", out.Bytes())
+	}
+	return string(m[1]), nil
+}
+
+// hasChecksums reports whether the data in dataDir has data checksums
+// enabled, according to pg_controldata.
+func hasChecksums(ctx context.Context, binDir, dataDir string) (bool, error) {
+	cmd := exec.CommandContext(ctx, filepath.Join(binDir, "pg_controldata"), "-D", dataDir)
+	cmd.Env = append(os.Environ(), "LC_ALL=C") // untranslated labels
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("pg_controldata: %w\n%s", err, out)
+	}
+	m := regexp.MustCompile(`(?m)^Data page checksum version:\s*(\d+)`).FindSubmatch(out)
+	if m == nil {
+		return false, fmt.Errorf("pg_controldata: no checksum version in output:\n%s", out)
+	}
+	return string(m[1]) != "0", nil
+}